@@ -0,0 +1,156 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/z0rr0/exchange/rates"
+)
+
+// compressors are constructors of supported response compression algorithms writers.
+var compressors = map[string]func(io.Writer) io.WriteCloser{
+	rates.CompressGzip: func(w io.Writer) io.WriteCloser {
+		return gzip.NewWriter(w)
+	},
+	// HTTP "deflate" is zlib format (RFC 1950), not raw DEFLATE stream
+	rates.CompressDeflate: func(w io.Writer) io.WriteCloser {
+		return zlib.NewWriter(w)
+	},
+}
+
+// acceptedEncoding returns the configured compression algorithm most preferred
+// by request header "Accept-Encoding", configured order resolves ties.
+// It is empty if compression is disabled or no algorithm is acceptable.
+func acceptedEncoding(r *http.Request, cfg *rates.Cfg) string {
+	if cfg.CompressMinSize == 0 {
+		return ""
+	}
+	weights := make(map[string]float64)
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			if value := strings.TrimSpace(param); strings.HasPrefix(value, "q=") {
+				v, err := strconv.ParseFloat(value[2:], 64)
+				if err != nil {
+					v = 0
+				}
+				q = v
+			}
+		}
+		weights[name] = q
+	}
+	best, bestQ := "", 0.0
+	for _, name := range cfg.CompressAlgorithms {
+		q, ok := weights[name]
+		if !ok {
+			q = weights["*"]
+		}
+		if q > bestQ {
+			best, bestQ = name, q
+		}
+	}
+	return best
+}
+
+// compressWriter is a ResponseWriter compressing responses not less than minSize bytes.
+// The response beginning is buffered until the size is known to be enough.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+	code     int
+	buf      []byte
+	decided  bool
+	cw       io.WriteCloser
+}
+
+// newCompressWriter returns new compressWriter with the encoding algorithm.
+func newCompressWriter(w http.ResponseWriter, encoding string, minSize int) *compressWriter {
+	w.Header().Add("Vary", "Accept-Encoding")
+	return &compressWriter{ResponseWriter: w, encoding: encoding, minSize: minSize, code: http.StatusOK}
+}
+
+// WriteHeader delays the status code until compression is decided.
+func (w *compressWriter) WriteHeader(code int) {
+	if w.decided {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.code = code
+}
+
+// Write buffers p while the response is shorter than minSize, then compresses it.
+func (w *compressWriter) Write(p []byte) (int, error) {
+	if w.decided {
+		if w.cw != nil {
+			return w.cw.Write(p)
+		}
+		return w.ResponseWriter.Write(p)
+	}
+	w.buf = append(w.buf, p...)
+	if len(w.buf) >= w.minSize {
+		if err := w.start(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// start writes the status code and buffered data, they are compressed if compress is set
+// and the response is not already encoded.
+func (w *compressWriter) start(compress bool) error {
+	w.decided = true
+	h := w.Header()
+	if compress && h.Get("Content-Encoding") == "" {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", w.encoding)
+		w.cw = compressors[w.encoding](w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(w.code)
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// Flush sends buffered data, a response which is still short is not compressed.
+func (w *compressWriter) Flush() {
+	if !w.decided {
+		if err := w.start(false); err != nil {
+			loggerError.Println(err.Error())
+		}
+	}
+	if f, ok := w.cw.(interface{ Flush() error }); ok {
+		if err := f.Flush(); err != nil {
+			loggerError.Println(err.Error())
+		}
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close finishes the response, it must be called after the handler.
+func (w *compressWriter) Close() error {
+	if !w.decided {
+		if err := w.start(false); err != nil {
+			return err
+		}
+	}
+	if w.cw != nil {
+		return w.cw.Close()
+	}
+	return nil
+}
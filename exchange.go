@@ -3,21 +3,31 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"html/template"
+	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	"mime"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/z0rr0/exchange/rates"
+	"github.com/z0rr0/exchange/rpc"
 )
 
 const (
@@ -29,6 +39,12 @@ const (
 	interruptPrefix = "interrupt signal"
 	// shutdownTimeout is connections' graceful shutdown timeout
 	shutdownTimeout = time.Second * 2
+	// timeoutHeader is a request header of custom timeout in milliseconds
+	timeoutHeader = "X-Timeout-Ms"
+	// maxBodySize is maximum size of JSON request body
+	maxBodySize = 64 << 10 // 64KB
+	// maxQueries is maximum number of queries in JSON request body
+	maxQueries = 100
 )
 
 var (
@@ -40,12 +56,61 @@ var (
 	Date = "2016-01-01_01:01:01UTC"
 	// GoVersion is runtime Go language version
 	GoVersion = runtime.Version()
+	// errBodyTooLarge is an error of JSON request body exceeding maxBodySize
+	errBodyTooLarge = errors.New("request body too large")
 
 	// requiredCodes are default required codes
 	requiredCodes = map[string][]string{
-		"USD": {"$", "dollar", "доллар"},
-		"EUR": {"€", "euro", "евро"},
-		"RUB": {"₽", "rub", "руб"},
+		"USD": {"$", "dollar", "dollars", "доллар", "доллара", "долларов", "долларах"},
+		"EUR": {"€", "euro", "euros", "евро"},
+		"RUB": {"₽", "rub", "ruble", "rubles", "руб", "рубль", "рубля", "рублей", "рублях"},
+	}
+	// ratesPage is HTML page template of rates info, items should have ordered values
+	ratesPage = template.Must(template.New("rates").Funcs(template.FuncMap{"format": rates.FormatValueScale}).Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="UTF-8"><title>Exchange rates {{.Date}}</title></head>
+<body>
+<h1>{{.Date}}</h1>
+<table>
+{{- range .Rates}}
+<tr><th>{{.Msg}}</th>{{range .Values}}<td>{{format .Code .Value $.Scale}}</td>{{end}}</tr>
+{{- end}}
+</table>
+</body>
+</html>
+`))
+	// formPage is HTML page template of rates query form
+	formPage = template.Must(template.New("form").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="UTF-8"><title>Exchange rates</title></head>
+<body>
+<h1>Exchange rates</h1>
+<form method="get">
+<input type="text" name="q" placeholder="{{.}}">
+<input type="date" name="d">
+<button type="submit">Convert</button>
+</form>
+</body>
+</html>
+`))
+	// projectionFields are names of rates response fields for "fields" parameter
+	projectionFields = map[string]bool{
+		"date":       true,
+		"rates":      true,
+		"trend":      true,
+		"basket":     true,
+		"precision":  true,
+		"cached":     true,
+		"cache_date": true,
+		"timestamp":  true,
+		"source":     true,
+		"msg":        true,
+		"rate":       true,
+		"raw":        true,
+		"inverse":    true,
+		"values":     true,
+		"ratio":      true,
+		"currencies": true,
 	}
 	// internal loggers
 	loggerError = log.New(os.Stderr, fmt.Sprintf("ERROR [%v]: ", Name), log.Ldate|log.Ltime|log.Lshortfile)
@@ -54,8 +119,34 @@ var (
 
 // helpParameters is info about HTTP parameters
 type helpParameters struct {
-	D string `json:"d"`
-	Q string `json:"q"`
+	D           string `json:"d"`
+	Q           string `json:"q"`
+	Search      string `json:"search"`
+	RUB         string `json:"rub"`
+	To          string `json:"to"`
+	Ratio       string `json:"ratio"`
+	From        string `json:"from"`
+	Ordered     string `json:"ordered"`
+	Raw         string `json:"raw"`
+	Fields      string `json:"fields"`
+	Trend       string `json:"trend"`
+	Basket      string `json:"basket"`
+	Verbose     string `json:"verbose"`
+	Base        string `json:"base"`
+	Threshold   string `json:"threshold"`
+	Timestamp   string `json:"timestamp"`
+	Currency    string `json:"currency"`
+	Op          string `json:"op"`
+	Value       string `json:"value"`
+	Format      string `json:"format"`
+	Receipt     string `json:"receipt"`
+	Precision   string `json:"precision"`
+	Time        string `json:"time"`
+	Numeric     string `json:"numeric"`
+	Metadata    string `json:"metadata"`
+	Interpolate string `json:"interpolate"`
+	Rounding    string `json:"rounding"`
+	Amount      string `json:"amount"`
 }
 
 // help is help data structure
@@ -63,28 +154,1070 @@ type help struct {
 	P       helpParameters `json:"parameters"`
 	V       string         `json:"version"`
 	Comment string         `json:"comment"`
+	// Codes are recognized currencies codes with their aliases.
+	Codes map[string][]string `json:"codes"`
+}
+
+// jsonQuery is JSON request body of rates request.
+type jsonQuery struct {
+	Queries []string `json:"queries"`
+	Date    string   `json:"date"`
+}
+
+// buyInfo is a response of currency buying request.
+type buyInfo struct {
+	Date    string         `json:"date"`
+	RUB     float64        `json:"rub"`
+	To      string         `json:"to"`
+	Value   float64        `json:"value"`
+	Source  rates.Source   `json:"source"`
+	Receipt *rates.Receipt `json:"receipt,omitempty"`
+	// Markup is a percentage of the rate markup applied to Value,
+	// Unmarked is a value without the markup.
+	Markup   float64 `json:"markup"`
+	Unmarked float64 `json:"unmarked"`
+}
+
+// convertInfo is a response of currencies pair conversion request,
+// its date is a date of used rates.
+type convertInfo struct {
+	Date    string         `json:"date"`
+	From    string         `json:"from"`
+	To      string         `json:"to"`
+	Amount  float64        `json:"amount"`
+	Value   float64        `json:"value"`
+	Source  rates.Source   `json:"source"`
+	Receipt *rates.Receipt `json:"receipt,omitempty"`
+}
+
+// alertInfo is a result of currency RUB rate threshold check.
+type alertInfo struct {
+	Date     string       `json:"date"`
+	Currency string       `json:"currency"`
+	Op       string       `json:"op"`
+	Value    float64      `json:"value"`
+	Rate     float64      `json:"rate"`
+	Alert    bool         `json:"alert"`
+	Source   rates.Source `json:"source"`
+}
+
+// alertEpsilon is relative tolerance of equal alert rates.
+const alertEpsilon = 1e-12
+
+// alertOps are threshold check operators, a rate is the first argument.
+// Not rounded rates are compared, so "eq" ignores float64 division errors.
+var alertOps = map[string]func(rate, value float64) bool{
+	"gt": func(rate, value float64) bool { return rate > value },
+	"lt": func(rate, value float64) bool { return rate < value },
+	"eq": func(rate, value float64) bool { return math.Abs(rate-value) <= alertEpsilon*math.Abs(value) },
 }
 
 // interrupt catches custom signals.
 func interrupt(errc chan error) {
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
 	errc <- fmt.Errorf("%v %v", interruptPrefix, <-c)
 }
 
-// helpFunc writes help info to ResponseWriter and returns HTTP status code.
-func helpFunc(w http.ResponseWriter, r *http.Request, h *help) int {
+// writeJSON writes v as JSON to ResponseWriter and returns HTTP status code.
+// Fields names are converted to camelCase if it is the configured naming.
+func writeJSON(w http.ResponseWriter, v interface{}, cfg *rates.Cfg) int {
+	data, err := encodeJSON(v, cfg)
+	if err != nil {
+		code := http.StatusInternalServerError
+		http.Error(w, http.StatusText(code), code)
+		loggerError.Println(err.Error())
+		return code
+	}
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	encoder := json.NewEncoder(w)
-	if err := encoder.Encode(h); err != nil {
+	if _, err := w.Write(data); err != nil {
+		loggerError.Println(err.Error())
+	}
+	return http.StatusOK
+}
+
+// writeText writes rates info as plain text with values formatted
+// by currencies native locales and returns HTTP status code.
+// Values have scale decimal places, it is the standard scale of currency if scale is negative.
+// Info items should have values in the configured order.
+func writeText(w http.ResponseWriter, info *rates.Info, scale int) int {
+	var b strings.Builder
+	b.WriteString(info.Date + "\n")
+	for _, item := range info.Rates {
+		b.WriteString(item.Msg + "\n")
+		for _, v := range item.Values {
+			fmt.Fprintf(&b, "\t%v: %v\n", v.Code, rates.FormatValueScale(v.Code, v.Value, scale))
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	if _, err := io.WriteString(w, b.String()); err != nil {
+		loggerError.Println(err.Error())
+	}
+	return http.StatusOK
+}
+
+// writeHTML writes rates info as HTML page and returns HTTP status code.
+// Values are formatted with scale decimal places like writeText.
+func writeHTML(w http.ResponseWriter, info *rates.Info, scale int) int {
+	var buf bytes.Buffer
+	page := struct {
+		*rates.Info
+		Scale int
+	}{info, scale}
+	if err := ratesPage.Execute(&buf, page); err != nil {
 		code := http.StatusInternalServerError
 		http.Error(w, http.StatusText(code), code)
 		loggerError.Println(err.Error())
 		return code
 	}
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	if _, err := buf.WriteTo(w); err != nil {
+		loggerError.Println(err.Error())
+	}
 	return http.StatusOK
 }
 
+// writeForm writes HTML form of rates query and returns HTTP status code.
+func writeForm(w http.ResponseWriter, cfg *rates.Cfg) int {
+	var buf bytes.Buffer
+	if err := formPage.Execute(&buf, cfg.DefaultQuery); err != nil {
+		code := http.StatusInternalServerError
+		http.Error(w, http.StatusText(code), code)
+		loggerError.Println(err.Error())
+		return code
+	}
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	if _, err := buf.WriteTo(w); err != nil {
+		loggerError.Println(err.Error())
+	}
+	return http.StatusOK
+}
+
+// writeRateError writes rates error to ResponseWriter and returns HTTP status code.
+func writeRateError(w http.ResponseWriter, err error) int {
+	code := http.StatusInternalServerError
+	if rateError, ok := err.(*rates.RateError); ok {
+		code = rateError.HTTPCode
+	}
+	http.Error(w, err.Error(), code)
+	loggerError.Println(err.Error())
+	return code
+}
+
+// helpFunc writes help info to ResponseWriter and returns HTTP status code.
+func helpFunc(w http.ResponseWriter, r *http.Request, h *help, cfg *rates.Cfg) int {
+	return writeJSON(w, h, cfg)
+}
+
+// boolParam returns a boolean request parameter value, it is false if the value is invalid.
+func boolParam(r *http.Request, name string) bool {
+	value, err := strconv.ParseBool(r.FormValue(name))
+	return err == nil && value
+}
+
+// requestTimeout returns a timeout from request header "X-Timeout-Ms",
+// it is the deadline if the header is absent. It can't exceed the deadline.
+func requestTimeout(r *http.Request, deadline time.Duration) (time.Duration, error) {
+	value := r.Header.Get(timeoutHeader)
+	if value == "" {
+		return deadline, nil
+	}
+	ms, err := strconv.ParseUint(value, 10, 32)
+	if err != nil || ms == 0 {
+		return 0, errors.New("bad timeout format")
+	}
+	timeout := time.Duration(ms) * time.Millisecond
+	if timeout > deadline {
+		return 0, fmt.Errorf("timeout exceeds maximum %v", deadline)
+	}
+	return timeout, nil
+}
+
+// requestPrecision returns a number of decimal places from request parameter "precision",
+// ok is false if the parameter is absent. It can't exceed the configured maximum.
+func requestPrecision(r *http.Request, cfg *rates.Cfg) (places int, ok bool, err error) {
+	value := r.FormValue("precision")
+	if value == "" {
+		return 0, false, nil
+	}
+	n, err := strconv.ParseUint(value, 10, 8)
+	if err != nil || int(n) > cfg.Precision.Max {
+		return 0, false, fmt.Errorf("bad precision, use integer in range [0, %v]", cfg.Precision.Max)
+	}
+	return int(n), true, nil
+}
+
+// requestRounding returns rounding mode from request parameter "rounding",
+// ok is false if it is not set.
+func requestRounding(r *http.Request) (mode rates.RoundingMode, ok bool, err error) {
+	value := r.FormValue("rounding")
+	if value == "" {
+		return rates.HalfUp, false, nil
+	}
+	mode, err = rates.ParseRoundingMode(value)
+	if err != nil {
+		return rates.HalfUp, false, errors.New("bad rounding, use half_up, half_even, floor, ceil or truncate")
+	}
+	return mode, true, nil
+}
+
+// acceptedType returns the offer most preferred by request header "Accept",
+// the first offer is default.
+func acceptedType(r *http.Request, offers ...string) string {
+	best, bestQ := offers[0], 0.0
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if value, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(value, 64); err != nil {
+				continue
+			}
+		}
+		for _, offer := range offers {
+			if q > bestQ && matchType(mediaType, offer) {
+				best, bestQ = offer, q
+			}
+		}
+	}
+	return best
+}
+
+// matchType returns true if media type pattern like "text/*" matches mediaType.
+func matchType(pattern, mediaType string) bool {
+	if pattern == "*/*" || pattern == mediaType {
+		return true
+	}
+	return strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(pattern, "*"))
+}
+
+// isJSONBody returns true if the request has a JSON body with a batch of queries.
+func isJSONBody(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return r.Method == "POST" && mediaType == "application/json"
+}
+
+// requestQuery returns rates query and date from JSON request body
+// or request parameters "q" and "d". Queries of JSON body are also returned
+// as a list of messages, so they are not split by commas.
+func requestQuery(w http.ResponseWriter, r *http.Request, cfg *rates.Cfg) (string, []string, time.Time, error) {
+	var date time.Time
+	if !isJSONBody(r) {
+		date, err := requestDate(r, cfg)
+		if err != nil {
+			return "", nil, date, err
+		}
+		query := r.FormValue("q")
+		if query == "" {
+			query = cfg.DefaultQuery
+		}
+		return query, nil, date, nil
+	}
+	// a known too large body is rejected before reading, so a client
+	// waiting for "100 Continue" doesn't send it at all
+	if r.ContentLength > maxBodySize {
+		return "", nil, date, errBodyTooLarge
+	}
+	body := &jsonQuery{}
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(body); err != nil {
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			return "", nil, date, errBodyTooLarge
+		}
+		return "", nil, date, fmt.Errorf("bad JSON body: %v", err)
+	}
+	if n := len(body.Queries); n == 0 || n > maxQueries {
+		return "", nil, date, fmt.Errorf("number of queries should be in range [1, %v]", maxQueries)
+	}
+	for _, q := range body.Queries {
+		if strings.TrimSpace(q) == "" {
+			return "", nil, date, errors.New("empty query")
+		}
+	}
+	date, err := cfg.ResolveDate(r.Context(), body.Date)
+	if err != nil {
+		return "", nil, date, err
+	}
+	return strings.Join(body.Queries, ", "), body.Queries, date, nil
+}
+
+// requestFields returns validated response fields from request parameter "fields",
+// it is empty if the parameter is absent.
+func requestFields(r *http.Request) ([]string, error) {
+	value := r.FormValue("fields")
+	if value == "" {
+		return nil, nil
+	}
+	fields := strings.Split(value, ",")
+	for i, field := range fields {
+		field = strings.ToLower(strings.TrimSpace(field))
+		if !projectionFields[field] {
+			return nil, fmt.Errorf("unknown field %q", field)
+		}
+		fields[i] = field
+	}
+	return fields, nil
+}
+
+// projectInfo returns rates info containing only requested fields,
+// it is full info if fields are empty. Names of info fields and rates items
+// fields are different, items fields are nested in "rates". Field "rates"
+// selects whole items, so items fields are ignored with it in any order.
+func projectInfo(info *rates.Info, fields []string, cfg *rates.Cfg) interface{} {
+	if len(fields) == 0 {
+		return info
+	}
+	var wholeItems bool
+	for _, field := range fields {
+		wholeItems = wholeItems || field == "rates"
+	}
+	result := make(map[string]interface{})
+	items := make([]map[string]interface{}, len(info.Rates))
+	for i, item := range info.Rates {
+		items[i] = make(map[string]interface{})
+		for _, field := range fields {
+			switch field {
+			case "msg":
+				items[i][field] = item.Msg
+			case "rate":
+				items[i][field] = item.RateValues()
+			case "raw":
+				items[i][field] = item.Raw
+			case "inverse":
+				items[i][field] = item.Inverse
+			case "values":
+				items[i][field] = item.Values
+			case "ratio":
+				items[i][field] = item.Ratio
+			}
+		}
+	}
+	for _, field := range fields {
+		switch field {
+		case "date":
+			result[field] = info.Date
+		case "rates":
+			result[field] = info.Rates
+		case "trend":
+			result[field] = info.Trend
+		case "basket":
+			result[field] = info.Basket
+		case "precision":
+			result[field] = info.Precision
+		case "cached":
+			result[field] = info.Cached
+		case "cache_date":
+			result[fieldName(field, cfg)] = info.CacheDate
+		case "timestamp":
+			result[field] = info.Timestamp
+		case "source":
+			result[field] = info.Source
+		case "currencies":
+			result[field] = info.Currencies
+		default:
+			if !wholeItems {
+				result["rates"] = items
+			}
+		}
+	}
+	return result
+}
+
+// requestBasket returns a basket of currencies from request parameter "basket",
+// it is the configured basket if the parameter is true.
+func requestBasket(r *http.Request, cfg *rates.Cfg) (rates.Basket, error) {
+	value := r.FormValue("basket")
+	if value == "" {
+		return nil, nil
+	}
+	if boolParam(r, "basket") {
+		if len(cfg.Basket) == 0 {
+			return nil, errors.New("basket is not configured")
+		}
+		return cfg.Basket, nil
+	}
+	return rates.ParseBasket(value)
+}
+
+// requestDate returns a date from request parameter "d" or today.
+func requestDate(r *http.Request, cfg *rates.Cfg) (time.Time, error) {
+	return cfg.ResolveDate(r.Context(), r.FormValue("d"))
+}
+
+// requestTime returns a time of the day from request parameter "time",
+// format HH:MM or HH:MM:SS. It is zero if the parameter is absent.
+func requestTime(r *http.Request) (time.Duration, error) {
+	value := r.FormValue("time")
+	if value == "" {
+		return 0, nil
+	}
+	for _, layout := range []string{"15:04", "15:04:05"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.Sub(time.Date(0, 1, 1, 0, 0, 0, 0, time.UTC)), nil
+		}
+	}
+	return 0, errors.New("bad time format, use HH:MM or HH:MM:SS")
+}
+
+// ratesFunc writes requested rates info to ResponseWriter and returns HTTP status code.
+func ratesFunc(w http.ResponseWriter, r *http.Request, cfg *rates.Cfg) int {
+	// a browser gets the query form instead of default query rates
+	if cfg.QueryForm && r.Method != http.MethodPost && r.URL.RawQuery == "" &&
+		acceptedType(r, "application/json", "text/html") == "text/html" {
+		return writeForm(w, cfg)
+	}
+	query, messages, date, err := requestQuery(w, r, cfg)
+	if err != nil {
+		code := http.StatusBadRequest
+		if err == errBodyTooLarge {
+			code = http.StatusRequestEntityTooLarge
+		}
+		http.Error(w, err.Error(), code)
+		return code
+	}
+	endpoint := rates.SingleEndpoint
+	if isJSONBody(r) {
+		endpoint = rates.BatchEndpoint
+	}
+	timeout, err := requestTimeout(r, cfg.Deadline(endpoint))
+	if err != nil {
+		code := http.StatusBadRequest
+		http.Error(w, err.Error(), code)
+		return code
+	}
+	fields, err := requestFields(r)
+	if err != nil {
+		code := http.StatusBadRequest
+		http.Error(w, err.Error(), code)
+		return code
+	}
+	format := strings.ToLower(r.FormValue("format"))
+	if format != "" && format != "json" && format != "flat" && format != "compact" {
+		code := http.StatusBadRequest
+		http.Error(w, "bad format, use json, flat or compact", code)
+		return code
+	}
+	if len(fields) > 0 && (format == "flat" || format == "compact") {
+		code := http.StatusBadRequest
+		http.Error(w, "fields can't be used with "+format+" format", code)
+		return code
+	}
+	basket, err := requestBasket(r, cfg)
+	if err != nil {
+		code := http.StatusBadRequest
+		http.Error(w, err.Error(), code)
+		return code
+	}
+	precision, exact, err := requestPrecision(r, cfg)
+	if err != nil {
+		code := http.StatusBadRequest
+		http.Error(w, err.Error(), code)
+		return code
+	}
+	dayTime, err := requestTime(r)
+	if err != nil {
+		code := http.StatusBadRequest
+		http.Error(w, err.Error(), code)
+		return code
+	}
+	rounding, customRounding, err := requestRounding(r)
+	if err != nil {
+		code := http.StatusBadRequest
+		http.Error(w, err.Error(), code)
+		return code
+	}
+	mediaType := acceptedType(r, "application/json", "text/plain", "text/html")
+	places := *cfg.Precision.JSON
+	// text values have the standard scale of currency by default
+	scale := -1
+	switch {
+	case exact:
+		places, scale = precision, precision
+	case mediaType != "application/json" && cfg.Precision.Text > 0:
+		places, scale = cfg.Precision.Text, cfg.Precision.Text
+	}
+	opts := rates.Options{
+		Ratio:          boolParam(r, "ratio"),
+		Timeout:        timeout,
+		Ordered:        boolParam(r, "ordered") || mediaType != "application/json",
+		Raw:            boolParam(r, "raw"),
+		Trend:          boolParam(r, "trend"),
+		Basket:         basket,
+		Verbose:        boolParam(r, "verbose"),
+		Places:         places,
+		ExactPlaces:    exact,
+		Rounding:       rounding,
+		CustomRounding: customRounding,
+		Timestamp:      boolParam(r, "timestamp"),
+		Time:           dayTime,
+		Numeric:        boolParam(r, "numeric"),
+		Metadata:       boolParam(r, "metadata"),
+		Messages:       messages,
+	}
+	info, err := cfg.GetRatesWith(date, query, opts)
+	if err != nil {
+		return writeRateError(w, err)
+	}
+	if p := info.Provenance; p != nil {
+		w.Header().Set("X-Rates-Age", strconv.FormatInt(int64(p.Age()/time.Second), 10))
+		if p.Stale {
+			w.Header().Set("X-Rates-Stale", "true")
+		}
+	}
+	if p := info.Provenance; cfg.Debug && p != nil {
+		w.Header().Set("X-Rates-Source", p.URL)
+		if p.Cached {
+			w.Header().Set("X-Rates-Cache", "hit")
+		} else {
+			w.Header().Set("X-Rates-Cache", "miss")
+		}
+	}
+	switch mediaType {
+	case "text/plain":
+		return writeText(w, info, scale)
+	case "text/html":
+		return writeHTML(w, info, scale)
+	}
+	switch format {
+	case "flat":
+		return writeJSON(w, info.Flat(), cfg)
+	case "compact":
+		return writeJSON(w, info.Compact(), cfg)
+	}
+	return writeJSON(w, projectInfo(info, fields, cfg), cfg)
+}
+
+// buyFunc writes an amount of currency which can be bought for rubles
+// to ResponseWriter and returns HTTP status code.
+func buyFunc(w http.ResponseWriter, r *http.Request, cfg *rates.Cfg) int {
+	rub, err := strconv.ParseFloat(r.FormValue("rub"), 64)
+	if err != nil || rub < 0 || math.IsInf(rub, 0) || math.IsNaN(rub) {
+		code := http.StatusBadRequest
+		http.Error(w, "bad rub amount", code)
+		return code
+	}
+	to := r.FormValue("to")
+	if to == "" {
+		code := http.StatusBadRequest
+		http.Error(w, "empty target currency", code)
+		return code
+	}
+	date, err := requestDate(r, cfg)
+	if err != nil {
+		code := http.StatusBadRequest
+		http.Error(w, err.Error(), code)
+		return code
+	}
+	receipt, err := cfg.BuyReceipt(date, rub, to)
+	if err != nil {
+		return writeRateError(w, err)
+	}
+	info := &buyInfo{
+		Date:     date.Format("2006-01-02"),
+		RUB:      rub,
+		To:       strings.ToLower(to),
+		Value:    receipt.Result,
+		Source:   cfg.Source(),
+		Markup:   receipt.Markup,
+		Unmarked: receipt.Result,
+	}
+	if receipt.Markup > 0 {
+		info.Unmarked = receipt.Unmarked
+	}
+	if boolParam(r, "receipt") {
+		info.Receipt = receipt
+	}
+	return writeJSON(w, info, cfg)
+}
+
+// convertFunc writes an amount of currency "from" converted to currency "to"
+// to ResponseWriter and returns HTTP status code.
+func convertFunc(w http.ResponseWriter, r *http.Request, cfg *rates.Cfg) int {
+	from, to := strings.ToLower(r.FormValue("from")), strings.ToLower(r.FormValue("to"))
+	if from == "" || to == "" {
+		code := http.StatusBadRequest
+		http.Error(w, "empty currency code", code)
+		return code
+	}
+	amount, err := strconv.ParseFloat(r.FormValue("amount"), 64)
+	if err != nil || amount < 0 || math.IsInf(amount, 0) || math.IsNaN(amount) {
+		code := http.StatusBadRequest
+		http.Error(w, "bad amount", code)
+		return code
+	}
+	date, err := requestDate(r, cfg)
+	if err != nil {
+		code := http.StatusBadRequest
+		http.Error(w, err.Error(), code)
+		return code
+	}
+	receipt, err := cfg.ConvertReceipt(date, from, to, amount)
+	if err != nil {
+		return writeRateError(w, err)
+	}
+	info := &convertInfo{
+		Date:   receipt.Date,
+		From:   from,
+		To:     to,
+		Amount: amount,
+		Value:  receipt.Result,
+		Source: cfg.Source(),
+	}
+	if boolParam(r, "receipt") {
+		info.Receipt = receipt
+	}
+	return writeJSON(w, info, cfg)
+}
+
+// alertFunc writes a result of currency RUB rate threshold check
+// to ResponseWriter and returns HTTP status code.
+func alertFunc(w http.ResponseWriter, r *http.Request, cfg *rates.Cfg) int {
+	currency := strings.ToLower(r.FormValue("currency"))
+	if currency == "" {
+		code := http.StatusBadRequest
+		http.Error(w, "empty currency", code)
+		return code
+	}
+	op := strings.ToLower(r.FormValue("op"))
+	check, ok := alertOps[op]
+	if !ok {
+		code := http.StatusBadRequest
+		http.Error(w, "bad operator, use gt, lt or eq", code)
+		return code
+	}
+	value, err := strconv.ParseFloat(r.FormValue("value"), 64)
+	if err != nil || value < 0 || math.IsInf(value, 0) || math.IsNaN(value) {
+		code := http.StatusBadRequest
+		http.Error(w, "bad value", code)
+		return code
+	}
+	date, err := requestDate(r, cfg)
+	if err != nil {
+		code := http.StatusBadRequest
+		http.Error(w, err.Error(), code)
+		return code
+	}
+	// not rounded rate, rounding changes comparison of low value currencies
+	rate, err := cfg.CrossRate(date, currency, "rub")
+	if err != nil {
+		return writeRateError(w, err)
+	}
+	info := &alertInfo{
+		Date:     date.Format("2006-01-02"),
+		Currency: currency,
+		Op:       op,
+		Value:    value,
+		Rate:     rate,
+		Alert:    check(rate, value),
+		Source:   cfg.Source(),
+	}
+	return writeJSON(w, info, cfg)
+}
+
+// compareFunc writes a currency rate of all configured providers
+// to ResponseWriter and returns HTTP status code.
+func compareFunc(w http.ResponseWriter, r *http.Request, cfg *rates.Cfg) int {
+	currency := r.FormValue("currency")
+	if currency == "" {
+		code := http.StatusBadRequest
+		http.Error(w, "empty currency", code)
+		return code
+	}
+	base := r.FormValue("to")
+	if base == "" {
+		base = "rub"
+	}
+	date, err := requestDate(r, cfg)
+	if err != nil {
+		code := http.StatusBadRequest
+		http.Error(w, err.Error(), code)
+		return code
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), cfg.Deadline(rates.BatchEndpoint))
+	defer cancel()
+	comparison, err := cfg.CompareProviders(ctx, date, currency, base)
+	if err != nil {
+		return writeRateError(w, err)
+	}
+	return writeJSON(w, comparison, cfg)
+}
+
+// tableFunc writes full rates table of the date to ResponseWriter
+// as JSON or XLSX file and returns HTTP status code.
+func tableFunc(w http.ResponseWriter, r *http.Request, cfg *rates.Cfg) int {
+	format := strings.ToLower(r.FormValue("format"))
+	if format != "" && format != "json" && format != "xlsx" {
+		code := http.StatusBadRequest
+		http.Error(w, "bad format, use json or xlsx", code)
+		return code
+	}
+	date, err := requestDate(r, cfg)
+	if err != nil {
+		code := http.StatusBadRequest
+		http.Error(w, err.Error(), code)
+		return code
+	}
+	table, err := cfg.Table(r.Context(), date)
+	if err != nil {
+		return writeRateError(w, err)
+	}
+	if format != "xlsx" {
+		return writeJSON(w, table, cfg)
+	}
+	var buf bytes.Buffer
+	if err = table.WriteXLSX(&buf); err != nil {
+		code := http.StatusInternalServerError
+		http.Error(w, http.StatusText(code), code)
+		loggerError.Println(err.Error())
+		return code
+	}
+	w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"rates-%v.xlsx\"", table.Date))
+	if _, err = buf.WriteTo(w); err != nil {
+		loggerError.Println(err.Error())
+	}
+	return http.StatusOK
+}
+
+// calendarFunc writes rates data availability for dates range
+// to ResponseWriter and returns HTTP status code.
+func calendarFunc(w http.ResponseWriter, r *http.Request, cfg *rates.Cfg) int {
+	if r.FormValue("from") == "" {
+		code := http.StatusBadRequest
+		http.Error(w, "empty from date", code)
+		return code
+	}
+	dates := make([]time.Time, 2)
+	for i, name := range []string{"from", "to"} {
+		date, err := cfg.ParseDate(r.FormValue(name))
+		if err != nil {
+			code := http.StatusBadRequest
+			http.Error(w, err.Error(), code)
+			return code
+		}
+		dates[i] = date
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), cfg.Deadline(rates.RangeEndpoint))
+	defer cancel()
+	days, err := cfg.Calendar(ctx, dates[0], dates[1])
+	if err != nil {
+		return writeRateError(w, err)
+	}
+	return writeJSON(w, days, cfg)
+}
+
+// rangeFunc writes rates info of every date in the range to ResponseWriter as JSON array
+// and returns HTTP status code. Array items are streamed as soon as they are ready,
+// so an error after the first item is written as the last item {"error": "..."}.
+func rangeFunc(w http.ResponseWriter, r *http.Request, cfg *rates.Cfg) int {
+	if r.FormValue("from") == "" {
+		code := http.StatusBadRequest
+		http.Error(w, "empty from date", code)
+		return code
+	}
+	dates := make([]time.Time, 2)
+	for i, name := range []string{"from", "to"} {
+		date, err := cfg.ParseDate(r.FormValue(name))
+		if err != nil {
+			code := http.StatusBadRequest
+			http.Error(w, err.Error(), code)
+			return code
+		}
+		dates[i] = date
+	}
+	query := r.FormValue("q")
+	if query == "" {
+		query = cfg.DefaultQuery
+	}
+	opts := rates.Options{
+		Ratio:       boolParam(r, "ratio"),
+		Ordered:     boolParam(r, "ordered"),
+		Raw:         boolParam(r, "raw"),
+		Trend:       boolParam(r, "trend"),
+		Verbose:     boolParam(r, "verbose"),
+		Timestamp:   boolParam(r, "timestamp"),
+		Interpolate: boolParam(r, "interpolate"),
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), cfg.Deadline(rates.RangeEndpoint))
+	defer cancel()
+	flusher, _ := w.(http.Flusher)
+	started := false
+	err := cfg.StreamRatesRange(ctx, dates[0], dates[1], query, opts, func(info *rates.Info) error {
+		delimiter := ","
+		if !started {
+			w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+			delimiter, started = "[", true
+		}
+		if _, err := io.WriteString(w, delimiter); err != nil {
+			return err
+		}
+		data, err := encodeJSON(info, cfg)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if !started {
+		if err != nil {
+			return writeRateError(w, err)
+		}
+		return writeJSON(w, []*rates.Info{}, cfg)
+	}
+	code := http.StatusOK
+	if err != nil {
+		code = http.StatusInternalServerError
+		if rateError, ok := err.(*rates.RateError); ok {
+			code = rateError.HTTPCode
+		}
+		loggerError.Println(err.Error())
+		if data, err := encodeJSON(map[string]string{"error": err.Error()}, cfg); err == nil {
+			io.WriteString(w, ",")
+			w.Write(data)
+		}
+	}
+	io.WriteString(w, "]\n")
+	return code
+}
+
+// matrixFunc writes cross-rates matrix of required currencies to ResponseWriter and returns HTTP status code.
+func matrixFunc(w http.ResponseWriter, r *http.Request, cfg *rates.Cfg) int {
+	date, err := requestDate(r, cfg)
+	if err != nil {
+		code := http.StatusBadRequest
+		http.Error(w, err.Error(), code)
+		return code
+	}
+	matrix, err := cfg.CrossRates(date)
+	if err != nil {
+		return writeRateError(w, err)
+	}
+	return writeJSON(w, matrix, cfg)
+}
+
+// changesFunc writes currencies changed against a baseline date to ResponseWriter and returns HTTP status code.
+func changesFunc(w http.ResponseWriter, r *http.Request, cfg *rates.Cfg) int {
+	date, err := requestDate(r, cfg)
+	if err != nil {
+		code := http.StatusBadRequest
+		http.Error(w, err.Error(), code)
+		return code
+	}
+	if r.FormValue("base") == "" {
+		code := http.StatusBadRequest
+		http.Error(w, "empty base date", code)
+		return code
+	}
+	base, err := cfg.ResolveDate(r.Context(), r.FormValue("base"))
+	if err != nil {
+		code := http.StatusBadRequest
+		http.Error(w, err.Error(), code)
+		return code
+	}
+	var threshold float64
+	if value := r.FormValue("threshold"); value != "" {
+		threshold, err = strconv.ParseFloat(value, 64)
+		if err != nil || threshold < 0 {
+			code := http.StatusBadRequest
+			http.Error(w, "bad threshold", code)
+			return code
+		}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), cfg.Deadline(rates.BatchEndpoint))
+	defer cancel()
+	changes, err := cfg.ChangedRates(ctx, date, base, threshold)
+	if err != nil {
+		return writeRateError(w, err)
+	}
+	return writeJSON(w, changes, cfg)
+}
+
+// codesFunc writes available currencies codes to ResponseWriter and returns HTTP status code.
+func codesFunc(w http.ResponseWriter, r *http.Request, cfg *rates.Cfg) int {
+	codes, err := cfg.SearchCodes(r.FormValue("search"))
+	if err != nil {
+		code := http.StatusServiceUnavailable
+		http.Error(w, "get currencies codes", code)
+		loggerError.Println(err.Error())
+		return code
+	}
+	return writeJSON(w, codes, cfg)
+}
+
+// defaultCodes returns configured required currencies codes or built-in ones.
+func defaultCodes(cfg *rates.Cfg) map[string][]string {
+	if len(cfg.Codes) > 0 {
+		return cfg.Codes
+	}
+	return requiredCodes
+}
+
+// allowedMethods returns HTTP methods allowed for the path, it is nil for unknown path.
+// Only rates requests can be POST with JSON body, "/metrics" is known only if it is enabled.
+func allowedMethods(path string, cfg *rates.Cfg) []string {
+	switch path {
+	case "":
+		return []string{http.MethodGet, http.MethodHead, http.MethodPost}
+	case "/help", "/codes", "/buy", "/convert", "/alert", "/compare", "/table", "/calendar", "/matrix", "/range", "/changes":
+		return []string{http.MethodGet, http.MethodHead}
+	case "/metrics":
+		if cfg.Metrics {
+			return []string{http.MethodGet, http.MethodHead}
+		}
+	}
+	return nil
+}
+
+// hasMethod returns true if method is in methods.
+func hasMethod(methods []string, method string) bool {
+	for _, m := range methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// handler returns main HTTP handler function.
+// Successful requests are logged by sample of every N-th one, errors are always logged.
+func handler(cfg *rates.Cfg, h *help) http.HandlerFunc {
+	var requests, succeeded uint64
+	metrics := newRequestMetrics()
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/favicon.ico" {
+			// browsers request it automatically, there is no icon and nothing to log
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if encoding := acceptedEncoding(r, cfg); encoding != "" {
+			cw := newCompressWriter(w, encoding, cfg.CompressMinSize)
+			defer func() {
+				if err := cw.Close(); err != nil {
+					loggerError.Println(err.Error())
+				}
+			}()
+			w = cw
+		}
+		start, code := time.Now(), http.StatusOK
+		n := atomic.AddUint64(&requests, 1)
+		var id string
+		if cfg.Exemplars {
+			id = requestID(r, n)
+			w.Header().Set(requestIDHeader, id)
+		}
+		defer func() {
+			if cfg.Metrics {
+				metrics.observe(time.Since(start), id)
+			}
+			// only every N-th successful request is logged
+			if code < http.StatusBadRequest && cfg.LogSample > 1 &&
+				atomic.AddUint64(&succeeded, 1)%cfg.LogSample != 1 {
+				return
+			}
+			loggerInfo.Printf("%-5v %v\t%-12v\t%v",
+				r.Method,
+				code,
+				time.Since(start),
+				r.URL.String(),
+			)
+		}()
+		path := strings.TrimRight(r.URL.Path, "/")
+		if cfg.BasePath != "" {
+			if path != cfg.BasePath && !strings.HasPrefix(path, cfg.BasePath+"/") {
+				code = http.StatusNotFound
+				http.NotFound(w, r)
+				return
+			}
+			path = strings.TrimPrefix(path, cfg.BasePath)
+		}
+		if methods := allowedMethods(path, cfg); methods != nil && !hasMethod(methods, r.Method) {
+			code = http.StatusMethodNotAllowed
+			w.Header().Set("Allow", strings.Join(methods, ", "))
+			http.Error(w, http.StatusText(code), code)
+			return
+		}
+		switch {
+		case path == "/help":
+			code = helpFunc(w, r, h, cfg)
+		case path == "/codes":
+			code = codesFunc(w, r, cfg)
+		case path == "/buy":
+			code = buyFunc(w, r, cfg)
+		case path == "/convert":
+			code = convertFunc(w, r, cfg)
+		case path == "/alert":
+			code = alertFunc(w, r, cfg)
+		case path == "/compare":
+			code = compareFunc(w, r, cfg)
+		case path == "/table":
+			code = tableFunc(w, r, cfg)
+		case path == "/calendar":
+			code = calendarFunc(w, r, cfg)
+		case path == "/matrix":
+			code = matrixFunc(w, r, cfg)
+		case path == "/range":
+			code = rangeFunc(w, r, cfg)
+		case path == "/changes":
+			code = changesFunc(w, r, cfg)
+		case path == "/metrics" && cfg.Metrics:
+			code = metricsFunc(w, r, cfg, metrics)
+		case path != "":
+			code = http.StatusNotFound
+			http.NotFound(w, r)
+		default:
+			code = ratesFunc(w, r, cfg)
+		}
+	}
+}
+
+// newHelp returns help info of the service parameters and recognized currencies.
+func newHelp(cfg *rates.Cfg) *help {
+	return &help{
+		P: helpParameters{
+			Q:           fmt.Sprintf("query (default '%v')", cfg.DefaultQuery),
+			D:           "date, format YYYY-MM-DD, YYYYMMDD or DD.MM.YYYY, YYYY-MM is the last business day of month (default today) [optional]",
+			Search:      "/codes filter by currency code or name substring [optional]",
+			RUB:         "/buy rubles amount",
+			To:          "/buy and /convert target currency code; /compare base currency code (default rub); /calendar and /range last date, format YYYY-MM-DD (default today)",
+			Ratio:       "add exact cross-rates as fractions, true/false (default false) [optional]",
+			From:        "/convert source currency code; /calendar and /range first date, format YYYY-MM-DD",
+			Ordered:     "add currencies values list in configured order, true/false (default false) [optional]",
+			Raw:         "add not rounded currencies values, true/false (default false) [optional]",
+			Fields:      "comma-separated response fields: date, rates, trend, basket, precision, cached, cache_date, timestamp, source, currencies, msg, rate, raw, inverse, values, ratio (default all), 'rates' includes all fields of items, it is not supported by flat and compact formats [optional]",
+			Trend:       "add currencies trends against the previous business day, true/false (default false) [optional]",
+			Verbose:     "add inverse rates of target currencies, decimal places of source rates and cache status, true/false (default false) [optional]",
+			Basket:      "add currencies values in units of weighted basket like 'usd:0.5,eur:0.5', true for configured basket [optional]",
+			Base:        "baseline date of /changes request, format YYYY-MM-DD",
+			Threshold:   "minimal absolute change of RUB rate for /changes request (default 0) [optional]",
+			Timestamp:   "add Unix time of the date midnight UTC, true/false (default false) [optional]",
+			Currency:    "currency of /alert and /compare requests",
+			Op:          "operator of /alert request: gt, lt or eq",
+			Value:       "RUB rate threshold of /alert request",
+			Receipt:     "add /buy and /convert conversion receipt with used rate and fetch time, true/false (default false) [optional]",
+			Amount:      "/convert amount of source currency",
+			Rounding:    "rounding mode of values: half_up, half_even, floor, ceil or truncate (default is configured mode) [optional]",
+			Interpolate: "/range values of weekends and holidays linearly interpolated between business days, true/false (default false) [optional]",
+			Metadata:    "add catalog entries of returned currencies: names, nominal and codes, true/false (default false) [optional]",
+			Numeric:     "key currencies values by ISO numeric codes like 840, true/false (default false) [optional]",
+			Time:        "time of the day to get the closest intraday rate, format HH:MM or HH:MM:SS, it is ignored for CBR daily rates [optional]",
+			Precision:   fmt.Sprintf("decimal places of rates values, integer in range [0, %v] (default %v) [optional]", cfg.Precision.Max, *cfg.Precision.JSON),
+			Format:      "rates response format: json, flat list of currencies values or compact arrays of values (schema " + rates.CompactSchema + "); /table response format: json or xlsx (default json) [optional]",
+		},
+		V:       Version,
+		Comment: "https://github.com/z0rr0/exchange",
+		Codes:   cfg.Aliases(),
+	}
+}
+
 func main() {
 	defer func() {
 		if r := recover(); r != nil {
@@ -110,18 +1243,11 @@ func main() {
 	if err != nil {
 		loggerError.Fatalf("configuration error: %v", err)
 	}
-	err = cfg.SetRequiredCodes(requiredCodes)
+	err = cfg.SetRequiredCodes(defaultCodes(cfg))
 	if err != nil {
 		loggerError.Fatal(err)
 	}
-	h := &help{
-		P: helpParameters{
-			Q: "query (default '1 rub')",
-			D: "date, format YYYY-MM-DD (default today) [optional]",
-		},
-		V:       Version,
-		Comment: "https://github.com/z0rr0/exchange",
-	}
+	h := newHelp(cfg)
 	server := &http.Server{
 		Addr:           cfg.Addr(),
 		Handler:        http.DefaultServeMux,
@@ -130,71 +1256,29 @@ func main() {
 		MaxHeaderBytes: 1 << 20, // 1MB
 		ErrorLog:       loggerError,
 	}
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		var date time.Time
-		start, code := time.Now(), http.StatusOK
-		defer func() {
-			loggerInfo.Printf("%-5v %v\t%-12v\t%v",
-				r.Method,
-				code,
-				time.Since(start),
-				r.URL.String(),
-			)
-		}()
-
-		switch path := strings.TrimRight(r.URL.Path, "/"); {
-		case path == "/help":
-			code = helpFunc(w, r, h)
-			return
-		case path != "":
-			code = http.StatusNotFound
-			http.NotFound(w, r)
-			return
-		}
-
-		query := r.FormValue("q")
-		if query == "" {
-			query = "1 rub"
-		}
-		if d := r.FormValue("d"); d != "" {
-			date, err = time.Parse("2006-01-02", d)
-			if err != nil {
-				code = http.StatusBadRequest
-				http.Error(w, "bad date format", code)
-				return
-			}
-			if date.After(time.Now().UTC()) {
-				code = http.StatusBadRequest
-				http.Error(w, "bad date", code)
-				return
-			}
-		} else {
-			date = time.Now().UTC()
-		}
-		info, err := cfg.GetRates(date, query)
-		if err != nil {
-			rateError := err.(*rates.RateError)
-			code = rateError.HTTPCode
-			http.Error(w, err.Error(), code)
-			loggerError.Println(err.Error())
-			return
-		}
-		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-		encoder := json.NewEncoder(w)
-		err = encoder.Encode(info)
-		if err != nil {
-			code = http.StatusInternalServerError
-			http.Error(w, http.StatusText(code), code)
-			loggerError.Println(err.Error())
-			return
-		}
-		// ok
-	})
+	http.HandleFunc("/", handler(cfg, h))
 	errc := make(chan error)
 	go interrupt(errc)
 	go func() {
 		errc <- server.ListenAndServe()
 	}()
+	grpcServer := rpc.NewServer(cfg)
+	if addr := cfg.GRPCAddr(); addr != "" {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			loggerError.Fatalf("gRPC listen error: %v", err)
+		}
+		go func() {
+			errc <- grpcServer.Serve(listener)
+		}()
+		loggerInfo.Printf("gRPC listen: %v\n", addr)
+	}
+	if cfg.WarmUpDays > 0 {
+		go func() {
+			n := cfg.WarmUp(context.Background())
+			loggerInfo.Printf("warm-up: cached rates of %v from %v days\n", n, cfg.WarmUpDays)
+		}()
+	}
 	loggerInfo.Printf("running: version=%v [%v %v debug=%v]\nListen: %v\n\n",
 		Version, GoVersion, Revision, *debug || cfg.Debug, server.Addr)
 	err = <-errc
@@ -208,6 +1292,7 @@ func main() {
 		if err := server.Shutdown(ctx); err != nil {
 			loggerError.Printf("graceful shutdown error: %v\n", err)
 		}
+		grpcServer.GracefulStop()
 
 	}
 }
@@ -0,0 +1,1916 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	"github.com/z0rr0/exchange/rates"
+)
+
+const (
+	testConfig = "config.example.json"
+	testDaily  = "rates/testdata/daily.xml"
+	testCodes  = "rates/testdata/codes.xml"
+	testERAPI  = "rates/testdata/erapi.json"
+)
+
+var (
+	testLogger = log.New(os.Stdout, "TEST: ", log.Ldate|log.Ltime|log.Lshortfile)
+)
+
+// testCfg returns rates configuration using a stub upstream service.
+func testCfg(t *testing.T) (*rates.Cfg, func()) {
+	mux := http.NewServeMux()
+	for path, name := range map[string]string{"/daily": testDaily, "/codes": testCodes, "/erapi": testERAPI} {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/xml")
+			w.Write(data)
+		})
+	}
+	server := httptest.NewServer(mux)
+	cfg, err := rates.New(testConfig, testLogger, "exchange_test/0.0")
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	cfg.RatesURL = server.URL + "/daily"
+	cfg.CodesURL = server.URL + "/codes"
+	cfg.ERAPIURL = server.URL + "/erapi"
+	if err := cfg.SetRequiredCodes(requiredCodes); err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	return cfg, server.Close
+}
+
+func TestHandlerDebugHeaders(t *testing.T) {
+	cfg, closer := testCfg(t)
+	defer closer()
+
+	h := handler(cfg, &help{})
+	for _, debug := range []bool{false, true} {
+		cfg.Debug = debug
+		req := httptest.NewRequest("GET", "/?q=1+usd&d=2017-03-02", nil)
+		w := httptest.NewRecorder()
+		h(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected status code: %v", w.Code)
+		}
+		source, cache := w.Header().Get("X-Rates-Source"), w.Header().Get("X-Rates-Cache")
+		if debug {
+			if source == "" || cache != "hit" {
+				t.Errorf("unexpected debug headers: %q, %q", source, cache)
+			}
+		} else if source != "" || cache != "" {
+			t.Errorf("debug headers in non-debug mode: %q, %q", source, cache)
+		}
+	}
+}
+
+func TestHandlerCodesSearch(t *testing.T) {
+	cfg, closer := testCfg(t)
+	defer closer()
+
+	h := handler(cfg, &help{})
+	req := httptest.NewRequest("GET", "/codes?search=dollar", nil)
+	w := httptest.NewRecorder()
+	h(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %v", w.Code)
+	}
+	var codes []rates.CodeItem
+	if err := json.NewDecoder(w.Body).Decode(&codes); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(codes); n != 2 {
+		t.Fatalf("unexpected number of codes: %v", n)
+	}
+	for _, item := range codes {
+		if item.CharCode != "USD" && item.CharCode != "CAD" {
+			t.Errorf("unexpected code: %+v", item)
+		}
+	}
+}
+
+func TestHandlerBuy(t *testing.T) {
+	cfg, closer := testCfg(t)
+	defer closer()
+
+	h := handler(cfg, &help{})
+	req := httptest.NewRequest("GET", "/buy?rub=10000&to=USD&d=2017-03-02", nil)
+	w := httptest.NewRecorder()
+	h(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %v", w.Code)
+	}
+	info := &buyInfo{}
+	if err := json.NewDecoder(w.Body).Decode(info); err != nil {
+		t.Fatal(err)
+	}
+	// 10000 / 58.1205
+	if info.To != "usd" || info.RUB != 10000 || info.Value != 172.06 {
+		t.Errorf("unexpected result: %+v", info)
+	}
+	if info.Source.Name != "Central Bank of Russia" || info.Source.URL == "" {
+		t.Errorf("unexpected source: %+v", info.Source)
+	}
+	if info.Receipt != nil {
+		t.Errorf("unexpected receipt: %+v", info.Receipt)
+	}
+	if info.Markup != 0 || info.Unmarked != info.Value {
+		t.Errorf("unexpected markup: %+v", info)
+	}
+	cfg.Markup = 2
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/buy?rub=10000&to=USD&d=2017-03-02", nil))
+	info = &buyInfo{}
+	if err := json.NewDecoder(w.Body).Decode(info); err != nil {
+		t.Fatal(err)
+	}
+	// 10000 / 58.1205 / 1.02
+	if info.Value != 168.68 || info.Markup != 2 || info.Unmarked != 172.06 {
+		t.Errorf("unexpected result with markup: %+v", info)
+	}
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/buy?rub=10000&to=USD&d=2017-03-02&receipt=true", nil))
+	info = &buyInfo{}
+	if err := json.NewDecoder(w.Body).Decode(info); err != nil {
+		t.Fatal(err)
+	}
+	// receipt has the marked not rounded rate
+	if r := info.Receipt; r == nil || math.Abs(r.Rate-1/58.1205/1.02) > 1e-12 || r.Result != info.Value || r.Markup != 2 {
+		t.Errorf("unexpected receipt with markup: %+v", r)
+	}
+	cfg.Markup = 0
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/buy?rub=10000&to=USD&d=2017-03-02&receipt=true", nil))
+	info = &buyInfo{}
+	if err := json.NewDecoder(w.Body).Decode(info); err != nil {
+		t.Fatal(err)
+	}
+	receipt := info.Receipt
+	if receipt == nil {
+		t.Fatal("empty receipt")
+	}
+	if receipt.Amount != 10000 || receipt.From != "rub" || receipt.To != "usd" || receipt.Rate != 1/58.1205 ||
+		receipt.Result != info.Value || receipt.Date != "2017-03-02" || receipt.FetchedAt.IsZero() {
+		t.Errorf("unexpected receipt: %+v", receipt)
+	}
+	urls := map[string]int{
+		"/buy?rub=10000&to=XYZ&d=2017-03-02": http.StatusBadRequest,
+		"/buy?rub=abc&to=USD&d=2017-03-02":   http.StatusBadRequest,
+		"/buy?rub=NaN&to=USD&d=2017-03-02":   http.StatusBadRequest,
+		"/buy?rub=Inf&to=USD&d=2017-03-02":   http.StatusBadRequest,
+		"/buy?rub=-Inf&to=USD&d=2017-03-02":  http.StatusBadRequest,
+		"/buy?rub=100&d=2017-03-02":          http.StatusBadRequest,
+	}
+	for u, code := range urls {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", u, nil))
+		if w.Code != code {
+			t.Errorf("unexpected status code for %v: %v", u, w.Code)
+		}
+	}
+}
+
+func TestHandlerAlert(t *testing.T) {
+	cfg, closer := testCfg(t)
+	defer closer()
+
+	h := handler(cfg, &help{})
+	// USD rate is 58.1205, JPY one is 0.512045
+	cases := []struct {
+		query string
+		alert bool
+		rate  float64
+	}{
+		{query: "currency=usd&op=gt&value=58", alert: true, rate: 58.1205},
+		{query: "currency=USD&op=gt&value=58.1205", alert: false, rate: 58.1205},
+		{query: "currency=usd&op=gt&value=58.12", alert: true, rate: 58.1205},
+		{query: "currency=usd&op=lt&value=60", alert: true, rate: 58.1205},
+		{query: "currency=usd&op=lt&value=58.1205", alert: false, rate: 58.1205},
+		{query: "currency=usd&op=eq&value=58.1205", alert: true, rate: 58.1205},
+		{query: "currency=usd&op=EQ&value=58.12", alert: false, rate: 58.1205},
+		{query: "currency=jpy&op=gt&value=0.5115", alert: true, rate: 0.512045},
+		{query: "currency=jpy&op=lt&value=0.512", alert: false, rate: 0.512045},
+		{query: "currency=jpy&op=eq&value=0.512045", alert: true, rate: 0.512045},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", "/alert?d=2017-03-02&"+c.query, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected status code of %q: %v", c.query, w.Code)
+		}
+		info := &alertInfo{}
+		if err := json.NewDecoder(w.Body).Decode(info); err != nil {
+			t.Fatal(err)
+		}
+		if info.Alert != c.alert || math.Abs(info.Rate-c.rate) > 1e-12 || info.Date != "2017-03-02" {
+			t.Errorf("unexpected result of %q: %+v", c.query, info)
+		}
+	}
+	urls := map[string]int{
+		"/alert?op=gt&value=80&d=2017-03-02":               http.StatusBadRequest,
+		"/alert?currency=usd&value=80&d=2017-03-02":        http.StatusBadRequest,
+		"/alert?currency=usd&op=ge&value=80&d=2017-03-02":  http.StatusBadRequest,
+		"/alert?currency=usd&op=gt&d=2017-03-02":           http.StatusBadRequest,
+		"/alert?currency=usd&op=gt&value=abc&d=2017-03-02": http.StatusBadRequest,
+		"/alert?currency=usd&op=gt&value=-1&d=2017-03-02":  http.StatusBadRequest,
+		"/alert?currency=usd&op=gt&value=NaN&d=2017-03-02": http.StatusBadRequest,
+		"/alert?currency=usd&op=lt&value=Inf&d=2017-03-02": http.StatusBadRequest,
+		"/alert?currency=usd&op=gt&value=80&d=bad":         http.StatusBadRequest,
+		"/alert?currency=xyz&op=gt&value=80&d=2017-03-02":  http.StatusBadRequest,
+	}
+	for u, code := range urls {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", u, nil))
+		if w.Code != code {
+			t.Errorf("unexpected status code for %v: %v", u, w.Code)
+		}
+	}
+}
+
+func TestHandlerCompare(t *testing.T) {
+	cfg, closer := testCfg(t)
+	defer closer()
+
+	h := handler(cfg, &help{})
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/compare?currency=USD&d=2017-03-02", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %v", w.Code)
+	}
+	comparison := &rates.Comparison{}
+	if err := json.NewDecoder(w.Body).Decode(comparison); err != nil {
+		t.Fatal(err)
+	}
+	if comparison.Code != "usd" || comparison.Base != "rub" || len(comparison.Rates) != 1 {
+		t.Fatalf("unexpected comparison: %+v", comparison)
+	}
+	if item := comparison.Rates[0]; item.Provider != "cbr" || item.Rate != 58.1205 {
+		t.Errorf("unexpected rate: %+v", item)
+	}
+	urls := map[string]int{
+		"/compare?d=2017-03-02":                     http.StatusBadRequest,
+		"/compare?currency=usd&d=bad":               http.StatusBadRequest,
+		"/compare?currency=usd&to=xyz&d=2017-03-02": http.StatusBadRequest,
+	}
+	for u, code := range urls {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", u, nil))
+		if w.Code != code {
+			t.Errorf("unexpected status code for %v: %v", u, w.Code)
+		}
+	}
+	// fallback providers are compared too
+	configFile := t.TempDir() + "/config.json"
+	config := fmt.Sprintf(`{"host": "localhost", "port": 8070, "timeout": 10, "cache": 1, "fallback_providers": ["erapi"], "erapi_url": %q}`, cfg.ERAPIURL)
+	if err := ioutil.WriteFile(configFile, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	chainCfg, err := rates.New(configFile, testLogger, "exchange_test/0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chainCfg.RatesURL = cfg.RatesURL
+	if err := chainCfg.SetRequiredCodes(requiredCodes); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	handler(chainCfg, &help{})(w, httptest.NewRequest("GET", "/compare?currency=USD&d=2017-03-02", nil))
+	comparison = &rates.Comparison{}
+	if err := json.NewDecoder(w.Body).Decode(comparison); err != nil {
+		t.Fatal(err)
+	}
+	expected := []rates.ProviderRate{
+		{Provider: "cbr", Source: rates.Source{Name: "Central Bank of Russia", URL: "https://www.cbr.ru"}, Rate: 58.1205},
+		{Provider: "erapi", Source: rates.Source{Name: "ExchangeRate-API", URL: "https://www.exchangerate-api.com"}, Rate: 62.5},
+	}
+	if !reflect.DeepEqual(comparison.Rates, expected) {
+		t.Errorf("unexpected rates: %+v", comparison.Rates)
+	}
+}
+
+func TestHandlerTable(t *testing.T) {
+	cfg, closer := testCfg(t)
+	defer closer()
+
+	h := handler(cfg, &help{})
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/table?d=2017-03-02&format=xlsx", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %v", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet" {
+		t.Errorf("unexpected content type: %v", ct)
+	}
+	if cd := w.Header().Get("Content-Disposition"); cd != `attachment; filename="rates-2017-03-02.xlsx"` {
+		t.Errorf("unexpected content disposition: %v", cd)
+	}
+	if !bytes.HasPrefix(w.Body.Bytes(), []byte("PK")) {
+		t.Error("response is not zip archive")
+	}
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/table?d=2017-03-02", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %v", w.Code)
+	}
+	table := &rates.DayTable{}
+	if err := json.NewDecoder(w.Body).Decode(table); err != nil {
+		t.Fatal(err)
+	}
+	if table.Date != "2017-03-02" || len(table.Rows) == 0 {
+		t.Errorf("unexpected table: %+v", table)
+	}
+	for _, query := range []string{"d=bad", "format=pdf"} {
+		w = httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", "/table?"+query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("unexpected status code of %q: %v", query, w.Code)
+		}
+	}
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	cfg, closer := testCfg(t)
+	defer closer()
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+		http.Error(w, "too late", http.StatusServiceUnavailable)
+	}))
+	defer slow.Close()
+	cfg.RatesURL = slow.URL
+
+	h := handler(cfg, &help{})
+	req := httptest.NewRequest("GET", "/?q=1+usd&d=2017-03-02", nil)
+	req.Header.Set(timeoutHeader, "50")
+	w := httptest.NewRecorder()
+	start := time.Now()
+	h(w, req)
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("too long request: %v", d)
+	}
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("unexpected status code: %v", w.Code)
+	}
+	// the single request deadline is less than the range one
+	cfg.Deadlines = rates.Deadlines{Single: 1, Range: 60}
+	for _, value := range []string{"abc", "0", "3600000", "1001"} {
+		req := httptest.NewRequest("GET", "/?q=1+usd&d=2017-03-02", nil)
+		req.Header.Set(timeoutHeader, value)
+		w := httptest.NewRecorder()
+		h(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("unexpected status code for %v: %v", value, w.Code)
+		}
+	}
+}
+
+func TestHandlerBasePath(t *testing.T) {
+	cfg, closer := testCfg(t)
+	defer closer()
+
+	cfg.BasePath = "/api/v1"
+	h := handler(cfg, &help{})
+	urls := map[string]int{
+		"/api/v1/help":                     http.StatusOK,
+		"/api/v1/?q=1+usd&d=2017-03-02":    http.StatusOK,
+		"/api/v1?q=1+usd&d=2017-03-02":     http.StatusOK,
+		"/api/v1/codes?search=euro":        http.StatusOK,
+		"/api/v1x/help":                    http.StatusNotFound,
+		"/api/v1/unknown":                  http.StatusNotFound,
+		"/help":                            http.StatusNotFound,
+		"/?q=1+usd&d=2017-03-02":           http.StatusNotFound,
+		"/buy?rub=100&to=usd&d=2017-03-02": http.StatusNotFound,
+	}
+	for u, code := range urls {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", u, nil))
+		if w.Code != code {
+			t.Errorf("unexpected status code for %v: %v", u, w.Code)
+		}
+	}
+}
+
+func TestHandlerJSONBody(t *testing.T) {
+	cfg, closer := testCfg(t)
+	defer closer()
+
+	h := handler(cfg, &help{})
+	body := `{"queries": ["10 usd", "5 euro"], "date": "2017-03-02"}`
+	req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	w := httptest.NewRecorder()
+	h(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %v", w.Code)
+	}
+	info := &rates.Info{}
+	if err := json.NewDecoder(w.Body).Decode(info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Date != "2017-03-02" || len(info.Rates) != 2 {
+		t.Fatalf("unexpected response: %+v", info)
+	}
+	if usd, eur := info.Rates[0].Rate["usd"], info.Rates[1].Rate["eur"]; usd != 10 || eur != 5 {
+		t.Errorf("unexpected rates: %v, %v", usd, eur)
+	}
+	bodies := []string{
+		`{"queries": []}`,
+		`{"queries": ["10 usd", " "]}`,
+		`{"queries": ["10 usd"], "date": "02/03/2017"}`,
+		`{"query": "10 usd"}`,
+		`{"queries": ["10 usd"]`,
+	}
+	for _, b := range bodies {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(b))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		h(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("unexpected status code: %v", w.Code)
+		}
+	}
+	// a query with comma is a single message, it isn't split
+	req = httptest.NewRequest("POST", "/", strings.NewReader(`{"queries": ["1,5 usd", "2 eur"], "date": "2017-03-02"}`))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	h(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %v", w.Code)
+	}
+	info = &rates.Info{}
+	if err := json.NewDecoder(w.Body).Decode(info); err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Rates) != 2 || info.Rates[0].Msg != "1,5 usd" || info.Rates[1].Msg != "2 eur" {
+		t.Errorf("unexpected response: %+v", info)
+	}
+}
+
+func TestHandlerExpectContinue(t *testing.T) {
+	cfg, closer := testCfg(t)
+	defer closer()
+
+	server := httptest.NewServer(handler(cfg, &help{}))
+	defer server.Close()
+	transport := &http.Transport{ExpectContinueTimeout: 5 * time.Second}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport}
+
+	post := func(body string, contentLength int64) (int, bool) {
+		reader := &readTracker{r: strings.NewReader(body)}
+		req, err := http.NewRequest("POST", server.URL+"/", reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.ContentLength = contentLength
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Expect", "100-continue")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		return resp.StatusCode, atomic.LoadInt32(&reader.read) != 0
+	}
+	body := `{"queries": ["10 usd"], "date": "2017-03-02"}`
+	if code, read := post(body, int64(len(body))); code != http.StatusOK || !read {
+		t.Errorf("unexpected result: %v, body read %v", code, read)
+	}
+	// declared too large body is rejected without "100 Continue"
+	large := `{"queries": ["` + strings.Repeat("1", maxBodySize) + ` usd"]}`
+	if code, read := post(large, int64(len(large))); code != http.StatusRequestEntityTooLarge || read {
+		t.Errorf("unexpected result: %v, body read %v", code, read)
+	}
+	// too large body of unknown length is limited while reading
+	if code, _ := post(large, -1); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("unexpected status code: %v", code)
+	}
+}
+
+// readTracker is a reader which remembers whether it was read.
+type readTracker struct {
+	r    io.Reader
+	read int32
+}
+
+func (rt *readTracker) Read(p []byte) (int, error) {
+	atomic.StoreInt32(&rt.read, 1)
+	return rt.r.Read(p)
+}
+
+func TestHandlerRatesAge(t *testing.T) {
+	cfg, closer := testCfg(t)
+	defer closer()
+
+	h := handler(cfg, &help{})
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/?q=1+usd&d=2017-03-02", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %v", w.Code)
+	}
+	if age := w.Header().Get("X-Rates-Age"); age != "0" {
+		t.Errorf("unexpected age: %q", age)
+	}
+}
+
+func TestHandlerRangeDeadline(t *testing.T) {
+	cfg, closer := testCfg(t)
+	defer closer()
+
+	data, err := ioutil.ReadFile(testDaily)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(400 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/xml")
+		w.Write(data)
+	}))
+	defer slow.Close()
+	cfg.RatesURL = slow.URL
+	cfg.Timeout = 1
+	cfg.RangeWorkers = 1
+
+	h := handler(cfg, &help{})
+	// 4 days take longer than the single request deadline
+	u := "/calendar?from=2017-02-27&to=2017-03-02"
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", u, nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("unexpected status code: %v", w.Code)
+	}
+	cfg.Deadlines.Range = 3
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", u, nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("unexpected status code: %v", w.Code)
+	}
+}
+
+func TestHandlerHelp(t *testing.T) {
+	cfg, closer := testCfg(t)
+	defer closer()
+
+	h := handler(cfg, newHelp(cfg))
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/help", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %v", w.Code)
+	}
+	info := &help{}
+	if err := json.NewDecoder(w.Body).Decode(info); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]string{
+		"usd": {"$", "dollar", "dollars", "доллар", "доллара", "долларов", "долларах"},
+		"eur": {"€", "euro", "euros", "евро"},
+		"rub": {"₽", "rub", "ruble", "rubles", "руб", "рубль", "рубля", "рублей", "рублях"},
+	}
+	if !reflect.DeepEqual(info.Codes, expected) {
+		t.Errorf("unexpected codes: %v", info.Codes)
+	}
+	if info.P.Q != "query (default '1 rub')" {
+		t.Errorf("unexpected parameters: %+v", info.P)
+	}
+}
+
+func TestHandlerFieldNaming(t *testing.T) {
+	cfg, closer := testCfg(t)
+	defer closer()
+
+	h := handler(cfg, &help{})
+	cases := []struct {
+		naming   string
+		url      string
+		expected []string
+		absent   []string
+	}{
+		{
+			rates.NamingSnake, "/buy?rub=10000&to=USD&d=2017-03-02&receipt=true",
+			[]string{`"fetched_at":`, `"rub":`}, []string{`"fetchedAt":`},
+		},
+		{
+			rates.NamingCamel, "/buy?rub=10000&to=USD&d=2017-03-02&receipt=true",
+			[]string{`"fetchedAt":`, `"rub":`}, []string{`"fetched_at":`},
+		},
+		{
+			rates.NamingCamel, "/convert?from=usd&to=eur&amount=100&d=2017-03-02&receipt=true",
+			[]string{`"fetchedAt":`, `"amount":`}, []string{`"fetched_at":`},
+		},
+		{
+			rates.NamingCamel, "/?q=1+usd&d=2017-03-02&verbose=true&metadata=true",
+			[]string{`"cacheDate":`, `"engName":`, `"numCode":`, `"usd":`}, []string{`"cache_date":`, `"eng_name":`},
+		},
+		{
+			rates.NamingCamel, "/?q=1+usd&d=2017-03-02&verbose=true&fields=date,cache_date",
+			[]string{`"cacheDate":`}, []string{`"cache_date":`},
+		},
+		{
+			rates.NamingCamel, "/range?from=2017-03-02&to=2017-03-03&q=1+usd&verbose=true",
+			[]string{`"cacheDate":`}, []string{`"cache_date":`},
+		},
+		{
+			rates.NamingCamel, "/range?from=2017-03-03&to=2017-03-02",
+			nil, []string{`"cache_date":`},
+		},
+	}
+	for _, c := range cases {
+		cfg.FieldNaming = c.naming
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", c.url, nil))
+		body := w.Body.String()
+		if w.Code == http.StatusOK && !json.Valid(w.Body.Bytes()) {
+			t.Errorf("invalid JSON for %v %v: %v", c.naming, c.url, body)
+		}
+		for _, name := range c.expected {
+			if !strings.Contains(body, name) {
+				t.Errorf("%v %v: field %v is not found: %v", c.naming, c.url, name, body)
+			}
+		}
+		for _, name := range c.absent {
+			if strings.Contains(body, name) {
+				t.Errorf("%v %v: unexpected field %v: %v", c.naming, c.url, name, body)
+			}
+		}
+	}
+}
+
+func TestEncodeJSON(t *testing.T) {
+	cfg, closer := testCfg(t)
+	defer closer()
+
+	fetched := time.Date(2017, 3, 2, 0, 0, 0, 0, time.UTC)
+	values := []interface{}{
+		&rates.Info{
+			Date:       "2017-03-02",
+			Rates:      []rates.RateItem{{Msg: "1 usd", Rate: map[string]float64{"snake_key": 1}}},
+			CacheDate:  "2017-03-02",
+			Currencies: map[string]rates.CodeItem{"usd": {EngName: "US Dollar", CharCode: "USD"}},
+		},
+		[]*rates.Info{{Date: "2017-03-02", CacheDate: "2017-03-02"}},
+		[]rates.CodeItem{{EngName: "US Dollar", CharCode: "USD"}},
+		&rates.DayTable{Date: "2017-03-02", Rows: []rates.TableRow{{Code: "USD", NumCode: "840"}}},
+		&buyInfo{Date: "2017-03-02", Receipt: &rates.Receipt{FetchedAt: fetched}},
+	}
+	expected := map[string][]string{
+		rates.NamingSnake: {
+			`{"date":"2017-03-02","rates":[{"msg":"1 usd","rate":{"snake_key":1}}],"cache_date":"2017-03-02",` +
+				`"currencies":{"usd":{"id":"","name":"","eng_name":"US Dollar","nominal":0,"parent_code":"","num_code":"","char_code":"USD"}}}`,
+			`[{"date":"2017-03-02","rates":null,"cache_date":"2017-03-02"}]`,
+			`[{"id":"","name":"","eng_name":"US Dollar","nominal":0,"parent_code":"","num_code":"","char_code":"USD"}]`,
+			`{"date":"2017-03-02","rows":[{"code":"USD","num_code":"840","name":"","nominal":0,"value":0,"rate":0}]}`,
+			`{"date":"2017-03-02","rub":0,"to":"","value":0,"source":{"name":""},"receipt":{"amount":0,"from":"","to":"",` +
+				`"rate":0,"result":0,"date":"","fetched_at":"2017-03-02T00:00:00Z"},"markup":0,"unmarked":0}`,
+		},
+		rates.NamingCamel: {
+			`{"date":"2017-03-02","rates":[{"msg":"1 usd","rate":{"snake_key":1}}],"cacheDate":"2017-03-02",` +
+				`"currencies":{"usd":{"id":"","name":"","engName":"US Dollar","nominal":0,"parentCode":"","numCode":"","charCode":"USD"}}}`,
+			`[{"date":"2017-03-02","rates":null,"cacheDate":"2017-03-02"}]`,
+			`[{"id":"","name":"","engName":"US Dollar","nominal":0,"parentCode":"","numCode":"","charCode":"USD"}]`,
+			`{"date":"2017-03-02","rows":[{"code":"USD","numCode":"840","name":"","nominal":0,"value":0,"rate":0}]}`,
+			`{"date":"2017-03-02","rub":0,"to":"","value":0,"source":{"name":""},"markup":0,"unmarked":0,"receipt":{"amount":0,` +
+				`"from":"","to":"","rate":0,"result":0,"date":"","fetchedAt":"2017-03-02T00:00:00Z"}}`,
+		},
+	}
+	for naming, results := range expected {
+		cfg.FieldNaming = naming
+		for i, v := range values {
+			data, err := encodeJSON(v, cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e := results[i] + "\n"; string(data) != e {
+				t.Errorf("unexpected %v result of %T:\n%s\nexpected:\n%s", naming, v, data, e)
+			}
+		}
+	}
+	if _, err := encodeJSON(math.NaN(), cfg); err == nil {
+		t.Error("unexpected encoding of NaN")
+	}
+	cfg.FieldNaming = rates.NamingCamel
+	if name := fieldName("cache_date", cfg); name != "cacheDate" {
+		t.Errorf("unexpected camel field name: %v", name)
+	}
+}
+
+func TestHandlerPrecisionParam(t *testing.T) {
+	cfg, closer := testCfg(t)
+	defer closer()
+
+	h := handler(cfg, &help{})
+	expected := map[string]map[string]float64{
+		"":  {"usd": 1, "eur": 0.95, "rub": 58.12},
+		"0": {"usd": 1, "eur": 1, "rub": 58},
+		"4": {"usd": 1, "eur": 0.9483, "rub": 58.1205},
+	}
+	for precision, values := range expected {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", "/?q=1+usd&d=2017-03-02&precision="+precision, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected status code for %q: %v", precision, w.Code)
+		}
+		info := &rates.Info{}
+		if err := json.NewDecoder(w.Body).Decode(info); err != nil {
+			t.Fatal(err)
+		}
+		if len(info.Rates) != 1 || !reflect.DeepEqual(info.Rates[0].Rate, values) {
+			t.Errorf("unexpected rates for %q: %+v", precision, info.Rates)
+		}
+	}
+	for _, precision := range []string{"-1", "11", "abc", "1.5"} {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", "/?q=1+usd&d=2017-03-02&precision="+precision, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("unexpected status code for %q: %v", precision, w.Code)
+		}
+	}
+	// text formats use the precision instead of the standard scale of currency
+	texts := map[string][]string{
+		"":  {"0,95\u00a0€", "58,12\u00a0₽"},
+		"0": {"1\u00a0€", "58\u00a0₽"},
+		"4": {"0,9483\u00a0€", "58,1205\u00a0₽"},
+	}
+	for precision, values := range texts {
+		for _, accept := range []string{"text/plain", "text/html"} {
+			req := httptest.NewRequest("GET", "/?q=1+usd&d=2017-03-02&precision="+precision, nil)
+			req.Header.Set("Accept", accept)
+			w := httptest.NewRecorder()
+			h(w, req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("unexpected status code for %q %v: %v", precision, accept, w.Code)
+			}
+			body := w.Body.String()
+			for _, value := range values {
+				if !strings.Contains(body, value) {
+					t.Errorf("value %q is not found for %q %v: %q", value, precision, accept, body)
+				}
+			}
+		}
+	}
+}
+
+func TestHandlerConvert(t *testing.T) {
+	cfg, closer := testCfg(t)
+	defer closer()
+
+	h := handler(cfg, &help{})
+	// 100 * 58.1205 / 61.2863 and 100 * 58.1205 / 0.512045, JPY is not required code
+	expected := map[string]float64{"EUR": 94.83, "jpy": 11350.66, "usd": 100}
+	for to, value := range expected {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", "/convert?from=USD&to="+to+"&amount=100&d=2017-03-02", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected status code for %v: %v", to, w.Code)
+		}
+		info := &convertInfo{}
+		if err := json.NewDecoder(w.Body).Decode(info); err != nil {
+			t.Fatal(err)
+		}
+		if info.From != "usd" || info.To != strings.ToLower(to) || info.Amount != 100 || info.Value != value {
+			t.Errorf("unexpected result for %v: %+v", to, info)
+		}
+		if info.Date != "2017-03-02" || info.Source.URL == "" {
+			t.Errorf("unexpected info for %v: %+v", to, info)
+		}
+	}
+	urls := map[string]int{
+		"/convert?from=xyz&to=eur&amount=1&d=2017-03-02": http.StatusBadRequest,
+		"/convert?from=usd&to=xyz&amount=1&d=2017-03-02": http.StatusBadRequest,
+		"/convert?from=usd&amount=1&d=2017-03-02":        http.StatusBadRequest,
+		"/convert?from=usd&to=eur&amount=-1":             http.StatusBadRequest,
+		"/convert?from=usd&to=eur&amount=abc":            http.StatusBadRequest,
+		"/convert?from=usd&to=eur&amount=NaN":            http.StatusBadRequest,
+		"/convert?from=usd&to=eur&amount=Inf":            http.StatusBadRequest,
+		"/convert?from=usd&to=rub&amount=1e308":          http.StatusBadRequest,
+	}
+	for u, code := range urls {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", u, nil))
+		if w.Code != code {
+			t.Errorf("unexpected status code for %v: %v", u, w.Code)
+		}
+	}
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("POST", "/convert?from=usd&to=eur&amount=1", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("unexpected status code for POST: %v", w.Code)
+	}
+	// Saturday uses rates of Thursday 2017-03-02
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/convert?from=usd&to=eur&amount=100&d=2017-03-04", nil))
+	info := &convertInfo{}
+	if err := json.NewDecoder(w.Body).Decode(info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Date != "2017-03-02" || info.Value != 94.83 {
+		t.Errorf("unexpected weekend result: %+v", info)
+	}
+	if info.Receipt != nil {
+		t.Errorf("unexpected receipt: %+v", info.Receipt)
+	}
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/convert?from=usd&to=eur&amount=100&d=2017-03-04&receipt=true", nil))
+	info = &convertInfo{}
+	if err := json.NewDecoder(w.Body).Decode(info); err != nil {
+		t.Fatal(err)
+	}
+	receipt := info.Receipt
+	if receipt == nil {
+		t.Fatal("empty receipt")
+	}
+	if receipt.Amount != 100 || receipt.From != "usd" || receipt.To != "eur" || receipt.Rate != 58.1205/61.2863 ||
+		receipt.Result != info.Value || receipt.Date != "2017-03-02" || receipt.FetchedAt.IsZero() {
+		t.Errorf("unexpected receipt: %+v", receipt)
+	}
+	// daily rates fetch fails
+	cfg.RatesURL += "/absent"
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/convert?from=usd&to=eur&amount=1&d=2017-03-01", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("unexpected status code for failed fetch: %v", w.Code)
+	}
+}
+
+func TestHandlerRounding(t *testing.T) {
+	cfg, closer := testCfg(t)
+	defer closer()
+
+	h := handler(cfg, &help{})
+	// 58.1205 is the .5 boundary for 3 decimal places
+	expected := map[string]float64{
+		"":          58.121,
+		"half_up":   58.121,
+		"HALF_EVEN": 58.12,
+		"floor":     58.12,
+		"ceil":      58.121,
+		"truncate":  58.12,
+	}
+	for mode, value := range expected {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", "/?q=1+usd&d=2017-03-02&precision=3&rounding="+mode, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected status code for %q: %v", mode, w.Code)
+		}
+		info := &rates.Info{}
+		if err := json.NewDecoder(w.Body).Decode(info); err != nil {
+			t.Fatal(err)
+		}
+		if len(info.Rates) != 1 || info.Rates[0].Rate["rub"] != value {
+			t.Errorf("unexpected rates for %q: %+v", mode, info.Rates)
+		}
+	}
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/?q=1+usd&d=2017-03-02&rounding=half_down", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("unexpected status code: %v", w.Code)
+	}
+}
+
+func TestHandlerNumeric(t *testing.T) {
+	cfg, closer := testCfg(t)
+	defer closer()
+
+	h := handler(cfg, &help{})
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/?q=1+usd&d=2017-03-02&numeric=true", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %v", w.Code)
+	}
+	info := &rates.Info{}
+	if err := json.NewDecoder(w.Body).Decode(info); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]float64{"840": 1, "978": 0.95, "643": 58.12}
+	if len(info.Rates) != 1 || !reflect.DeepEqual(info.Rates[0].Rate, expected) {
+		t.Errorf("unexpected rates: %+v", info.Rates)
+	}
+}
+
+func TestHandlerCompact(t *testing.T) {
+	cfg, closer := testCfg(t)
+	defer closer()
+
+	cfg.Order = []string{"usd"}
+	h := handler(cfg, &help{})
+	u := "/?q=10+eur,+100+rub+to+usd&d=2017-03-02"
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", u, nil))
+	info := &rates.Info{}
+	if err := json.NewDecoder(w.Body).Decode(info); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", u+"&format=compact", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %v", w.Code)
+	}
+	compact := &rates.CompactInfo{}
+	if err := json.NewDecoder(w.Body).Decode(compact); err != nil {
+		t.Fatal(err)
+	}
+	if compact.Schema != rates.CompactSchema || compact.Date != info.Date {
+		t.Errorf("unexpected compact info: %+v", compact)
+	}
+	if codes := []string{"usd", "eur", "rub"}; !reflect.DeepEqual(compact.Codes, codes) {
+		t.Errorf("unexpected codes: %v", compact.Codes)
+	}
+	if len(compact.Rates) != len(info.Rates) {
+		t.Fatalf("unexpected number of rates: %v", len(compact.Rates))
+	}
+	for i, values := range compact.Rates {
+		if len(values) != len(compact.Codes) {
+			t.Fatalf("unexpected number of values of %v: %v", i, len(values))
+		}
+		for j, value := range values {
+			expected, ok := info.Rates[i].Rate[compact.Codes[j]]
+			if (value != nil) != ok || (ok && *value != expected) {
+				t.Errorf("unexpected value [%v][%v]: %v", i, j, value)
+			}
+		}
+	}
+	// only usd is requested for the second message
+	if values := compact.Rates[1]; values[0] == nil || values[1] != nil || values[2] != nil {
+		t.Errorf("unexpected target values: %v", values)
+	}
+}
+
+func TestHandlerMetadata(t *testing.T) {
+	cfg, closer := testCfg(t)
+	defer closer()
+
+	h := handler(cfg, &help{})
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/?q=1+usd&d=2017-03-02&metadata=true&fields=rates,currencies", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %v", w.Code)
+	}
+	info := &rates.Info{}
+	if err := json.NewDecoder(w.Body).Decode(info); err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Currencies) != 2 || info.Currencies["eur"].EngName != "Euro" || info.Currencies["usd"].NumCode != "840" {
+		t.Errorf("unexpected currencies metadata: %+v", info.Currencies)
+	}
+	if _, ok := info.Currencies["rub"]; ok {
+		t.Error("unexpected rub metadata")
+	}
+}
+
+func TestHandlerQueryForm(t *testing.T) {
+	cfg, closer := testCfg(t)
+	defer closer()
+
+	h := handler(cfg, &help{})
+	browser := "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"
+	get := func(u, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", u, nil)
+		req.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		h(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected status code for %v: %v", u, w.Code)
+		}
+		return w
+	}
+	// disabled form
+	if body := get("/", browser).Body.String(); strings.Contains(body, "<form") {
+		t.Errorf("unexpected form: %v", body)
+	}
+	cfg.QueryForm = true
+	w := get("/", browser)
+	if ct := w.Header().Get("Content-Type"); ct != "text/html; charset=UTF-8" {
+		t.Errorf("unexpected content type: %v", ct)
+	}
+	body := w.Body.String()
+	for _, value := range []string{"<form", `name="q"`, `name="d"`, `placeholder="` + cfg.DefaultQuery + `"`} {
+		if !strings.Contains(body, value) {
+			t.Errorf("%q is not found in form: %v", value, body)
+		}
+	}
+	// API clients and queries get rates
+	cases := map[string]string{
+		"/":                      "application/json",
+		"/?q=1+usd&d=2017-03-02": browser,
+	}
+	for u, accept := range cases {
+		if body := get(u, accept).Body.String(); strings.Contains(body, "<form") {
+			t.Errorf("unexpected form for %v: %v", u, body)
+		}
+	}
+	if body := get("/", "").Body.String(); !json.Valid([]byte(body)) {
+		t.Errorf("unexpected default response: %v", body)
+	}
+}
+
+func TestHandlerTime(t *testing.T) {
+	cfg, closer := testCfg(t)
+	defer closer()
+
+	h := handler(cfg, &help{})
+	get := func(u string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", u, nil))
+		return w
+	}
+	expected := get("/?q=1+usd&d=2017-03-02").Body.String()
+	// CBR rates are daily, time is ignored
+	for _, value := range []string{"00:00", "12:30", "23:59:59"} {
+		w := get("/?q=1+usd&d=2017-03-02&time=" + value)
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected status code for %v: %v", value, w.Code)
+		}
+		if body := w.Body.String(); body != expected {
+			t.Errorf("unexpected response for %v: %v", value, body)
+		}
+	}
+	for _, value := range []string{"24:00", "12", "12:60", "noon"} {
+		if w := get("/?q=1+usd&d=2017-03-02&time=" + value); w.Code != http.StatusBadRequest {
+			t.Errorf("unexpected status code for %v: %v", value, w.Code)
+		}
+	}
+	req := httptest.NewRequest("GET", "/?time=12:30:15", nil)
+	if d, err := requestTime(req); err != nil || d != 12*time.Hour+30*time.Minute+15*time.Second {
+		t.Errorf("unexpected time: %v, %v", d, err)
+	}
+}
+
+func TestHandlerFlat(t *testing.T) {
+	cfg, closer := testCfg(t)
+	defer closer()
+
+	cfg.Order = []string{"usd"}
+	h := handler(cfg, &help{})
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/?q=10+eur,+100+rub+to+usd&d=2017-03-02&format=flat", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %v", w.Code)
+	}
+	info := &rates.FlatInfo{}
+	if err := json.NewDecoder(w.Body).Decode(info); err != nil {
+		t.Fatal(err)
+	}
+	expected := []rates.FlatRate{
+		{Msg: "10 eur", Currency: "usd", Value: 10.54},
+		{Msg: "10 eur", Currency: "eur", Value: 10},
+		{Msg: "10 eur", Currency: "rub", Value: 612.86},
+		{Msg: "100 rub to usd", Currency: "usd", Value: 1.72},
+	}
+	if info.Date != "2017-03-02" || !reflect.DeepEqual(info.Rates, expected) {
+		t.Errorf("unexpected flat info: %+v", info)
+	}
+	if info.Source == nil || info.Source.Name != "Central Bank of Russia" || info.Trend != nil {
+		t.Errorf("unexpected flat info source: %+v", info)
+	}
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/?q=10+eur&d=2017-03-03&format=flat&trend=true", nil))
+	info = &rates.FlatInfo{}
+	if err := json.NewDecoder(w.Body).Decode(info); err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Trend) == 0 {
+		t.Errorf("unexpected flat info trend: %+v", info)
+	}
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/?q=abc&d=2017-03-02&format=flat", nil))
+	info = &rates.FlatInfo{}
+	if err := json.NewDecoder(w.Body).Decode(info); err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Rates) != 0 || info.Notice == "" {
+		t.Errorf("unexpected flat info notice: %+v", info)
+	}
+	urls := []string{
+		"/?q=10+eur&d=2017-03-02&format=xml",
+		"/?q=10+eur&d=2017-03-02&format=flat&fields=date",
+		"/?q=10+eur&d=2017-03-02&format=compact&fields=rates",
+	}
+	for _, u := range urls {
+		w = httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", u, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("unexpected status code of %v: %v", u, w.Code)
+		}
+	}
+}
+
+func TestHandlerFields(t *testing.T) {
+	cfg, closer := testCfg(t)
+	defer closer()
+
+	h := handler(cfg, &help{})
+	cases := map[string]string{
+		"date":        `{"date":"2017-03-02"}`,
+		"date,rate":   `{"date":"2017-03-02","rates":[{"rate":{"eur":1,"rub":61.29,"usd":1.05}}]}`,
+		"msg, Rate":   `{"rates":[{"msg":"1 eur","rate":{"eur":1,"rub":61.29,"usd":1.05}}]}`,
+		"rate,rates":  `{"rates":[{"msg":"1 eur","rate":{"eur":1,"rub":61.29,"usd":1.05}}]}`,
+		"rates,msg":   `{"rates":[{"msg":"1 eur","rate":{"eur":1,"rub":61.29,"usd":1.05}}]}`,
+		"date,msg":    `{"date":"2017-03-02","rates":[{"msg":"1 eur"}]}`,
+		"msg,source":  `{"rates":[{"msg":"1 eur"}],"source":{"name":"Central Bank of Russia","url":"https://www.cbr.ru"}}`,
+		"date,source": `{"date":"2017-03-02","source":{"name":"Central Bank of Russia","url":"https://www.cbr.ru"}}`,
+		"": `{"date":"2017-03-02","rates":[{"msg":"1 eur","rate":{"eur":1,"rub":61.29,"usd":1.05}}],` +
+			`"source":{"name":"Central Bank of Russia","url":"https://www.cbr.ru"}}`,
+	}
+	for fields, expected := range cases {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", "/?q=1+eur&d=2017-03-02&fields="+url.QueryEscape(fields), nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected status code for %q: %v", fields, w.Code)
+		}
+		if body := strings.TrimSpace(w.Body.String()); body != expected {
+			t.Errorf("unexpected response for %q: %v", fields, body)
+		}
+	}
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/?q=1+usd&d=2017-03-02&fields=date,unknown", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("unexpected status code: %v", w.Code)
+	}
+}
+
+func TestProjectionFields(t *testing.T) {
+	// names of info and items fields are resolved without ambiguity
+	names := func(v interface{}) map[string]bool {
+		result := make(map[string]bool)
+		typ := reflect.TypeOf(v)
+		for i := 0; i < typ.NumField(); i++ {
+			if name := strings.Split(typ.Field(i).Tag.Get("json"), ",")[0]; name != "" && name != "-" {
+				result[name] = true
+			}
+		}
+		return result
+	}
+	infoFields, itemFields := names(rates.Info{}), names(rates.RateItem{})
+	for field := range projectionFields {
+		if infoFields[field] == itemFields[field] {
+			t.Errorf("ambiguous or unknown projection field %q", field)
+		}
+	}
+}
+
+func TestHandlerText(t *testing.T) {
+	cfg, closer := testCfg(t)
+	defer closer()
+
+	cfg.Order = []string{"rub", "usd", "eur"}
+	h := handler(cfg, &help{})
+	req := httptest.NewRequest("GET", "/?q=1000+usd&d=2017-03-02", nil)
+	req.Header.Set("Accept", "text/plain, application/json;q=0.5")
+	w := httptest.NewRecorder()
+	h(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %v", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("unexpected content type: %v", ct)
+	}
+	expected := "2017-03-02\n1000 usd\n\trub: 58\u00a0120,50\u00a0₽\n\tusd: $1,000.00\n\teur: 948,34\u00a0€\n"
+	if body := w.Body.String(); body != expected {
+		t.Errorf("unexpected response: %q", body)
+	}
+	// JSON is default
+	for _, accept := range []string{"", "*/*", "application/*, text/plain;q=0.9", "image/png"} {
+		req := httptest.NewRequest("GET", "/?q=1000+usd&d=2017-03-02", nil)
+		req.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		h(w, req)
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+			t.Errorf("unexpected content type for %q: %v", accept, ct)
+		}
+	}
+}
+
+func TestHandlerHTML(t *testing.T) {
+	cfg, closer := testCfg(t)
+	defer closer()
+
+	cfg.Order = []string{"usd", "eur", "rub"}
+	h := handler(cfg, &help{})
+	req := httptest.NewRequest("GET", "/?q=<b>1+usd</b>&d=2017-03-02", nil)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8")
+	w := httptest.NewRecorder()
+	h(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %v", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("unexpected content type: %v", ct)
+	}
+	body := w.Body.String()
+	row := "<tr><th>&lt;b&gt;1 usd&lt;/b&gt;</th><td>$1.00</td><td>0,95\u00a0€</td><td>58,12\u00a0₽</td></tr>"
+	if !strings.Contains(body, "<table>") || !strings.Contains(body, row) {
+		t.Errorf("unexpected response: %v", body)
+	}
+	if strings.Contains(body, "<b>") {
+		t.Error("not escaped message")
+	}
+}
+
+func TestHandlerBasket(t *testing.T) {
+	cfg, closer := testCfg(t)
+	defer closer()
+
+	h := handler(cfg, &help{})
+	cfg.Basket = rates.Basket{"usd": 0.55, "eur": 0.45}
+	urls := map[string]int{
+		"/?q=1+usd&d=2017-03-02&basket=usd:0.5,eur:0.5": http.StatusOK,
+		"/?q=1+usd&d=2017-03-02&basket=true":            http.StatusOK,
+		"/?q=1+usd&d=2017-03-02&basket=usd:0.5,eur:0.6": http.StatusBadRequest,
+		"/?q=1+usd&d=2017-03-02&basket=usd:0.5,xyz:0.5": http.StatusBadRequest,
+	}
+	for u, code := range urls {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", u, nil))
+		if w.Code != code {
+			t.Errorf("unexpected status code for %v: %v", u, w.Code)
+			continue
+		}
+		if code != http.StatusOK {
+			continue
+		}
+		info := &rates.Info{}
+		if err := json.NewDecoder(w.Body).Decode(info); err != nil {
+			t.Fatal(err)
+		}
+		if len(info.Basket) != 3 {
+			t.Errorf("unexpected basket for %v: %v", u, info.Basket)
+		}
+	}
+}
+
+func TestHandlerLogSample(t *testing.T) {
+	cfg, closer := testCfg(t)
+	defer closer()
+
+	var buf bytes.Buffer
+	loggerInfo.SetOutput(&buf)
+	defer loggerInfo.SetOutput(os.Stdout)
+
+	cfg.LogSample = 10
+	h := handler(cfg, &help{})
+	for i := 0; i < 1000; i++ {
+		h(httptest.NewRecorder(), httptest.NewRequest("GET", "/help", nil))
+	}
+	if n := strings.Count(buf.String(), "\n"); n != 100 {
+		t.Errorf("unexpected number of logged requests: %v", n)
+	}
+	buf.Reset()
+	for i := 0; i < 10; i++ {
+		h(httptest.NewRecorder(), httptest.NewRequest("GET", "/unknown", nil))
+	}
+	if n := strings.Count(buf.String(), "\n"); n != 10 {
+		t.Errorf("unexpected number of logged errors: %v", n)
+	}
+	// errors don't shift the sample of successful requests
+	buf.Reset()
+	for i := 0; i < 100; i++ {
+		h(httptest.NewRecorder(), httptest.NewRequest("GET", "/unknown", nil))
+		h(httptest.NewRecorder(), httptest.NewRequest("GET", "/help", nil))
+	}
+	if n := strings.Count(buf.String(), "/help"); n != 10 {
+		t.Errorf("unexpected number of logged requests: %v", n)
+	}
+}
+
+func TestHandlerFavicon(t *testing.T) {
+	cfg, closer := testCfg(t)
+	defer closer()
+
+	var buf bytes.Buffer
+	loggerInfo.SetOutput(&buf)
+	defer loggerInfo.SetOutput(os.Stdout)
+	loggerError.SetOutput(&buf)
+	defer loggerError.SetOutput(os.Stderr)
+
+	cfg.BasePath = "exchange"
+	h := handler(cfg, &help{})
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/favicon.ico", nil))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("unexpected status code: %v", w.Code)
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("unexpected body: %v", w.Body.String())
+	}
+	if buf.Len() != 0 {
+		t.Errorf("unexpected log: %v", buf.String())
+	}
+}
+
+func TestHandlerMetrics(t *testing.T) {
+	cfg, closer := testCfg(t)
+	defer closer()
+
+	h := handler(cfg, &help{})
+	for _, method := range []string{"GET", "PUT"} {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(method, "/metrics", nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("unexpected status code of disabled metrics %v: %v", method, w.Code)
+		}
+		if allow := w.Header().Get("Allow"); allow != "" {
+			t.Errorf("unexpected Allow header of disabled metrics: %v", allow)
+		}
+	}
+	cfg.Metrics, cfg.Exemplars = true, true
+	h = handler(cfg, &help{})
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("PUT", "/metrics", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("unexpected status code: %v", w.Code)
+	}
+	req := httptest.NewRequest("GET", "/help", nil)
+	req.Header.Set(requestIDHeader, "req-1")
+	w = httptest.NewRecorder()
+	h(w, req)
+	if id := w.Header().Get(requestIDHeader); id != "req-1" {
+		t.Errorf("unexpected request ID: %q", id)
+	}
+	req = httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+	w = httptest.NewRecorder()
+	h(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %v", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/openmetrics-text") {
+		t.Errorf("unexpected content type: %v", ct)
+	}
+	body := w.Body.String()
+	for _, value := range []string{
+		"# TYPE exchange_request_duration_seconds histogram\n",
+		`exchange_request_duration_seconds_bucket{le="0.005"} 2 # {request_id="req-1"} `,
+		"exchange_request_duration_seconds_count 2\n",
+	} {
+		if !strings.Contains(body, value) {
+			t.Errorf("%q is not found in metrics: %v", value, body)
+		}
+	}
+	if !strings.HasSuffix(body, "# EOF\n") {
+		t.Errorf("unexpected metrics end: %v", body)
+	}
+	cfg.Exemplars = false
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("unexpected content type: %v", ct)
+	}
+	parser := expfmt.NewTextParser(model.LegacyValidation)
+	families, err := parser.TextToMetricFamilies(w.Body)
+	if err != nil {
+		t.Fatalf("failed to parse metrics: %v", err)
+	}
+	family, ok := families[latencyMetric]
+	if !ok || family.GetType() != dto.MetricType_HISTOGRAM || len(family.GetMetric()) != 1 {
+		t.Fatalf("unexpected metrics: %v", families)
+	}
+	histogram := family.GetMetric()[0].GetHistogram()
+	if n := histogram.GetSampleCount(); n != 3 {
+		t.Errorf("unexpected samples count: %v", n)
+	}
+	buckets := histogram.GetBucket()
+	if len(buckets) != len(latencyBuckets)+1 || !math.IsInf(buckets[len(latencyBuckets)].GetUpperBound(), 1) {
+		t.Fatalf("unexpected buckets: %v", buckets)
+	}
+	for i, bucket := range buckets[:len(latencyBuckets)] {
+		if bucket.GetUpperBound() != latencyBuckets[i] {
+			t.Errorf("unexpected bucket %v upper bound: %v", i, bucket.GetUpperBound())
+		}
+	}
+}
+
+func TestRequestMetrics(t *testing.T) {
+	m := newRequestMetrics()
+	m.observe(20*time.Millisecond, "a")
+	m.observe(30*time.Millisecond, "")
+	m.observe(20*time.Second, `b"c`)
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+	w := httptest.NewRecorder()
+	m.handler.ServeHTTP(w, req)
+	expected := []string{
+		`exchange_request_duration_seconds_bucket{le="0.01"} 0`,
+		`exchange_request_duration_seconds_bucket{le="0.025"} 1 # {request_id="a"} 0.02 `,
+		`exchange_request_duration_seconds_bucket{le="0.05"} 2`,
+		`exchange_request_duration_seconds_bucket{le="10.0"} 2`,
+		`exchange_request_duration_seconds_bucket{le="+Inf"} 3 # {request_id="b\"c"} 20.0 `,
+		`exchange_request_duration_seconds_sum 20.05`,
+		`exchange_request_duration_seconds_count 3`,
+	}
+	lines := strings.Split(w.Body.String(), "\n")
+	for _, value := range expected {
+		found := false
+		for _, line := range lines {
+			if strings.HasPrefix(line, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("line %q is not found: %q", value, lines)
+		}
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	cases := []struct {
+		header   string
+		expected string
+	}{
+		{"", "7"},
+		{" abc ", "abc"},
+		{strings.Repeat("a", maxRequestID+1), "7"},
+		{"\xff", "7"},
+	}
+	for i, c := range cases {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set(requestIDHeader, c.header)
+		if id := requestID(req, 7); id != c.expected {
+			t.Errorf("failed case=%v: %q", i, id)
+		}
+	}
+}
+
+func TestHandlerCompress(t *testing.T) {
+	cfg, closer := testCfg(t)
+	defer closer()
+
+	h := handler(cfg, &help{})
+	get := func(encoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/help", nil)
+		if encoding != "" {
+			req.Header.Set("Accept-Encoding", encoding)
+		}
+		w := httptest.NewRecorder()
+		h(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected status code: %v", w.Code)
+		}
+		return w
+	}
+	// compression is disabled by default
+	plain := get("gzip").Body.Bytes()
+	size := len(plain)
+	cfg.CompressMinSize = size
+	w := get("gzip, deflate;q=0.5")
+	if ce := w.Header().Get("Content-Encoding"); ce != "gzip" {
+		t.Fatalf("unexpected content encoding: %q", ce)
+	}
+	if vary := w.Header().Get("Vary"); vary != "Accept-Encoding" {
+		t.Errorf("unexpected Vary header: %q", vary)
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, plain) {
+		t.Errorf("unexpected decompressed body: %s", data)
+	}
+	// threshold boundary
+	cfg.CompressMinSize = size + 1
+	w = get("gzip")
+	if ce := w.Header().Get("Content-Encoding"); ce != "" || !bytes.Equal(w.Body.Bytes(), plain) {
+		t.Errorf("unexpected compressed short response: %q", ce)
+	}
+	cfg.CompressMinSize = 1
+	cfg.CompressAlgorithms = []string{rates.CompressGzip, rates.CompressDeflate}
+	encodings := map[string]string{
+		"":                         "",
+		"identity":                 "",
+		"br":                       "",
+		"gzip;q=0":                 "",
+		"deflate":                  "deflate",
+		"gzip;q=0.5, deflate":      "deflate",
+		"deflate, gzip":            "gzip",
+		"*":                        "gzip",
+		"*;q=0.1, deflate;q=0.001": "gzip",
+	}
+	for encoding, expected := range encodings {
+		if ce := get(encoding).Header().Get("Content-Encoding"); ce != expected {
+			t.Errorf("unexpected content encoding for %q: %q", encoding, ce)
+		}
+	}
+	// deflate content encoding is zlib format
+	zlr, err := zlib.NewReader(get("deflate").Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = ioutil.ReadAll(zlr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, plain) {
+		t.Errorf("unexpected deflate body: %s", data)
+	}
+}
+
+func TestHandlerMatrix(t *testing.T) {
+	cfg, closer := testCfg(t)
+	defer closer()
+
+	h := handler(cfg, &help{})
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/matrix?d=2017-03-02", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %v", w.Code)
+	}
+	matrix := &rates.Matrix{}
+	if err := json.NewDecoder(w.Body).Decode(matrix); err != nil {
+		t.Fatal(err)
+	}
+	if matrix.Date != "2017-03-02" || len(matrix.Codes) != 3 || len(matrix.Rates) != 3 {
+		t.Fatalf("unexpected matrix: %+v", matrix)
+	}
+	for _, a := range matrix.Codes {
+		if v := matrix.Rates[a][a]; v != 1 {
+			t.Errorf("unexpected diagonal value of %v: %v", a, v)
+		}
+		for _, b := range matrix.Codes {
+			ab, ba := matrix.Rates[a][b], matrix.Rates[b][a]
+			if d := ab*ba - 1; d < -1e-4 || d > 1e-4 {
+				t.Errorf("inconsistent rates %v/%v: %v, %v", a, b, ab, ba)
+			}
+		}
+	}
+	if v := matrix.Rates["usd"]["rub"]; v != 58.1205 {
+		t.Errorf("unexpected rate: %v", v)
+	}
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/matrix?d=bad", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("unexpected status code: %v", w.Code)
+	}
+}
+
+func TestHandlerChanges(t *testing.T) {
+	cfg, closer := testCfg(t)
+	defer closer()
+
+	h := handler(cfg, &help{})
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/changes?d=2017-03-02&base=2017-03-01&threshold=0.5", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %v", w.Code)
+	}
+	changes := &rates.Changes{}
+	if err := json.NewDecoder(w.Body).Decode(changes); err != nil {
+		t.Fatal(err)
+	}
+	if changes.Date != "2017-03-02" || changes.Base != "2017-03-01" || changes.Threshold != 0.5 {
+		t.Errorf("unexpected changes: %+v", changes)
+	}
+	if len(changes.Items) != 0 {
+		t.Errorf("unexpected changed currencies: %+v", changes.Items)
+	}
+	for _, query := range []string{"d=2017-03-02", "base=bad", "base=2017-03-01&threshold=-1", "base=2017-03-01&threshold=x"} {
+		w = httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", "/changes?"+query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("unexpected status code of %q: %v", query, w.Code)
+		}
+	}
+}
+
+func TestHandlerEmptyResult(t *testing.T) {
+	cfg, closer := testCfg(t)
+	defer closer()
+
+	h := handler(cfg, &help{})
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/?q=abc&d=2017-03-02", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %v", w.Code)
+	}
+	// the notice doesn't use "msg" key of rates items
+	if body := w.Body.String(); strings.Contains(body, `"msg":`) || !strings.Contains(body, `"notice":`) {
+		t.Errorf("unexpected body: %v", body)
+	}
+	info := &rates.Info{}
+	if err := json.NewDecoder(w.Body).Decode(info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Rates == nil || len(info.Rates) != 0 || info.Notice == "" {
+		t.Errorf("unexpected info: %+v", info)
+	}
+	cfg.StrictEmpty = true
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/?q=abc&d=2017-03-02", nil))
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("unexpected status code: %v", w.Code)
+	}
+}
+
+func TestHandlerRange(t *testing.T) {
+	cfg, closer := testCfg(t)
+	defer closer()
+
+	h := handler(cfg, &help{})
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/range?from=2017-03-01&to=2017-03-03&q=1+usd", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %v", w.Code)
+	}
+	if !w.Flushed {
+		t.Error("response is not flushed")
+	}
+	var result []rates.Info
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	dates := []string{"2017-03-01", "2017-03-02", "2017-03-03"}
+	if n := len(result); n != len(dates) {
+		t.Fatalf("unexpected number of dates: %v", n)
+	}
+	for i, info := range result {
+		if info.Date != dates[i] {
+			t.Errorf("unexpected date: %v", info.Date)
+		}
+		if v := info.Rates[0].Rate["rub"]; v != 58.12 {
+			t.Errorf("unexpected rate: %v", v)
+		}
+	}
+	for _, query := range []string{"to=2017-03-03", "from=2017-03-03&to=2017-03-01", "from=bad"} {
+		w = httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", "/range?"+query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("unexpected status code of %q: %v", query, w.Code)
+		}
+	}
+}
+
+func TestHandlerRangePartial(t *testing.T) {
+	data, err := ioutil.ReadFile(testDaily)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("date_req") == "03/03/2017" {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		w.Write(data)
+	}))
+	defer server.Close()
+	cfg, closer := testCfg(t)
+	defer closer()
+	cfg.RatesURL = server.URL
+	cfg.RangeWorkers = 1
+
+	h := handler(cfg, &help{})
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/range?from=2017-03-01&to=2017-03-05", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %v", w.Code)
+	}
+	var result []map[string]interface{}
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(result); n != 3 {
+		t.Fatalf("unexpected number of items: %v", n)
+	}
+	if result[1]["date"] != "2017-03-02" || result[2]["error"] == nil {
+		t.Errorf("unexpected result: %v", result)
+	}
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/range?from=2017-03-03&to=2017-03-04", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("unexpected status code: %v", w.Code)
+	}
+}
+
+func TestHandlerStale(t *testing.T) {
+	data, err := ioutil.ReadFile(testDaily)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failed {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	configFile := t.TempDir() + "/config.json"
+	config := `{"host": "localhost", "port": 8070, "timeout": 10, "cache": 1, "max_cache_age": 60, "stale_age": 3600}`
+	if err := ioutil.WriteFile(configFile, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := rates.New(configFile, testLogger, "exchange_test/0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.RatesURL = server.URL
+	if err := cfg.SetRequiredCodes(requiredCodes); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2017, 3, 2, 12, 0, 0, 0, time.UTC)
+	cfg.Clock = rates.ClockFunc(func() time.Time { return now })
+
+	h := handler(cfg, &help{})
+	for _, stale := range []bool{false, true} {
+		failed = stale
+		now = now.Add(2 * time.Minute)
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", "/?q=1+usd&d=2017-03-02", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected status code: %v", w.Code)
+		}
+		if v := w.Header().Get("X-Rates-Stale"); (v == "true") != stale {
+			t.Errorf("unexpected stale header: %q", v)
+		}
+	}
+}
+
+func TestHandlerDedupCache(t *testing.T) {
+	upstream, closer := testCfg(t)
+	defer closer()
+
+	configFile := t.TempDir() + "/config.json"
+	config := `{"host": "localhost", "port": 8070, "timeout": 10, "cache": 1, "dedup_window": 60, "debug": true}`
+	if err := ioutil.WriteFile(configFile, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := rates.New(configFile, testLogger, "exchange_test/0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.RatesURL = upstream.RatesURL
+	if err := cfg.SetRequiredCodes(requiredCodes); err != nil {
+		t.Fatal(err)
+	}
+	h := handler(cfg, &help{})
+	for _, cache := range []string{"miss", "hit"} {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", "/?q=1+usd&d=2017-03-02", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected status code: %v", w.Code)
+		}
+		if v := w.Header().Get("X-Rates-Cache"); v != cache {
+			t.Errorf("unexpected cache header: %q, expected %q", v, cache)
+		}
+	}
+}
+
+func TestHandlerMethods(t *testing.T) {
+	cfg, closer := testCfg(t)
+	defer closer()
+
+	h := handler(cfg, &help{})
+	cases := []struct {
+		method string
+		url    string
+		code   int
+		allow  string
+	}{
+		{"PUT", "/?q=1+usd&d=2017-03-02", http.StatusMethodNotAllowed, "GET, HEAD, POST"},
+		{"DELETE", "/matrix?d=2017-03-02", http.StatusMethodNotAllowed, "GET, HEAD"},
+		{"POST", "/codes", http.StatusMethodNotAllowed, "GET, HEAD"},
+		{"PUT", "/unknown", http.StatusNotFound, ""},
+		{"GET", "/?q=1+usd&d=2017-03-02", http.StatusOK, ""},
+		{"HEAD", "/matrix?d=2017-03-02", http.StatusOK, ""},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(c.method, c.url, nil))
+		if w.Code != c.code {
+			t.Errorf("unexpected status code of %v %v: %v", c.method, c.url, w.Code)
+		}
+		if allow := w.Header().Get("Allow"); allow != c.allow {
+			t.Errorf("unexpected Allow header of %v %v: %q", c.method, c.url, allow)
+		}
+	}
+}
+
+func TestHandlerPrecision(t *testing.T) {
+	cfg, closer := testCfg(t)
+	defer closer()
+
+	cfg.Order = []string{"usd", "eur", "rub"}
+	places := 4
+	cfg.Precision = rates.FormatPrecision{JSON: &places, Text: 3}
+	h := handler(cfg, &help{})
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/?q=1+usd&d=2017-03-02", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %v", w.Code)
+	}
+	info := &rates.Info{}
+	if err := json.NewDecoder(w.Body).Decode(info); err != nil {
+		t.Fatal(err)
+	}
+	if v := info.Rates[0].Rate["eur"]; v != 0.9483 {
+		t.Errorf("unexpected JSON rate: %v", v)
+	}
+	for accept, value := range map[string]string{"text/plain": "0,948\u00a0€", "text/html": "0,948\u00a0€"} {
+		req := httptest.NewRequest("GET", "/?q=1+usd&d=2017-03-02", nil)
+		req.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		h(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected status code: %v", w.Code)
+		}
+		if body := w.Body.String(); !strings.Contains(body, value) || !strings.Contains(body, "$1.000") {
+			t.Errorf("unexpected %v response: %q", accept, body)
+		}
+	}
+}
+
+func TestHandlerTimestamp(t *testing.T) {
+	cfg, closer := testCfg(t)
+	defer closer()
+
+	h := handler(cfg, &help{})
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/range?from=2017-03-01&to=2017-03-02&timestamp=true", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %v", w.Code)
+	}
+	var result []rates.Info
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(result); n != 2 {
+		t.Fatalf("unexpected number of dates: %v", n)
+	}
+	for _, info := range result {
+		date, err := time.Parse("2006-01-02", info.Date)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Timestamp != date.Unix() {
+			t.Errorf("unexpected timestamp of %v: %v", info.Date, info.Timestamp)
+		}
+	}
+}
+
+func TestHandlerDefaultQuery(t *testing.T) {
+	cfg, closer := testCfg(t)
+	defer closer()
+
+	if cfg.DefaultQuery != "1 rub" {
+		t.Errorf("unexpected default query: %v", cfg.DefaultQuery)
+	}
+	if codes := defaultCodes(cfg); len(codes) != len(requiredCodes) {
+		t.Errorf("unexpected default codes: %v", codes)
+	}
+	cfg.DefaultQuery = "100 eur"
+	cfg.Codes = map[string][]string{"eur": {"€"}, "jpy": {"¥"}}
+	if err := cfg.SetRequiredCodes(defaultCodes(cfg)); err != nil {
+		t.Fatal(err)
+	}
+	h := handler(cfg, &help{})
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/?d=2017-03-02", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %v", w.Code)
+	}
+	info := &rates.Info{}
+	if err := json.NewDecoder(w.Body).Decode(info); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(info.Rates); n != 1 {
+		t.Fatalf("unexpected rates: %v", info.Rates)
+	}
+	item := info.Rates[0]
+	if item.Msg != "100 eur" || len(item.Rate) != 2 || item.Rate["eur"] != 100 || item.Rate["jpy"] != 11968.93 {
+		t.Errorf("unexpected rate: %+v", item)
+	}
+}
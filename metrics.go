@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/z0rr0/exchange/rates"
+)
+
+const (
+	// requestIDHeader is a header of request ID, it is used as metrics exemplar label
+	requestIDHeader = "X-Request-Id"
+	// maxRequestID is maximum length of request ID from header
+	maxRequestID = 64
+	// latencyMetric is a name of requests latency histogram
+	latencyMetric = "exchange_request_duration_seconds"
+)
+
+// latencyBuckets are upper bounds in seconds of requests latency histogram buckets.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// requestMetrics is a registry of requests metrics and its HTTP handler.
+type requestMetrics struct {
+	latency prometheus.Histogram
+	handler http.Handler
+}
+
+// newRequestMetrics returns new metrics with own registry, so every main handler has separate ones.
+// OpenMetrics format is used if the client accepts it, it is required to expose exemplars.
+func newRequestMetrics() *requestMetrics {
+	latency := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    latencyMetric,
+		Help:    "Requests handling duration.",
+		Buckets: latencyBuckets,
+	})
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(latency)
+	return &requestMetrics{
+		latency: latency,
+		handler: promhttp.HandlerFor(registry, promhttp.HandlerOpts{
+			ErrorLog:          loggerError,
+			EnableOpenMetrics: true,
+			// responses are compressed by main handler
+			DisableCompression: true,
+		}),
+	}
+}
+
+// observe adds request duration d to the latency histogram, empty id doesn't add an exemplar.
+func (m *requestMetrics) observe(d time.Duration, id string) {
+	if id == "" {
+		m.latency.Observe(d.Seconds())
+		return
+	}
+	m.latency.(prometheus.ExemplarObserver).ObserveWithExemplar(d.Seconds(), prometheus.Labels{"request_id": id})
+}
+
+// requestID returns request ID from header X-Request-Id or request number n if it is absent.
+// Too long or not UTF-8 values are ignored, they are not allowed as exemplars labels.
+func requestID(r *http.Request, n uint64) string {
+	id := strings.TrimSpace(r.Header.Get(requestIDHeader))
+	if id == "" || len(id) > maxRequestID || !utf8.ValidString(id) {
+		return strconv.FormatUint(n, 10)
+	}
+	return id
+}
+
+// metricsFunc writes requests metrics in Prometheus or OpenMetrics text format to ResponseWriter
+// and returns HTTP status code.
+func metricsFunc(w http.ResponseWriter, r *http.Request, cfg *rates.Cfg, metrics *requestMetrics) int {
+	metrics.handler.ServeHTTP(w, r)
+	return http.StatusOK
+}
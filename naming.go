@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"github.com/z0rr0/exchange/rates"
+)
+
+// camelCodeItem is a catalog entry with camelCase JSON fields names.
+type camelCodeItem struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	EngName    string `json:"engName"`
+	Nominal    uint   `json:"nominal"`
+	ParentCode string `json:"parentCode"`
+	NumCode    string `json:"numCode"`
+	CharCode   string `json:"charCode"`
+}
+
+// camelReceipt is a conversion receipt with camelCase JSON fields names.
+type camelReceipt struct {
+	Amount    float64   `json:"amount"`
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Rate      float64   `json:"rate"`
+	Result    float64   `json:"result"`
+	Date      string    `json:"date"`
+	FetchedAt time.Time `json:"fetchedAt"`
+	Markup    float64   `json:"markup,omitempty"`
+	Unmarked  float64   `json:"unmarked,omitempty"`
+}
+
+// camelTableRow is a row of daily rates table with camelCase JSON fields names.
+type camelTableRow struct {
+	Code    string  `json:"code"`
+	NumCode string  `json:"numCode"`
+	Name    string  `json:"name"`
+	Nominal uint    `json:"nominal"`
+	Value   float64 `json:"value"`
+	Rate    float64 `json:"rate"`
+}
+
+// camelInfo is rates info with camelCase JSON fields names. Its fields hide
+// the same named fields of Info, empty SnakeCacheDate hides "cache_date".
+type camelInfo struct {
+	*rates.Info
+	CacheDate      string                   `json:"cacheDate,omitempty"`
+	Currencies     map[string]camelCodeItem `json:"currencies,omitempty"`
+	SnakeCacheDate string                   `json:"cache_date,omitempty"`
+}
+
+// camelBuyInfo is a currency buying response with camelCase JSON fields names.
+type camelBuyInfo struct {
+	*buyInfo
+	Receipt *camelReceipt `json:"receipt,omitempty"`
+}
+
+// camelConvertInfo is a currencies pair conversion response with camelCase JSON fields names.
+type camelConvertInfo struct {
+	*convertInfo
+	Receipt *camelReceipt `json:"receipt,omitempty"`
+}
+
+// camelDayTable is a daily rates table with camelCase JSON fields names.
+type camelDayTable struct {
+	Date string          `json:"date"`
+	Rows []camelTableRow `json:"rows"`
+}
+
+// encodeJSON returns JSON encoding of v with a trailing newline like json.Encoder.
+// Responses are replaced by their camelCase representations if it is the configured naming.
+func encodeJSON(v interface{}, cfg *rates.Cfg) ([]byte, error) {
+	if cfg.FieldNaming == rates.NamingCamel {
+		v = camelValue(v)
+	}
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// camelValue returns camelCase representation of response v,
+// it is v as is if its fields names are single words.
+func camelValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case *rates.Info:
+		if v == nil {
+			return v
+		}
+		return &camelInfo{Info: v, CacheDate: v.CacheDate, Currencies: camelCodes(v.Currencies)}
+	case []*rates.Info:
+		result := make([]interface{}, len(v))
+		for i, info := range v {
+			result[i] = camelValue(info)
+		}
+		return result
+	case map[string]interface{}:
+		// projected info has names of fields in the configured naming
+		result := make(map[string]interface{}, len(v))
+		for name, value := range v {
+			result[name] = camelValue(value)
+		}
+		return result
+	case map[string]rates.CodeItem:
+		return camelCodes(v)
+	case []rates.CodeItem:
+		result := make([]camelCodeItem, len(v))
+		for i, item := range v {
+			result[i] = camelCodeItem(item)
+		}
+		return result
+	case *buyInfo:
+		return &camelBuyInfo{buyInfo: v, Receipt: camelReceiptOf(v.Receipt)}
+	case *convertInfo:
+		return &camelConvertInfo{convertInfo: v, Receipt: camelReceiptOf(v.Receipt)}
+	case *rates.DayTable:
+		table := &camelDayTable{Date: v.Date, Rows: make([]camelTableRow, len(v.Rows))}
+		for i, row := range v.Rows {
+			table.Rows[i] = camelTableRow(row)
+		}
+		return table
+	}
+	return v
+}
+
+// camelReceiptOf returns a receipt with camelCase JSON fields names, it is nil for nil receipt.
+func camelReceiptOf(receipt *rates.Receipt) *camelReceipt {
+	if receipt == nil {
+		return nil
+	}
+	result := camelReceipt(*receipt)
+	return &result
+}
+
+// camelCodes returns catalog entries with camelCase JSON fields names, it is nil for nil items.
+func camelCodes(items map[string]rates.CodeItem) map[string]camelCodeItem {
+	if items == nil {
+		return nil
+	}
+	result := make(map[string]camelCodeItem, len(items))
+	for code, item := range items {
+		result[code] = camelCodeItem(item)
+	}
+	return result
+}
+
+// camelFields are camelCase names of multi-word projection fields.
+var camelFields = map[string]string{"cache_date": "cacheDate"}
+
+// fieldName returns JSON field name of projection in the configured naming.
+func fieldName(name string, cfg *rates.Cfg) string {
+	if camel, ok := camelFields[name]; ok && cfg.FieldNaming == rates.NamingCamel {
+		return camel
+	}
+	return name
+}
@@ -0,0 +1,69 @@
+package rates
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// basketTolerance is allowed difference of basket weights sum from 1.
+const basketTolerance = 1e-6
+
+// Basket is a weighted set of currencies, for example, {"usd": 0.5, "eur": 0.5}.
+type Basket map[string]float64
+
+// ParseBasket parses basket from comma-separated pairs "code:weight",
+// for example, "usd:0.5,eur:0.5".
+func ParseBasket(value string) (Basket, error) {
+	basket := make(Basket)
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.Split(pair, ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid basket item %q", pair)
+		}
+		weight, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid basket weight %q", parts[1])
+		}
+		code := strings.ToLower(strings.TrimSpace(parts[0]))
+		if _, ok := basket[code]; ok {
+			return nil, fmt.Errorf("duplicate basket currency %q", code)
+		}
+		basket[code] = weight
+	}
+	return basket, basket.Validate()
+}
+
+// Validate checks that basket weights are positive and their sum is 1.
+func (b Basket) Validate() error {
+	if len(b) == 0 {
+		return errors.New("empty basket")
+	}
+	var sum float64
+	for code, weight := range b {
+		if weight <= 0 {
+			return fmt.Errorf("not positive weight of %v", code)
+		}
+		sum += weight
+	}
+	if math.Abs(sum-1) > basketTolerance {
+		return fmt.Errorf("sum of basket weights %v is not 1", sum)
+	}
+	return nil
+}
+
+// value returns RUB value of the basket unit using RUB rates of currencies.
+func (b Basket) value(info map[string]float64) (float64, error) {
+	var result float64
+	for code, weight := range b {
+		rate, ok := info[strings.ToLower(code)]
+		if !ok {
+			return 0, &RateError{HTTPCode: http.StatusBadRequest, Msg: fmt.Sprintf("unknown basket currency %v", code)}
+		}
+		result += weight * rate
+	}
+	return result, nil
+}
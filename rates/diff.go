@@ -0,0 +1,65 @@
+package rates
+
+import "sort"
+
+// RateDiff is a difference of rate items with the same index.
+type RateDiff struct {
+	Msg string `json:"msg"`
+	// Delta are changes of values from the first item to the second one,
+	// only currencies of both items are compared.
+	Delta map[string]float64 `json:"delta"`
+	// Added are currencies of the second item only.
+	Added []string `json:"added,omitempty"`
+	// Removed are currencies of the first item only.
+	Removed []string `json:"removed,omitempty"`
+}
+
+// DiffInfo returns per-currency differences of rate items of a and b matched by indexes,
+// so items of repeated messages are compared too. Msg is a message of a item if it exists.
+// An item without pair is compared with an empty one, so all its currencies are added
+// or removed. Nil info has no items.
+func DiffInfo(a, b *Info) []RateDiff {
+	var aItems, bItems []RateItem
+	if a != nil {
+		aItems = a.Rates
+	}
+	if b != nil {
+		bItems = b.Rates
+	}
+	n := len(aItems)
+	if len(bItems) > n {
+		n = len(bItems)
+	}
+	result := make([]RateDiff, n)
+	for i := range result {
+		switch {
+		case i >= len(bItems):
+			result[i] = diffItem(aItems[i].Msg, aItems[i].Rate, nil)
+		case i >= len(aItems):
+			result[i] = diffItem(bItems[i].Msg, nil, bItems[i].Rate)
+		default:
+			result[i] = diffItem(aItems[i].Msg, aItems[i].Rate, bItems[i].Rate)
+		}
+	}
+	return result
+}
+
+// diffItem returns a difference of rate values a and b.
+func diffItem(msg string, a, b map[string]float64) RateDiff {
+	diff := RateDiff{Msg: msg, Delta: make(map[string]float64)}
+	for code, value := range a {
+		if other, ok := b[code]; ok {
+			diff.Delta[code] = other - value
+		} else {
+			diff.Removed = append(diff.Removed, code)
+		}
+	}
+	for code := range b {
+		if _, ok := a[code]; !ok {
+			diff.Added = append(diff.Added, code)
+		}
+	}
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	return diff
+}
@@ -0,0 +1,96 @@
+package rates
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// erapiURL is RUB based latest rates URL of ExchangeRate-API open access
+	erapiURL = "https://open.er-api.com/v6/latest/RUB"
+	// ProviderERAPI is a name of ExchangeRate-API fallback provider
+	ProviderERAPI = "erapi"
+)
+
+// erapiSource is attribution of ExchangeRate-API, it is required by its terms of use.
+var erapiSource = Source{Name: "ExchangeRate-API", URL: "https://www.exchangerate-api.com"}
+
+// fallbackProviders are constructors of built-in fallback providers by their names.
+var fallbackProviders = map[string]func(c *Cfg) Provider{
+	ProviderERAPI: func(c *Cfg) Provider { return &erapi{c: c} },
+}
+
+// erapiResponse is JSON latest rates response of ExchangeRate-API.
+type erapiResponse struct {
+	Result     string             `json:"result"`
+	ErrorType  string             `json:"error-type"`
+	BaseCode   string             `json:"base_code"`
+	UpdateUnix int64              `json:"time_last_update_unix"`
+	Rates      map[string]float64 `json:"rates"`
+}
+
+// erapi is ExchangeRate-API rates provider. It has only the latest rates,
+// so it fails for dates before their update day.
+type erapi struct {
+	c *Cfg
+}
+
+// Name returns provider's name.
+func (p *erapi) Name() string {
+	return ProviderERAPI
+}
+
+// Source returns provider's attribution.
+func (p *erapi) Source() Source {
+	return erapiSource
+}
+
+// Rates returns currencies rates for the date.
+func (p *erapi) Rates(ctx context.Context, date time.Time) (*RateTable, error) {
+	reqURL := p.c.ERAPIURL
+	req, err := p.c.newRequest(reqURL)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.c.timeout)
+	defer cancel()
+	p.c.logger.Printf("start request to %v", reqURL)
+	resp, err := p.c.httpClient.Do(req.WithContext(ctx))
+	p.c.logger.Printf("done request to %v", reqURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("not ok response: %v", resp.StatusCode)
+	}
+	var data erapiResponse
+	if err = json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+	if data.Result != "success" {
+		return nil, fmt.Errorf("failed response: %v", data.ErrorType)
+	}
+	updated := time.Unix(data.UpdateUnix, 0).UTC()
+	day := time.Date(updated.Year(), updated.Month(), updated.Day(), 0, 0, 0, 0, time.UTC)
+	if date.Before(day) {
+		return nil, fmt.Errorf("no rates of %v, the latest ones are of %v", date.Format("2006-01-02"), day.Format("2006-01-02"))
+	}
+	// values are amounts of currencies for one unit of base currency
+	table := &RateTable{
+		Base:    strings.ToLower(data.BaseCode),
+		Rates:   make(map[string]float64, len(data.Rates)),
+		Date:    day.Format("2006-01-02"),
+		Fetched: p.c.Now(),
+	}
+	for code, value := range data.Rates {
+		if code = strings.ToLower(code); code != table.Base && value > 0 {
+			table.Rates[code] = 1 / value
+		}
+	}
+	return table, nil
+}
@@ -0,0 +1,72 @@
+package rates
+
+import (
+	"strings"
+
+	"golang.org/x/text/currency"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+	"golang.org/x/text/number"
+)
+
+// nbsp is no-break space separating amount and currency symbol.
+const nbsp = "\u00a0"
+
+// nativeFormat is a currency display format of its native locale.
+type nativeFormat struct {
+	tag    language.Tag
+	suffix bool
+}
+
+// nativeFormats are display formats of known currencies,
+// other ones are formatted by English rules with char code suffix.
+var nativeFormats = map[string]nativeFormat{
+	"usd": {language.AmericanEnglish, false},
+	"gbp": {language.BritishEnglish, false},
+	"jpy": {language.Japanese, false},
+	"cny": {language.Chinese, false},
+	"eur": {language.German, true},
+	"chf": {language.MustParse("de-CH"), false},
+	"rub": {language.Russian, true},
+	"uah": {language.Ukrainian, true},
+	"kzt": {language.Kazakh, true},
+}
+
+// FormatValue returns display-ready value of currency formatted by its native locale
+// rules of grouping, decimal separator and symbol placement, for example,
+// "$1,234.56" or "1.234,56 €".
+func FormatValue(code string, value float64) string {
+	return FormatValueScale(code, value, -1)
+}
+
+// FormatValueScale is like FormatValue but with scale decimal places,
+// it is the standard scale of currency if scale is negative.
+func FormatValueScale(code string, value float64, scale int) string {
+	code = strings.ToLower(code)
+	format, ok := nativeFormats[code]
+	if !ok {
+		format = nativeFormat{tag: language.English, suffix: true}
+	}
+	printer := message.NewPrinter(format.tag)
+	unit, err := currency.ParseISO(code)
+	if err != nil {
+		if scale < 0 {
+			scale = 2
+		}
+		amount := printer.Sprint(number.Decimal(value, number.Scale(scale)))
+		return amount + nbsp + strings.ToUpper(code)
+	}
+	if scale < 0 {
+		scale, _ = currency.Standard.Rounding(unit)
+	}
+	amount := printer.Sprint(number.Decimal(value, number.Scale(scale)))
+	// narrow symbols of English locale are not full-width
+	symbol := message.NewPrinter(language.English).Sprint(currency.NarrowSymbol(unit))
+	if !ok {
+		symbol = strings.ToUpper(code)
+	}
+	if format.suffix {
+		return amount + nbsp + symbol
+	}
+	return symbol + amount
+}
@@ -0,0 +1,121 @@
+package rates
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Locale is a set of amounts parsing rules.
+type Locale int
+
+// Amounts parsing locales.
+const (
+	// English locale uses dot decimal and comma grouping separators, it is default locale.
+	English Locale = iota
+	// Russian locale uses comma decimal and space grouping separators.
+	Russian
+)
+
+// localeNames are names of amounts parsing locales.
+var localeNames = map[Locale]string{
+	English: "en",
+	Russian: "ru",
+}
+
+// ParseLocale returns amounts parsing locale by its case-insensitive name.
+func ParseLocale(name string) (Locale, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for locale, localeName := range localeNames {
+		if localeName == name {
+			return locale, nil
+		}
+	}
+	return English, fmt.Errorf("unknown locale %q", name)
+}
+
+// String returns a name of locale.
+func (l Locale) String() string {
+	if name, ok := localeNames[l]; ok {
+		return name
+	}
+	return fmt.Sprintf("Locale(%d)", int(l))
+}
+
+// MarshalText implements encoding.TextMarshaler interface.
+func (l Locale) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler interface.
+func (l *Locale) UnmarshalText(text []byte) error {
+	locale, err := ParseLocale(string(text))
+	if err != nil {
+		return err
+	}
+	*l = locale
+	return nil
+}
+
+// Split splits a query by commas which are not separators inside amounts.
+func (l Locale) Split(query string) []string {
+	var result []string
+	start := 0
+	for i := 0; i < len(query); i++ {
+		if query[i] == ',' && !l.separator(query, i) {
+			result = append(result, query[start:i])
+			start = i + 1
+		}
+	}
+	return append(result, query[start:])
+}
+
+// Normalize converts amounts of msg to the format with dot decimal separator
+// and without grouping.
+func (l Locale) Normalize(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		if l.separator(msg, i) {
+			if l == Russian && msg[i] == ',' {
+				b.WriteByte('.')
+			}
+			continue
+		}
+		b.WriteByte(msg[i])
+	}
+	return b.String()
+}
+
+// separator returns true if s[i] is a decimal or grouping separator inside an amount.
+func (l Locale) separator(s string, i int) bool {
+	if i == 0 || i+1 >= len(s) || !isDigit(s[i-1]) {
+		return false
+	}
+	switch s[i] {
+	case ',':
+		if l == Russian {
+			return isDigit(s[i+1])
+		}
+		return isGroup(s, i+1)
+	case ' ':
+		return l == Russian && isGroup(s, i+1)
+	}
+	return false
+}
+
+// isGroup returns true if s has a group of three digits from position i.
+func isGroup(s string, i int) bool {
+	if i+3 > len(s) {
+		return false
+	}
+	for j := i; j < i+3; j++ {
+		if !isDigit(s[j]) {
+			return false
+		}
+	}
+	return i+3 == len(s) || !isDigit(s[i+3])
+}
+
+// isDigit returns true if b is ASCII digit.
+func isDigit(b byte) bool {
+	return '0' <= b && b <= '9'
+}
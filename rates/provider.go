@@ -0,0 +1,193 @@
+package rates
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Provider is a source of daily currencies rates.
+type Provider interface {
+	// Name returns provider's name.
+	Name() string
+	// Rates returns currencies rates for the date.
+	Rates(ctx context.Context, date time.Time) (*RateTable, error)
+}
+
+// Source is an attribution of rates provider for display.
+type Source struct {
+	Name string `json:"name"`
+	URL  string `json:"url,omitempty"`
+}
+
+// Attributed is an optional interface of provider with display attribution.
+type Attributed interface {
+	// Source returns provider's attribution.
+	Source() Source
+}
+
+// ProviderRate is a currency rate of one provider.
+// Rate is empty if the provider failed, the failure is in Error.
+type ProviderRate struct {
+	Provider string  `json:"provider"`
+	Source   Source  `json:"source"`
+	Rate     float64 `json:"rate,omitempty"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// Comparison is a currency rate of all configured providers normalized
+// to the same base currency, providers are in configured order.
+type Comparison struct {
+	Date  string         `json:"date"`
+	Code  string         `json:"code"`
+	Base  string         `json:"base"`
+	Rates []ProviderRate `json:"rates"`
+}
+
+// cbrSource is attribution of Russian Central Bank.
+var cbrSource = Source{Name: "Central Bank of Russia", URL: "https://www.cbr.ru"}
+
+// RateTable is a set of currencies rates relative to a base currency.
+type RateTable struct {
+	// Base is a lower case char code of base currency.
+	Base string
+	// Rates are values of one currency unit in units of base currency,
+	// keys are lower case char codes, CBR tables have internal IDs keys too.
+	Rates map[string]float64
+	// Date is a date of rates YYYY-MM-DD, it is empty if it is unknown.
+	Date string
+	// Fetched is a time of receiving rates from upstream, it is zero if it is unknown.
+	Fetched time.Time
+}
+
+// rate returns a value of one currency unit in units of base currency.
+func (t *RateTable) rate(code string) (float64, error) {
+	code = strings.ToLower(code)
+	if code == t.Base {
+		return 1, nil
+	}
+	rate, ok := t.Rates[code]
+	if !ok {
+		return 0, &RateError{HTTPCode: http.StatusBadRequest, Msg: fmt.Sprintf("unknown currency %v", code)}
+	}
+	if rate <= 0 || math.IsInf(rate, 0) || math.IsNaN(rate) {
+		return 0, &RateError{HTTPCode: http.StatusInternalServerError, Msg: "invalid currency rate"}
+	}
+	return rate, nil
+}
+
+// Cross returns a value of one unit of currency "from" in units of currency "to".
+// Currencies are triangulated via the base one, so it can differ from both of them.
+func (t *RateTable) Cross(from, to string) (float64, error) {
+	fromRate, err := t.rate(from)
+	if err != nil {
+		return 0, err
+	}
+	toRate, err := t.rate(to)
+	if err != nil {
+		return 0, err
+	}
+	return fromRate / toRate, nil
+}
+
+// Rebase returns the table relative to another base currency.
+func (t *RateTable) Rebase(base string) (*RateTable, error) {
+	base = strings.ToLower(base)
+	if base == t.Base {
+		return t, nil
+	}
+	baseRate, err := t.rate(base)
+	if err != nil {
+		return nil, err
+	}
+	rates := make(map[string]float64, len(t.Rates))
+	for code, rate := range t.Rates {
+		if code != base {
+			rates[code] = rate / baseRate
+		}
+	}
+	rates[t.Base] = 1 / baseRate
+	return &RateTable{Base: base, Rates: rates, Date: t.Date, Fetched: t.Fetched}, nil
+}
+
+// cbr is Russian Central Bank rates provider, its base currency is RUB.
+type cbr struct {
+	c *Cfg
+}
+
+// Name returns provider's name.
+func (p *cbr) Name() string {
+	return "cbr"
+}
+
+// Source returns provider's attribution.
+func (p *cbr) Source() Source {
+	return cbrSource
+}
+
+// Rates returns currencies rates for the date.
+func (p *cbr) Rates(ctx context.Context, date time.Time) (*RateTable, error) {
+	dayInfo, provenance, err := p.c.dayRates(ctx, date)
+	if err != nil {
+		return nil, err
+	}
+	currencyInfo, err := currencyMap(dayInfo.Items, nil)
+	if err != nil {
+		p.c.logger.Printf("currency map prepare: %v", err)
+		return nil, &RateError{HTTPCode: http.StatusInternalServerError, Msg: "internal error"}
+	}
+	table := &RateTable{Base: "rub", Rates: currencyInfo, Fetched: provenance.Fetched}
+	if d, err := time.Parse("02.01.2006", dayInfo.Date); err == nil {
+		table.Date = d.Format("2006-01-02")
+	}
+	return table, nil
+}
+
+// chain is a providers chain, next provider is used if previous one fails.
+// Rates tables are normalized to the same base currency.
+type chain struct {
+	c         *Cfg
+	base      string
+	providers []Provider
+}
+
+// Name returns names of chain providers.
+func (p *chain) Name() string {
+	names := make([]string, len(p.providers))
+	for i, provider := range p.providers {
+		names[i] = provider.Name()
+	}
+	return strings.Join(names, ",")
+}
+
+// Rates returns currencies rates for the date from the first succeeded provider.
+func (p *chain) Rates(ctx context.Context, date time.Time) (*RateTable, error) {
+	var err error
+	for _, provider := range p.providers {
+		var table *RateTable
+		table, err = provider.Rates(ctx, date)
+		if err == nil {
+			table, err = table.Rebase(p.base)
+		}
+		if err == nil {
+			p.c.logger.Printf("rates for %v are served by provider %v", date.Format("2006-01-02"), provider.Name())
+			return table, nil
+		}
+		p.c.logger.Printf("provider %v failed: %v", provider.Name(), err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
+
+// providerSource returns attribution of provider p, it is its name if p is not Attributed.
+func providerSource(p Provider) Source {
+	if a, ok := p.(Attributed); ok {
+		return a.Source()
+	}
+	return Source{Name: p.Name()}
+}
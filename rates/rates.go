@@ -3,28 +3,106 @@
 package rates
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/gob"
+	"encoding/json"
 	"encoding/xml"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"math"
+	"math/big"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	lru "github.com/hashicorp/golang-lru"
 	"golang.org/x/net/html/charset"
+	"golang.org/x/net/http/httpguts"
+	"golang.org/x/text/unicode/norm"
+	"gopkg.in/yaml.v3"
 )
 
 const (
 	currenciesCodesURL = "https://www.cbr.ru/scripts/XML_val.asp?d=0"
 	currenciesRatesURL = "https://www.cbr.ru/scripts/XML_daily.asp"
+	// maxPort is maximum TCP port number
+	maxPort = 65535
+	// maxCacheSize is maximum number of cached days
+	maxCacheSize = 10000
+	// maxRangeDays is maximum number of days in a dates range request
+	maxRangeDays = 366
+	// maxMatrixSize is maximum number of currencies in cross-rates matrix
+	maxMatrixSize = 50
+	// monthLayout is a layout of month date
+	monthLayout = "2006-01"
+	// default upstream transport timeouts in seconds
+	defaultDialTimeout = 30
+	defaultTLSTimeout  = 10
+	defaultIdleTimeout = 10
+	// defaultRangeWorkers is default number of concurrent requests of dates range
+	defaultRangeWorkers = 4
+	// defaultMaxUpstream is default number of concurrent upstream requests
+	defaultMaxUpstream = 8
+	// defaultMaxCodes is default maximum number of required currencies codes
+	defaultMaxCodes = 100
+	// defaultMaxRedirects is default maximum number of followed upstream redirects
+	defaultMaxRedirects = 10
+	// defaultRetryDelay is default delay in milliseconds before the first retry
+	defaultRetryDelay = 100
+	// defaultJSONPrecision is default number of decimal places of JSON rates values
+	defaultJSONPrecision = 2
+	// maxPrecision is maximum number of decimal places of rates values
+	maxPrecision = 10
+	// rubNumCode is ISO numeric code of RUB
+	rubNumCode = "643"
+	// maxMarkup is maximum buying markup percentage
+	maxMarkup = 100
+	// defaultQuery is default query of rates request without messages
+	defaultQuery = "1 rub"
+	// defaultCodesMaxAge is default max age of codes catalog in seconds
+	defaultCodesMaxAge = 24 * 60 * 60
+	// resultsCacheSize is maximum number of reused rates results of identical queries
+	resultsCacheSize = 1024
+	// emptyResultMsg is a message of a query without recognized currencies
+	emptyResultMsg = "no currencies recognized"
+)
+
+// targetKeywords separate requested amount and a single target currency,
+// for example, "100 usd to eur" or "100 usd в рублях".
+var targetKeywords = map[string]bool{"to": true, "in": true, "в": true}
+
+// expRegexp matches an amount in exponent notation like "1e3" and the rest of message.
+var expRegexp = regexp.MustCompile(`^(\d+(?:\.\d+)?e[+-]?\d+)\s*(.*)$`)
+
+// idRegexp matches an amount and CBR internal currency ID like "R01235".
+var idRegexp = regexp.MustCompile(`^(?:(\d+(?:\.\d+)?)\s*)?(r\d{5}[a-z]?)$`)
+
+// symbolReplacer replaces currency symbols by their char codes
+// and common spelling variants by canonical ones.
+var symbolReplacer = strings.NewReplacer(
+	"$", " usd ",
+	"€", " eur ",
+	"₽", " rub ",
+	"£", " gbp ",
+	"¥", " jpy ",
+	"ё", "е",
 )
 
 // ResponseCodes is XML codes response.
@@ -35,16 +113,19 @@ type ResponseCodes struct {
 
 // CodeItem is currency code XML item.
 type CodeItem struct {
-	ID         string `xml:"ID,attr"`
-	Name       string `xml:"Name"`
-	EngName    string `xml:"EngName"`
-	Nominal    uint   `xml:"Nominal"`
-	ParentCode string `xml:"ParentCode"`
+	ID         string `xml:"ID,attr" json:"id"`
+	Name       string `xml:"Name" json:"name"`
+	EngName    string `xml:"EngName" json:"eng_name"`
+	Nominal    uint   `xml:"Nominal" json:"nominal"`
+	ParentCode string `xml:"ParentCode" json:"parent_code"`
+	NumCode    string `xml:"ISO_Num_Code" json:"num_code"`
+	CharCode   string `xml:"ISO_Char_Code" json:"char_code"`
 }
 
 // ResponseRates is XML rates response.
 type ResponseRates struct {
 	XMLName xml.Name       `xml:"ValCurs"`
+	Date    string         `xml:"Date,attr"`
 	Items   []CurrencyItem `xml:"Valute"`
 }
 
@@ -60,14 +141,221 @@ type CurrencyItem struct {
 
 // Info is rates' JSON struct response
 type Info struct {
-	Date  string     `json:"date"`
-	Rates []RateItem `json:"rates"`
+	Date        string              `json:"date"`
+	Rates       []RateItem          `json:"rates"`
+	Trend       map[string]string   `json:"trend,omitempty"`
+	Basket      map[string]float64  `json:"basket,omitempty"`
+	Notice      string              `json:"notice,omitempty"`
+	Suggestions []Suggestion        `json:"suggestions,omitempty"`
+	Precision   map[string]int      `json:"precision,omitempty"`
+	Cached      *bool               `json:"cached,omitempty"`
+	CacheDate   string              `json:"cache_date,omitempty"`
+	Timestamp   int64               `json:"timestamp,omitempty"`
+	Source      *Source             `json:"source,omitempty"`
+	Currencies  map[string]CodeItem `json:"currencies,omitempty"`
+	// Interpolated marks rates of a non-business day interpolated between business days ones.
+	Interpolated bool        `json:"interpolated,omitempty"`
+	Provenance   *Provenance `json:"-"`
+
+	places int
+	order  []string
 }
 
 // RateItem is exchange rate item.
 type RateItem struct {
-	Msg  string             `json:"msg"`
-	Rate map[string]float64 `json:"rate"`
+	Msg     string             `json:"msg"`
+	Rate    map[string]float64 `json:"rate"`
+	Raw     map[string]float64 `json:"raw,omitempty"`
+	Inverse map[string]float64 `json:"inverse,omitempty"`
+	Values  []CodeValue        `json:"values,omitempty"`
+	Ratio   map[string]*Ratio  `json:"ratio,omitempty"`
+
+	// fixed encodes Rate values as JSON strings with places decimal places
+	fixed  bool
+	places int
+}
+
+// FixedValues are currencies values encoded as JSON strings with fixed decimal places.
+type FixedValues struct {
+	Values map[string]float64
+	Places int
+}
+
+// MarshalJSON encodes values as JSON object of strings like {"usd": "1.50"}.
+func (v FixedValues) MarshalJSON() ([]byte, error) {
+	values := make(map[string]string, len(v.Values))
+	for code, value := range v.Values {
+		values[code] = strconv.FormatFloat(value, 'f', v.Places, 64)
+	}
+	return json.Marshal(values)
+}
+
+// RateValues returns Rate values for JSON encoding, they are
+// FixedValues if string encoding of values is configured.
+func (r RateItem) RateValues() interface{} {
+	if r.fixed {
+		return FixedValues{Values: r.Rate, Places: r.places}
+	}
+	return r.Rate
+}
+
+// MarshalJSON encodes rate item, Rate values are strings if it is configured.
+func (r RateItem) MarshalJSON() ([]byte, error) {
+	type plain RateItem
+	return json.Marshal(struct {
+		plain
+		Rate interface{} `json:"rate"`
+	}{plain(r), r.RateValues()})
+}
+
+// UnmarshalJSON decodes rate item, Rate values can be numbers or numeric strings.
+func (r *RateItem) UnmarshalJSON(data []byte) error {
+	type plain RateItem
+	item := struct {
+		*plain
+		Rate map[string]json.Number `json:"rate"`
+	}{plain: (*plain)(r)}
+	if err := json.Unmarshal(data, &item); err != nil {
+		return err
+	}
+	r.Rate = nil
+	if item.Rate != nil {
+		r.Rate = make(map[string]float64, len(item.Rate))
+		for code, value := range item.Rate {
+			v, err := value.Float64()
+			if err != nil {
+				return err
+			}
+			r.Rate[code] = v
+		}
+	}
+	return nil
+}
+
+// FlatRate is a currency value of rates item in flat representation.
+type FlatRate struct {
+	Msg      string  `json:"msg"`
+	Currency string  `json:"currency"`
+	Value    float64 `json:"value"`
+}
+
+// FlatInfo is rates info with flat list of currencies values instead of nested maps.
+type FlatInfo struct {
+	Date   string            `json:"date"`
+	Rates  []FlatRate        `json:"rates"`
+	Trend  map[string]string `json:"trend,omitempty"`
+	Notice string            `json:"notice,omitempty"`
+	Source *Source           `json:"source,omitempty"`
+}
+
+// CompactSchema is a schema reference of compact rates info.
+const CompactSchema = "exchange.compact.v1"
+
+// CompactInfo is rates info without keys, Rates[i][j] is a value of i-th requested
+// message in currency Codes[j], it is null if the currency isn't requested for the message.
+type CompactInfo struct {
+	Schema string       `json:"schema"`
+	Date   string       `json:"date"`
+	Codes  []string     `json:"codes"`
+	Rates  [][]*float64 `json:"rates"`
+}
+
+// CodeValue is a value of currency.
+type CodeValue struct {
+	Code  string  `json:"code"`
+	Value float64 `json:"value"`
+}
+
+// Ratio is an exact cross-rate as irreducible fraction.
+type Ratio struct {
+	Numerator   *big.Int `json:"numerator"`
+	Denominator *big.Int `json:"denominator"`
+}
+
+// Options are optional settings of rates request.
+type Options struct {
+	// Ratio adds exact cross-rates for one unit of requested currency.
+	Ratio bool
+	// Timeout limits upstream request if it is less than the configured one.
+	Timeout time.Duration
+	// Ordered adds currencies values as a list in the configured order.
+	Ordered bool
+	// Raw adds not rounded currencies values.
+	Raw bool
+	// Trend adds RUB rates changes against the previous business day.
+	Trend bool
+	// Basket adds values of currencies in units of the weighted basket.
+	Basket Basket
+	// Verbose adds inverse rates of every target currency.
+	Verbose bool
+	// Places is a number of decimal places of rates values, zero is JSON precision.
+	Places int
+	// ExactPlaces uses Places as is, so zero Places rounds values to integers.
+	ExactPlaces bool
+	// Rounding is a rounding mode of rates values, it is used if CustomRounding is set.
+	Rounding RoundingMode
+	// CustomRounding uses Rounding instead of the configured mode.
+	CustomRounding bool
+	// Timestamp adds Unix time of the date midnight UTC.
+	Timestamp bool
+	// Metadata adds catalog entries of returned currencies.
+	Metadata bool
+	// Interpolate replaces rates of non-business days of a dates range by values
+	// linearly interpolated between the bracketing business days.
+	Interpolate bool
+	// Numeric keys currencies values by ISO numeric codes like "840" instead of char codes.
+	Numeric bool
+	// Time is a time of the day to get the closest intraday rates,
+	// it is ignored for CBR daily rates.
+	Time time.Duration
+	// Messages are query messages used as is instead of splitting a query by commas,
+	// so a message can contain commas, for example, a JSON batch of queries.
+	Messages []string
+}
+
+// Matrix is a table of cross-rates between required currencies,
+// Rates[a][b] is a value of one unit of currency a in units of currency b.
+type Matrix struct {
+	Date  string                        `json:"date"`
+	Codes []string                      `json:"codes"`
+	Rates map[string]map[string]float64 `json:"rates"`
+}
+
+// Change is a RUB rate change of currency against a baseline date.
+type Change struct {
+	Code  string  `json:"code"`
+	Rate  float64 `json:"rate"`
+	Base  float64 `json:"base"`
+	Delta float64 `json:"delta"`
+}
+
+// Changes is a list of currencies changed against a baseline date beyond a threshold.
+type Changes struct {
+	Date      string   `json:"date"`
+	Base      string   `json:"base"`
+	Threshold float64  `json:"threshold"`
+	Items     []Change `json:"changes"`
+}
+
+// Receipt is a self-contained record of a currency conversion.
+// Rate and Result of buying receipt include the currency markup,
+// Unmarked is the result without it.
+type Receipt struct {
+	Amount    float64   `json:"amount"`
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Rate      float64   `json:"rate"`
+	Result    float64   `json:"result"`
+	Date      string    `json:"date"`
+	FetchedAt time.Time `json:"fetched_at"`
+	Markup    float64   `json:"markup,omitempty"`
+	Unmarked  float64   `json:"unmarked,omitempty"`
+}
+
+// DayStatus is rates data availability for a date.
+type DayStatus struct {
+	Date      string `json:"date"`
+	Available bool   `json:"available"`
 }
 
 // RateError is error type during rates getting.
@@ -76,18 +364,298 @@ type RateError struct {
 	Msg      string
 }
 
+// FieldError is a configuration field validation error.
+type FieldError struct {
+	Field string
+	Msg   string
+}
+
+// ConfigError is a list of all configuration validation errors.
+type ConfigError []*FieldError
+
+// Trend directions of RUB rate against the previous business day.
+const (
+	TrendUp   = "up"
+	TrendDown = "down"
+	TrendFlat = "flat"
+)
+
+// JSON response field naming conventions.
+const (
+	// NamingSnake is snake_case naming, for example, "cache_date".
+	NamingSnake = "snake"
+	// NamingCamel is camelCase naming, for example, "cacheDate".
+	NamingCamel = "camel"
+)
+
+// Behaviors of rates values overflowing float64 for too large amounts.
+const (
+	// OverflowReject returns bad request error, it is default behavior.
+	OverflowReject = "reject"
+	// OverflowClamp replaces overflowed values by maximum float64 value.
+	OverflowClamp = "clamp"
+)
+
+// Response compression algorithms.
+const (
+	CompressGzip    = "gzip"
+	CompressDeflate = "deflate"
+)
+
+// Endpoint is a kind of service endpoint with own request deadline.
+type Endpoint int
+
+// Endpoints kinds.
+const (
+	// SingleEndpoint is a request of rates for one query.
+	SingleEndpoint Endpoint = iota
+	// RangeEndpoint is a request of data for a dates range.
+	RangeEndpoint
+	// BatchEndpoint is a request of rates for a list of queries.
+	BatchEndpoint
+)
+
+// Deadlines are request deadlines per endpoint kind in seconds,
+// zero value means the common timeout.
+type Deadlines struct {
+	Single int64 `json:"single" yaml:"single"`
+	Range  int64 `json:"range" yaml:"range"`
+	Batch  int64 `json:"batch" yaml:"batch"`
+}
+
+// FormatPrecision are numbers of decimal places of rates values per output format.
+// Absent JSON precision is default 2 places, zero text precision is the standard
+// scale of currency. Max limits precision requested by clients, zero is 10 places.
+type FormatPrecision struct {
+	JSON *int `json:"json" yaml:"json"`
+	Text int  `json:"text" yaml:"text"`
+	Max  int  `json:"max" yaml:"max"`
+}
+
+// Bounds is an expected range of RUB rate of one currency unit, zero bound is not checked.
+type Bounds struct {
+	Min float64 `json:"min" yaml:"min"`
+	Max float64 `json:"max" yaml:"max"`
+}
+
+// Provenance describes where daily rates data came from.
+type Provenance struct {
+	URL     string
+	Cached  bool
+	Fetched time.Time
+	// Stale is true if expired cached data is served because of upstream failure.
+	Stale bool
+
+	clock Clock
+}
+
+// Clock is a source of current time.
+type Clock interface {
+	Now() time.Time
+}
+
+// systemClock is a clock of real time.
+type systemClock struct{}
+
+// ClockFunc is an adapter to use a function as a clock.
+type ClockFunc func() time.Time
+
 // Cfg is rates' configuration settings.
 type Cfg struct {
-	Host      string `json:"host"`
-	Port      uint   `json:"port"`
-	CacheSize int    `json:"cache"`
-	Timeout   int64  `json:"timeout"`
-	Debug     bool   `json:"debug"`
-	timeout   time.Duration
-	codes     map[string][]*regexp.Regexp
-	userAgent string
-	cache     *lru.Cache
-	logger    *log.Logger
+	Host         string       `json:"host" yaml:"host"`
+	Port         uint         `json:"port" yaml:"port"`
+	GRPCPort     uint         `json:"grpc_port" yaml:"grpc_port"`
+	CacheSize    int          `json:"cache" yaml:"cache"`
+	Timeout      int64        `json:"timeout" yaml:"timeout"`
+	Debug        bool         `json:"debug" yaml:"debug"`
+	RatesURL     string       `json:"rates_url" yaml:"rates_url"`
+	CodesURL     string       `json:"codes_url" yaml:"codes_url"`
+	Timezone     string       `json:"timezone" yaml:"timezone"`
+	Rounding     RoundingMode `json:"rounding" yaml:"rounding"`
+	MaxCacheAge  int64        `json:"max_cache_age" yaml:"max_cache_age"`
+	StaleAge     int64        `json:"stale_age" yaml:"stale_age"`
+	DedupWindow  int64        `json:"dedup_window" yaml:"dedup_window"`
+	CodesMaxAge  int64        `json:"codes_max_age" yaml:"codes_max_age"`
+	Order        []string     `json:"order" yaml:"order"`
+	BasePath     string       `json:"base_path" yaml:"base_path"`
+	Deadlines    Deadlines    `json:"deadlines" yaml:"deadlines"`
+	Locale       Locale       `json:"amount_locale" yaml:"amount_locale"`
+	DialTimeout  int64        `json:"dial_timeout" yaml:"dial_timeout"`
+	TLSTimeout   int64        `json:"tls_timeout" yaml:"tls_timeout"`
+	IdleTimeout  int64        `json:"idle_timeout" yaml:"idle_timeout"`
+	RangeWorkers int          `json:"range_workers" yaml:"range_workers"`
+	MaxUpstream  int          `json:"max_upstream" yaml:"max_upstream"`
+	// LogSample logs only every N-th successful request, the first one included,
+	// errors are always logged. Zero and one log all requests.
+	LogSample uint64 `json:"log_sample" yaml:"log_sample"`
+	// Retries is maximum number of retries of failed daily rates request,
+	// only network errors and 5xx responses are retried.
+	Retries int `json:"retries" yaml:"retries"`
+	// RetryBudget is maximum number of retries of all upstream requests
+	// of one client request, zero is unlimited.
+	RetryBudget int `json:"retry_budget" yaml:"retry_budget"`
+	// RetryDelay is a delay in milliseconds before the first retry, it is doubled
+	// for every next one, zero is default 100.
+	RetryDelay int64 `json:"retry_delay" yaml:"retry_delay"`
+	// MaxCodes is maximum number of required currencies codes. Every code adds
+	// regular expressions checked for each message, so parsing slows down linearly.
+	MaxCodes int `json:"max_codes" yaml:"max_codes"`
+	// Precision are decimal places of rates values per output format.
+	Precision FormatPrecision `json:"precision" yaml:"precision"`
+	// DefaultQuery is a query of rates request without messages, default is "1 rub".
+	DefaultQuery string `json:"default_query" yaml:"default_query"`
+	// StringValues encodes rates values as JSON strings with fixed decimal places, for example, "58.12".
+	StringValues bool `json:"string_values" yaml:"string_values"`
+	// AmountOverflow is a behavior for amounts which rates values overflow float64:
+	// "reject" (default) returns bad request error, "clamp" uses maximum float64 value.
+	AmountOverflow string `json:"amount_overflow" yaml:"amount_overflow"`
+	// QueryForm serves HTML query form for a browser rates request without parameters.
+	QueryForm bool `json:"query_form" yaml:"query_form"`
+	// WarmUpDays is a number of the last business days which rates are prefetched
+	// in background on startup, zero disables warm-up. It can't exceed CacheSize.
+	WarmUpDays int `json:"warm_up_days" yaml:"warm_up_days"`
+	// Codes are required currencies codes with aliases shown in rates responses,
+	// the service built-in codes are used if it is empty.
+	Codes map[string][]string `json:"codes" yaml:"codes"`
+	// Holidays are non-working days YYYY-MM-DD without rates, they are skipped
+	// like weekends to resolve business days without upstream requests.
+	Holidays []string `json:"holidays" yaml:"holidays"`
+	// HolidaysFile is a file of additional holidays, one date YYYY-MM-DD per line,
+	// empty lines and lines starting with "#" are ignored.
+	HolidaysFile string `json:"holidays_file" yaml:"holidays_file"`
+	// FieldNaming is a naming convention of JSON response fields: "snake" (default) or "camel".
+	FieldNaming string `json:"field_naming" yaml:"field_naming"`
+	// MaxRedirects is maximum number of followed upstream redirects,
+	// zero is default 10, negative value denies redirects.
+	MaxRedirects int `json:"max_redirects" yaml:"max_redirects"`
+	// HedgeDelay is a delay in milliseconds of a second hedged upstream request
+	// if the first one hasn't responded yet, zero disables hedging.
+	HedgeDelay int64 `json:"hedge_delay" yaml:"hedge_delay"`
+	// CacheMemory is approximate memory budget in bytes of cached daily rates,
+	// the oldest entries are evicted when it is exceeded, zero is unlimited.
+	CacheMemory int64 `json:"cache_memory" yaml:"cache_memory"`
+	// CompressMinSize is minimum size in bytes of compressed response, zero disables compression.
+	CompressMinSize int `json:"compress_min_size" yaml:"compress_min_size"`
+	// CompressAlgorithms are response compression algorithms in preference order,
+	// "gzip" and "deflate" are supported, default is gzip only.
+	CompressAlgorithms []string `json:"compress_algorithms" yaml:"compress_algorithms"`
+	// Metrics enables /metrics endpoint of requests latency histogram in Prometheus or OpenMetrics text format.
+	Metrics bool `json:"metrics" yaml:"metrics"`
+	// Exemplars adds requests IDs exemplars to metrics histogram.
+	Exemplars bool `json:"exemplars" yaml:"exemplars"`
+	// LogBodySize is maximum size in bytes of upstream response body logged
+	// on decode error in debug mode, zero disables the logging.
+	LogBodySize int `json:"log_body_size" yaml:"log_body_size"`
+	// ArchiveURL is a daily rates URL of past dates, for example, a faster mirror
+	// of CBR archive. RatesURL is used for all dates if it is empty.
+	ArchiveURL string `json:"archive_url" yaml:"archive_url"`
+	// Bounds are expected ranges of RUB rates of currencies, for example, {"usd": {"min": 10, "max": 1000}}.
+	// A rate out of its range is logged as a probable upstream data error.
+	Bounds map[string]Bounds `json:"bounds" yaml:"bounds"`
+	// RejectOutOfBounds makes a rate out of its expected range an error of requests using the currency.
+	RejectOutOfBounds bool `json:"reject_out_of_bounds" yaml:"reject_out_of_bounds"`
+	// Markup is a percentage of currencies buying markup, for example, 2 is +2% to rates.
+	Markup float64 `json:"markup" yaml:"markup"`
+	// Markups are percentages of currencies buying markups by char codes, they override Markup.
+	Markups map[string]float64 `json:"markups" yaml:"markups"`
+	// Basket is default weighted basket of currencies.
+	Basket Basket `json:"basket" yaml:"basket"`
+	// CAFile is a PEM bundle of additional root certificates of upstream TLS connections,
+	// for example, of a TLS-intercepting proxy. System roots are used anyway.
+	CAFile string `json:"ca_file" yaml:"ca_file"`
+	// Headers are additional HTTP headers of upstream requests, User-Agent is not overridden.
+	Headers map[string]string `json:"headers" yaml:"headers"`
+	// UpperCodes makes response currencies codes uppercase ISO ones, for example, "USD".
+	// Codes matching is case-insensitive anyway.
+	UpperCodes bool `json:"upper_codes" yaml:"upper_codes"`
+	// MergeDuplicates sums amounts of the same currency in a query to one rates item,
+	// for example, "100 usd, 50 usd" is the item "100 usd + 50 usd" of 150 usd.
+	// Duplicates are separate items by default.
+	MergeDuplicates bool `json:"merge_duplicates" yaml:"merge_duplicates"`
+	// StrictEmpty makes a query without recognized currencies an error instead of empty rates.
+	StrictEmpty bool `json:"strict_empty" yaml:"strict_empty"`
+	// FoldDiacritics ignores diacritical marks of aliases and queries,
+	// for example, "ё" matches "е" and "é" matches "e", but "й" doesn't match "и".
+	FoldDiacritics bool `json:"fold_diacritics" yaml:"fold_diacritics"`
+	// CleanQueries normalizes whitespace of queries messages and removes stray punctuation
+	// around amounts, for example, "(100\u00a0usd)!" is "100 usd".
+	CleanQueries bool `json:"clean_queries" yaml:"clean_queries"`
+	// PrefixAliases allows aliases at words starts, for example, "dollars" matches "dollar".
+	// Only whole words match aliases by default, so "5 rubber" doesn't match "rub".
+	PrefixAliases bool `json:"prefix_aliases" yaml:"prefix_aliases"`
+	// FallbackProviders are names of built-in rates sources used in order if CBR fails,
+	// "erapi" is ExchangeRate-API, it has only the latest rates without history.
+	FallbackProviders []string `json:"fallback_providers" yaml:"fallback_providers"`
+	// ERAPIURL is RUB based latest rates URL of "erapi" fallback provider.
+	ERAPIURL string `json:"erapi_url" yaml:"erapi_url"`
+	// Normalize prepares a message before currencies matching.
+	Normalize func(string) string `json:"-" yaml:"-"`
+	// Provider is a rates source for conversions, default is CBR.
+	Provider Provider `json:"-" yaml:"-"`
+	// Fallbacks are rates sources used in order if the primary provider fails,
+	// New sets them by FallbackProviders.
+	Fallbacks []Provider `json:"-" yaml:"-"`
+	// Clock is a source of current time, default is system clock.
+	Clock Clock `json:"-" yaml:"-"`
+
+	timeout     time.Duration
+	maxCacheAge time.Duration
+	staleAge    time.Duration
+	dedupWindow time.Duration
+	hedgeDelay  time.Duration
+	retryDelay  time.Duration
+	codesMaxAge time.Duration
+	location    *time.Location
+	codes       map[string][]*regexp.Regexp
+	aliases     map[string]string
+	names       map[string][]string
+	holidays    map[string]bool
+	userAgent   string
+	httpClient  *http.Client
+	upstream    chan struct{}
+	cache       *lru.Cache
+	cacheMu     sync.Mutex // serializes cache changes
+	cacheBytes  int64
+	results     *lru.Cache
+	logger      *log.Logger
+	catalog     []CodeItem
+	catalogAt   time.Time
+	catalogIdx  map[string]CodeItem
+	catalogMu   sync.RWMutex
+}
+
+// retryBudgetKey is a context key of upstream retries budget.
+type retryBudgetKey struct{}
+
+// dayEntry is a cached daily rates response.
+type dayEntry struct {
+	rates   *ResponseRates
+	url     string
+	fetched time.Time
+	size    int64
+}
+
+// Approximate memory sizes in bytes of structures without their strings data.
+const (
+	dayEntrySize      = 80
+	responseRatesSize = 72
+	currencyItemSize  = 88
+)
+
+// memSize returns approximate memory size in bytes of the entry.
+func (e *dayEntry) memSize() int64 {
+	size := int64(dayEntrySize + responseRatesSize + len(e.url) + len(e.rates.Date))
+	for _, item := range e.rates.Items {
+		size += int64(currencyItemSize + len(item.ID) + len(item.NumCode) +
+			len(item.CharCode) + len(item.Name) + len(item.Value))
+	}
+	return size
+}
+
+// resultEntry is a rates result of a query reused during the deduplication window.
+type resultEntry struct {
+	info    *Info
+	created time.Time
 }
 
 // parsedMsg is a structure of parsed message.
@@ -95,6 +663,10 @@ type parsedMsg struct {
 	msg      string
 	currency string
 	value    float64
+	// target is a single requested target currency, for example, "eur" of "100 usd to eur"
+	target string
+	// underflow is true if an amount in exponent notation is too small for float64
+	underflow bool
 }
 
 // Error returns error message of RateError struct.
@@ -102,6 +674,38 @@ func (r *RateError) Error() string {
 	return r.Msg
 }
 
+// Now returns current local time.
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// Now returns f().
+func (f ClockFunc) Now() time.Time {
+	return f()
+}
+
+// Age returns how long ago the data was fetched from upstream.
+func (p *Provenance) Age() time.Duration {
+	if p.clock == nil {
+		return time.Since(p.Fetched)
+	}
+	return p.clock.Now().Sub(p.Fetched)
+}
+
+// Error returns error message of FieldError struct.
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%v: %v", e.Field, e.Msg)
+}
+
+// Error returns joined messages of all configuration errors.
+func (e ConfigError) Error() string {
+	messages := make([]string, len(e))
+	for i, fieldError := range e {
+		messages[i] = fieldError.Error()
+	}
+	return "invalid configuration: " + strings.Join(messages, "; ")
+}
+
 // externalTimeout is external service timeout.
 func (c *Cfg) externalTimeout() time.Duration {
 	// external timeout is less than service one (100ms)
@@ -109,57 +713,385 @@ func (c *Cfg) externalTimeout() time.Duration {
 }
 
 // isValid checks the settings are valid.
+// It returns ConfigError with all found problems.
 func (c *Cfg) isValid() error {
+	var errs ConfigError
+	add := func(field, msg string) {
+		errs = append(errs, &FieldError{Field: field, Msg: msg})
+	}
+	if strings.ContainsAny(c.Host, " /?#") {
+		add("host", fmt.Sprintf("invalid host %q", c.Host))
+	}
+	if c.Port == 0 || c.Port > maxPort {
+		add("port", fmt.Sprintf("port %v is out of range [1, %v]", c.Port, maxPort))
+	}
+	if c.GRPCPort > maxPort {
+		add("grpc_port", fmt.Sprintf("port %v is out of range [0, %v]", c.GRPCPort, maxPort))
+	} else if c.GRPCPort != 0 && c.GRPCPort == c.Port {
+		add("grpc_port", "port is already used by HTTP service")
+	}
+	if c.CacheSize < 1 || c.CacheSize > maxCacheSize {
+		add("cache", fmt.Sprintf("cache size %v is out of range [1, %v]", c.CacheSize, maxCacheSize))
+	}
 	// required 2 due to external timeout
 	if c.Timeout < 1 {
-		return errors.New("invalid timeout value")
+		add("timeout", "invalid timeout value")
+	}
+	deadlines := []struct {
+		field string
+		value int64
+	}{{"deadlines.single", c.Deadlines.Single}, {"deadlines.range", c.Deadlines.Range}, {"deadlines.batch", c.Deadlines.Batch}}
+	for _, d := range deadlines {
+		if d.value < 0 {
+			add(d.field, "negative deadline")
+		}
+	}
+	if strings.ContainsAny(c.BasePath, " ?#") {
+		add("base_path", fmt.Sprintf("invalid path %q", c.BasePath))
+	}
+	if c.MaxCacheAge < 0 {
+		add("max_cache_age", "negative cache age")
+	}
+	if c.StaleAge < 0 {
+		add("stale_age", "negative stale age")
+	}
+	if c.FieldNaming != NamingSnake && c.FieldNaming != NamingCamel {
+		add("field_naming", fmt.Sprintf("unknown naming %q", c.FieldNaming))
+	}
+	if c.AmountOverflow != OverflowReject && c.AmountOverflow != OverflowClamp {
+		add("amount_overflow", fmt.Sprintf("unknown behavior %q", c.AmountOverflow))
+	}
+	if c.HedgeDelay < 0 {
+		add("hedge_delay", "negative delay")
+	}
+	if c.CacheMemory < 0 {
+		add("cache_memory", "negative size")
+	}
+	if c.CompressMinSize < 0 {
+		add("compress_min_size", "negative size")
+	}
+	for _, name := range c.CompressAlgorithms {
+		if name != CompressGzip && name != CompressDeflate {
+			add("compress_algorithms", fmt.Sprintf("unsupported algorithm %q", name))
+		}
+	}
+	if c.Exemplars && !c.Metrics {
+		add("exemplars", "metrics are disabled")
+	}
+	for _, name := range c.FallbackProviders {
+		if _, ok := fallbackProviders[name]; !ok {
+			add("fallback_providers", fmt.Sprintf("unknown provider %q", name))
+		}
+	}
+	if c.LogBodySize < 0 {
+		add("log_body_size", "negative size")
+	}
+	if c.WarmUpDays < 0 || c.WarmUpDays > maxRangeDays {
+		add("warm_up_days", fmt.Sprintf("number of days should be in range [0, %v]", maxRangeDays))
+	}
+	// warmed rates evicted by the next ones are requested twice
+	if c.WarmUpDays > c.CacheSize {
+		add("warm_up_days", fmt.Sprintf("number of days %v exceeds cache size %v", c.WarmUpDays, c.CacheSize))
+	}
+	if c.CacheMemory > 0 && int64(c.WarmUpDays)*(dayEntrySize+responseRatesSize) > c.CacheMemory {
+		add("warm_up_days", fmt.Sprintf("rates of %v days exceed cache memory budget", c.WarmUpDays))
+	}
+	if c.CodesMaxAge < 0 {
+		add("codes_max_age", "negative codes catalog age")
+	}
+	if c.DedupWindow < 0 {
+		add("dedup_window", "negative deduplication window")
+	}
+	if c.Retries < 0 {
+		add("retries", "negative number of retries")
+	}
+	if c.RetryBudget < 0 {
+		add("retry_budget", "negative retry budget")
+	}
+	if c.RetryDelay < 0 {
+		add("retry_delay", "negative delay")
+	}
+	if len(c.Basket) > 0 {
+		if err := c.Basket.Validate(); err != nil {
+			add("basket", err.Error())
+		}
+	}
+	for name, value := range c.Headers {
+		if !httpguts.ValidHeaderFieldName(name) || !httpguts.ValidHeaderFieldValue(value) {
+			add("headers", fmt.Sprintf("invalid header %q", name))
+		}
+	}
+	if c.RangeWorkers < 1 {
+		add("range_workers", "number of workers should be positive")
+	}
+	if c.MaxUpstream < 1 {
+		add("max_upstream", "number of upstream requests should be positive")
+	}
+	if c.MaxCodes < 1 {
+		add("max_codes", "number of codes should be positive")
+	}
+	if len(c.Codes) > c.MaxCodes {
+		add("codes", fmt.Sprintf("too many codes, max %v", c.MaxCodes))
+	}
+	for code, b := range c.Bounds {
+		if b.Min < 0 || b.Max < 0 || (b.Max > 0 && b.Min > b.Max) {
+			add("bounds", fmt.Sprintf("invalid range of %v", code))
+		}
+	}
+	if c.Markup < 0 || c.Markup >= maxMarkup {
+		add("markup", fmt.Sprintf("markup should be in range [0, %v)", maxMarkup))
+	}
+	markupCodes := make(map[string]bool, len(c.Markups))
+	for code, m := range c.Markups {
+		if m < 0 || m >= maxMarkup {
+			add("markups", fmt.Sprintf("markup of %v should be in range [0, %v)", code, maxMarkup))
+		}
+		if code = strings.ToLower(code); markupCodes[code] {
+			add("markups", fmt.Sprintf("duplicate markup of %v", code))
+		}
+		markupCodes[code] = true
+	}
+	for _, places := range []int{*c.Precision.JSON, c.Precision.Text, c.Precision.Max} {
+		if places < 0 || places > maxPrecision {
+			add("precision", fmt.Sprintf("number of decimal places should be in range [0, %v]", maxPrecision))
+			break
+		}
+	}
+	transport := []struct {
+		field string
+		value int64
+	}{{"dial_timeout", c.DialTimeout}, {"tls_timeout", c.TLSTimeout}, {"idle_timeout", c.IdleTimeout}}
+	for _, t := range transport {
+		if t.value < 0 {
+			add(t.field, "negative timeout")
+		}
+	}
+	urls := []struct {
+		field string
+		value string
+	}{{"rates_url", c.RatesURL}, {"codes_url", c.CodesURL}}
+	if c.ArchiveURL != "" {
+		urls = append(urls, struct {
+			field string
+			value string
+		}{"archive_url", c.ArchiveURL})
+	}
+	for _, u := range urls {
+		if err := checkURL(u.value); err != nil {
+			add(u.field, err.Error())
+		}
+	}
+	if _, err := time.LoadLocation(c.Timezone); err != nil {
+		add("timezone", err.Error())
+	}
+	if len(errs) > 0 {
+		return errs
 	}
 	return nil
 }
 
-// client returns HTTP client.
-func (c *Cfg) client() *http.Client {
+// newClient returns HTTP client with the configured transport timeouts.
+func (c *Cfg) newClient() (*http.Client, error) {
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{
+		Timeout:   time.Duration(c.DialTimeout) * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
 	tr := &http.Transport{
 		Proxy:                 http.ProxyFromEnvironment,
-		TLSHandshakeTimeout:   10 * time.Second,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   time.Duration(c.TLSTimeout) * time.Second,
 		MaxIdleConns:          100,
-		IdleConnTimeout:       10 * time.Second,
+		IdleConnTimeout:       time.Duration(c.IdleTimeout) * time.Second,
 		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig:       tlsConfig,
+	}
+	return &http.Client{Transport: tr, CheckRedirect: c.checkRedirect}, nil
+}
+
+// checkRedirect logs upstream redirect and follows it if it is allowed by MaxRedirects.
+// A denied redirect response is returned as is.
+func (c *Cfg) checkRedirect(req *http.Request, via []*http.Request) error {
+	c.logger.Printf("redirect %v -> %v", via[len(via)-1].URL, req.URL)
+	if c.MaxRedirects < 0 {
+		return http.ErrUseLastResponse
+	}
+	if len(via) > c.MaxRedirects {
+		return fmt.Errorf("stopped after %v redirects", c.MaxRedirects)
+	}
+	return nil
+}
+
+// tlsConfig returns TLS configuration of upstream client,
+// it is nil if custom root certificates are not configured.
+func (c *Cfg) tlsConfig() (*tls.Config, error) {
+	if c.CAFile == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(c.CAFile)
+	if err != nil {
+		return nil, err
 	}
-	return &http.Client{Transport: tr}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates in CA file %v", c.CAFile)
+	}
+	return &tls.Config{RootCAs: pool}, nil
 }
 
-// parseMsg returns corresponded
+// parseMsg returns corresponded parsed messages.
+// A message can have a single target currency like "100 usd to eur".
+// Well-formed messages "AMOUNT CODE" are matched by exact code lookup,
+// other ones are scanned by regular expressions of all codes aliases.
 func (c *Cfg) parseMsg(messages []string) []parsedMsg {
-	var nominal string
 	result := make([]parsedMsg, len(messages))
 	for j, m := range messages {
-		message := strings.Trim(m, " ")
-		result[j] = parsedMsg{msg: message}
-		for currency, rgs := range c.codes {
-			for i, rg := range rgs {
-				if matches := rg.FindStringSubmatch(message); len(matches) == 4 {
-					if i%2 == 0 {
-						nominal = matches[1]
-					} else {
-						nominal = matches[2]
-					}
-					if value, err := strconv.ParseFloat(nominal, 64); err != nil {
-						c.logger.Printf("parse float [%v] error: %v", nominal, err)
-					} else {
-						result[j].currency = currency
-						result[j].value = value
-						break
-					}
+		result[j] = parsedMsg{msg: strings.Trim(m, " ")}
+		message := result[j].msg
+		if c.CleanQueries {
+			message = cleanMsg(message)
+		}
+		if c.Normalize != nil {
+			message = c.Normalize(message)
+		}
+		message = c.Locale.Normalize(c.foldText(message))
+		if source, target, ok := splitTarget(message); ok {
+			message, result[j].target = source, c.targetCode(target)
+		}
+		amount, rest, exp := expAmount(message)
+		if exp {
+			message = "1 " + rest
+			result[j].underflow = amount == 0
+		}
+		if code, value, ok := c.matchExact(message); ok {
+			result[j].currency, result[j].value = code, value
+		} else {
+			c.matchRegexp(&result[j], message)
+		}
+		if exp && result[j].currency != "" {
+			result[j].value *= amount
+		}
+	}
+	return result
+}
+
+// expAmount returns a positive amount in exponent notation like "1e3" from the message
+// beginning and the rest of message. The amount is +Inf if it overflows float64
+// and zero if it underflows, such message is not parsed as a plain one.
+func expAmount(message string) (float64, string, bool) {
+	matches := expRegexp.FindStringSubmatch(message)
+	if matches == nil {
+		return 0, "", false
+	}
+	// range error is returned with +Inf for too large values,
+	// too small ones are zero without error, but their mantissa is not zero
+	amount, err := strconv.ParseFloat(matches[1], 64)
+	if err != nil && !math.IsInf(amount, 0) {
+		return 0, "", false
+	}
+	if amount == 0 {
+		mantissa := matches[1][:strings.IndexByte(matches[1], 'e')]
+		if strings.Trim(mantissa, "0.") == "" {
+			return 0, "", false
+		}
+	}
+	return amount, matches[2], true
+}
+
+// targetCode returns a code of target currency name which is a known code or alias,
+// or starts with an alias if PrefixAliases is set, for example, "рублях".
+// Other names are returned as is.
+func (c *Cfg) targetCode(name string) string {
+	if code, ok := c.aliases[name]; ok {
+		return code
+	}
+	if !c.PrefixAliases {
+		return name
+	}
+	var code, prefix string
+	for alias, aliasCode := range c.aliases {
+		if len(alias) > len(prefix) && strings.HasPrefix(name, alias) {
+			code, prefix = aliasCode, alias
+		}
+	}
+	if code == "" {
+		return name
+	}
+	return code
+}
+
+// matchExact returns currency code and amount of message "AMOUNT CODE"
+// where CODE is a known code or alias. It is a fast path of matchRegexp.
+func (c *Cfg) matchExact(message string) (string, float64, bool) {
+	i := strings.IndexByte(message, ' ')
+	if i < 0 {
+		return "", 0, false
+	}
+	amount, name := message[:i], message[i+1:]
+	code, ok := c.aliases[name]
+	if !ok || !isAmount(amount) {
+		return "", 0, false
+	}
+	value, err := strconv.ParseFloat(amount, 64)
+	if err != nil || value <= 0 {
+		return "", 0, false
+	}
+	return code, value, true
+}
+
+// matchRegexp sets currency and amount of parsed message m
+// using regular expressions of all codes aliases.
+func (c *Cfg) matchRegexp(m *parsedMsg, message string) {
+	var nominal string
+	for currency, rgs := range c.codes {
+		for i, rg := range rgs {
+			if matches := rg.FindStringSubmatch(message); len(matches) == 4 {
+				if i%2 == 0 {
+					nominal = matches[1]
+				} else {
+					nominal = matches[2]
+				}
+				if value, err := strconv.ParseFloat(nominal, 64); err != nil {
+					c.logger.Printf("parse float [%v] error: %v", nominal, err)
+				} else {
+					m.currency = currency
+					m.value = value
+					break
 				}
 			}
-			if result[j].value > 0 {
-				// some currency already found
-				break
+		}
+		if m.value > 0 {
+			// some currency already found
+			break
+		}
+	}
+	if code, ok := c.aliases[strings.TrimSpace(message)]; ok && m.value == 0 {
+		// bare currency without amount is one unit
+		m.currency = code
+		m.value = 1
+	}
+	if matches := idRegexp.FindStringSubmatch(strings.TrimSpace(message)); matches != nil && m.value == 0 {
+		// CBR internal ID, for example, "100 r01235"
+		m.currency, m.value = matches[2], 1
+		if matches[1] != "" {
+			if value, err := strconv.ParseFloat(matches[1], 64); err == nil {
+				m.value = value
 			}
 		}
 	}
-	return result
+}
+
+// NormalizeQuery is default message normalization, it replaces currency
+// symbols by char codes and collapses whitespaces.
+func NormalizeQuery(msg string) string {
+	msg = symbolReplacer.Replace(strings.ToLower(msg))
+	return strings.Join(strings.Fields(msg), " ")
 }
 
 // Addr returns service's net address.
@@ -167,96 +1099,674 @@ func (c *Cfg) Addr() string {
 	return net.JoinHostPort(c.Host, fmt.Sprint(c.Port))
 }
 
-// HandleTimeout is service timeout.
-func (c *Cfg) HandleTimeout() time.Duration {
-	return time.Duration(c.Timeout) * time.Second
+// GRPCAddr returns gRPC service's net address, it is empty if gRPC is disabled.
+func (c *Cfg) GRPCAddr() string {
+	if c.GRPCPort == 0 {
+		return ""
+	}
+	return net.JoinHostPort(c.Host, fmt.Sprint(c.GRPCPort))
 }
 
-// SetRequiredCodes sets required currencies char codes and their aliases.
-// For example, {"USD": ["$", "dollar"], "RUB": ["руб", "rubles"]}
-func (c *Cfg) SetRequiredCodes(codeNames map[string][]string) error {
-	codes := make(map[string][]*regexp.Regexp)
-	for code, names := range codeNames {
-		namesRegexp := make([]*regexp.Regexp, (len(names)+1)*2)
-		quotedCode := regexp.QuoteMeta(strings.ToLower(code))
-		rg, err := regexp.Compile(fmt.Sprintf("(\\d+(\\.\\d+)?)\\s*(%s)", quotedCode))
-		if err != nil {
-			return err
-		}
-		namesRegexp[0] = rg
-		rg, err = regexp.Compile(fmt.Sprintf("(%s)\\s*(\\d+(\\.\\d+)?)", quotedCode))
-		if err != nil {
-			return err
-		}
-		namesRegexp[1] = rg
-		for i, name := range names {
-			j := (i + 1) * 2
-			namePattern := regexp.QuoteMeta(strings.ToLower(name))
-			rg, err = regexp.Compile(fmt.Sprintf("(\\d+(\\.\\d+)?){1}\\s*(%s)", namePattern))
-			if err != nil {
-				return err
-			}
-			namesRegexp[j] = rg
-			rg, err = regexp.Compile(fmt.Sprintf("(%s)\\s*(\\d+(\\.\\d+)?){1}", namePattern))
-			if err != nil {
-				return err
-			}
-			namesRegexp[j+1] = rg
+// HandleTimeout is service timeout, it is not less than any endpoint deadline.
+func (c *Cfg) HandleTimeout() time.Duration {
+	timeout := c.Timeout
+	for _, value := range []int64{c.Deadlines.Single, c.Deadlines.Range, c.Deadlines.Batch} {
+		if value > timeout {
+			timeout = value
 		}
-		codes[strings.ToLower(code)] = namesRegexp
 	}
-	c.codes = codes
-	return nil
+	return time.Duration(timeout) * time.Second
 }
 
-// GetCodes returns available currencies codes.
-func (c *Cfg) GetCodes() ([]CodeItem, error) {
-	client := c.client()
-	c.logger.Printf("start request to %v", currenciesCodesURL)
-	defer func() {
-		c.logger.Printf("done request to %v", currenciesCodesURL)
-	}()
-	resp, err := client.Get(currenciesCodesURL)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-	if statusCode := resp.StatusCode; statusCode != http.StatusOK {
-		return nil, fmt.Errorf("not ok response: %v", statusCode)
+// Deadline returns a request deadline of the endpoint kind.
+func (c *Cfg) Deadline(e Endpoint) time.Duration {
+	var value int64
+	switch e {
+	case SingleEndpoint:
+		value = c.Deadlines.Single
+	case RangeEndpoint:
+		value = c.Deadlines.Range
+	case BatchEndpoint:
+		value = c.Deadlines.Batch
 	}
-	codes := &ResponseCodes{}
-	decoder := xml.NewDecoder(resp.Body)
-	decoder.CharsetReader = charset.NewReaderLabel
-	err = decoder.Decode(codes)
-	if err != nil {
-		return nil, err
+	if value == 0 {
+		value = c.Timeout
 	}
-	return codes.Items, nil
+	return time.Duration(value) * time.Second
 }
 
-// dayRates gets currencies rates for requested day.
-func (c *Cfg) dayRates(date time.Time) (*ResponseRates, error) {
-	var resp *http.Response
+// DayDate returns a calendar date of t in the configured time zone.
+func (c *Cfg) DayDate(t time.Time) time.Time {
+	y, m, d := t.In(c.location).Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// Now returns current time of the configured clock.
+func (c *Cfg) Now() time.Time {
+	if c.Clock == nil {
+		return time.Now()
+	}
+	return c.Clock.Now()
+}
+
+// Today returns current date in the configured time zone.
+func (c *Cfg) Today() time.Time {
+	return c.DayDate(c.Now())
+}
+
+// ParseDate parses a date, empty value is today. Supported formats are
+// YYYY-MM-DD, YYYY.MM.DD, YYYY/MM/DD, YYYYMMDD and DD.MM.YYYY.
+// A month YYYY-MM is its last day, or today for the current month.
+// Future dates are not allowed.
+func (c *Cfg) ParseDate(value string) (time.Time, error) {
+	if value == "" {
+		return c.Today(), nil
+	}
+	layout, err := dateLayout(value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	date, err := time.Parse(layout, value)
+	if err != nil {
+		return date, errors.New("bad date format")
+	}
+	today := c.Today()
+	if date.After(today) {
+		return date, errors.New("bad date")
+	}
+	if layout == monthLayout {
+		if date = date.AddDate(0, 1, -1); date.After(today) {
+			date = today
+		}
+	}
+	return date, nil
+}
+
+// ResolveDate parses a date like ParseDate, but a month YYYY-MM is resolved
+// to its last business day. It is done by the holidays calendar if it is configured,
+// otherwise using the date of rates known at the month end.
+// The month end is used if the rates request fails.
+func (c *Cfg) ResolveDate(ctx context.Context, value string) (time.Time, error) {
+	date, err := c.ParseDate(value)
+	if err != nil || len(value) != len(monthLayout) {
+		return date, err
+	}
+	if len(c.holidays) > 0 {
+		return c.businessDay(date), nil
+	}
+	dayInfo, _, err := c.dailyRates(ctx, date)
+	if err != nil {
+		c.logger.Printf("resolve business day of %v: %v", value, err)
+		return date, nil
+	}
+	if d, err := time.Parse("02.01.2006", dayInfo.Date); err == nil && d.Before(date) {
+		return d, nil
+	}
+	return date, nil
+}
+
+// SetHolidays sets non-working days in format YYYY-MM-DD.
+func (c *Cfg) SetHolidays(dates []string) error {
+	holidays := make(map[string]bool, len(dates))
+	for _, value := range dates {
+		date, err := time.Parse("2006-01-02", strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("bad holiday %q", value)
+		}
+		holidays[date.Format("2006-01-02")] = true
+	}
+	c.holidays = holidays
+	return nil
+}
+
+// businessDay returns the date if it is a business day,
+// otherwise the closest previous one skipping weekends and holidays.
+func (c *Cfg) businessDay(date time.Time) time.Time {
+	for {
+		switch {
+		case date.Weekday() == time.Saturday || date.Weekday() == time.Sunday:
+		case c.holidays[date.Format("2006-01-02")]:
+		default:
+			return date
+		}
+		date = date.AddDate(0, 0, -1)
+	}
+}
+
+// readHolidays returns holidays dates from the file, one date per line.
+func readHolidays(filename string) ([]string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var dates []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			dates = append(dates, line)
+		}
+	}
+	return dates, nil
+}
+
+// outOfBounds returns true if RUB rate of one currency unit is out of its expected range,
+// bounds codes are case-insensitive.
+func (c *Cfg) outOfBounds(code string, rate float64) bool {
+	for k, b := range c.Bounds {
+		if strings.ToLower(k) == code {
+			return (b.Min > 0 && rate < b.Min) || (b.Max > 0 && rate > b.Max)
+		}
+	}
+	return false
+}
+
+// warnBounds logs a warning about every RUB rate of currency unit out of its
+// expected range, it is called once for fetched rates.
+func (c *Cfg) warnBounds(rates map[string]float64) {
+	codes := make([]string, 0, len(c.Bounds))
+	for code := range c.Bounds {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	for _, code := range codes {
+		rate, ok := rates[strings.ToLower(code)]
+		if ok && c.outOfBounds(strings.ToLower(code), rate) {
+			b := c.Bounds[code]
+			c.logger.Printf("WARNING: rate of %v %v is out of expected range [%v, %v]", code, rate, b.Min, b.Max)
+		}
+	}
+}
+
+// checkBounds returns an error if RejectOutOfBounds is set and RUB rate
+// of any currency used by a request is out of its expected range.
+func (c *Cfg) checkBounds(rates map[string]float64, codes ...string) error {
+	if !c.RejectOutOfBounds {
+		return nil
+	}
+	sort.Strings(codes)
+	for _, code := range codes {
+		code = strings.ToLower(code)
+		if rate, ok := rates[code]; ok && c.outOfBounds(code, rate) {
+			msg := fmt.Sprintf("rate of %v is out of expected range", code)
+			return &RateError{HTTPCode: http.StatusBadGateway, Msg: msg}
+		}
+	}
+	return nil
+}
+
+// usedCodes returns currencies codes of parsed messages and their targets,
+// required codes are targets of messages without a single target currency.
+func (c *Cfg) usedCodes(messages []parsedMsg) []string {
+	var codes []string
+	required := false
+	for _, m := range messages {
+		codes = append(codes, m.currency)
+		if m.target != "" {
+			codes = append(codes, m.target)
+		} else {
+			required = true
+		}
+	}
+	if required {
+		codes = append(codes, c.codesOrder()...)
+	}
+	return codes
+}
+
+// codesOrder returns required currencies codes in the configured order,
+// codes missing in the order setting follow in alphabetical order.
+func (c *Cfg) codesOrder() []string {
+	result := make([]string, 0, len(c.codes))
+	for code := range c.codes {
+		result = append(result, code)
+	}
+	sortCodes(result, c.Order)
+	return result
+}
+
+// sortCodes sorts currencies codes in the order, codes missing in it
+// follow in alphabetical order. Codes are compared case-insensitive.
+func sortCodes(codes, order []string) {
+	positions := make(map[string]int, len(order))
+	for i, code := range order {
+		positions[strings.ToLower(code)] = i
+	}
+	sort.Slice(codes, func(i, j int) bool {
+		a, b := strings.ToLower(codes[i]), strings.ToLower(codes[j])
+		pi, iOk := positions[a]
+		pj, jOk := positions[b]
+		switch {
+		case iOk && jOk:
+			return pi < pj
+		case iOk != jOk:
+			return iOk
+		}
+		return a < b
+	})
+}
+
+// SetRequiredCodes sets required currencies char codes and their aliases.
+// For example, {"USD": ["$", "dollar"], "RUB": ["руб", "rubles"]}
+// An alias matches from a word start, so "rub" doesn't match "scrub 5",
+// and whole words only unless PrefixAliases is set. A number of codes is limited
+// by MaxCodes, because every message is matched against all codes aliases.
+func (c *Cfg) SetRequiredCodes(codeNames map[string][]string) error {
+	if n := len(codeNames); n > c.MaxCodes {
+		return fmt.Errorf("too many required codes %v, max %v", n, c.MaxCodes)
+	}
+	codes := make(map[string][]*regexp.Regexp)
+	aliases := make(map[string]string)
+	original := make(map[string][]string, len(codeNames))
+	for code, names := range codeNames {
+		original[strings.ToLower(code)] = append([]string{}, names...)
+	}
+	for code, names := range codeNames {
+		aliases[strings.ToLower(code)] = strings.ToLower(code)
+		for _, name := range names {
+			aliases[c.foldText(name)] = strings.ToLower(code)
+		}
+		names = append([]string{code}, names...)
+		namesRegexp := make([]*regexp.Regexp, len(names)*2)
+		for i, name := range names {
+			name = c.foldText(name)
+			start, end := c.aliasBounds(name)
+			namePattern := regexp.QuoteMeta(name)
+			rg, err := regexp.Compile(fmt.Sprintf("(\\d+(\\.\\d+)?){1}\\s*(%s)%s", namePattern, end))
+			if err != nil {
+				return err
+			}
+			namesRegexp[i*2] = rg
+			rg, err = regexp.Compile(fmt.Sprintf("%s(%s)\\s*(\\d+(\\.\\d+)?){1}", start, namePattern))
+			if err != nil {
+				return err
+			}
+			namesRegexp[i*2+1] = rg
+		}
+		codes[strings.ToLower(code)] = namesRegexp
+	}
+	c.codes = codes
+	c.aliases = aliases
+	c.names = original
+	return nil
+}
+
+// Aliases returns required currencies codes with their aliases as they are set.
+func (c *Cfg) Aliases() map[string][]string {
+	result := make(map[string][]string, len(c.names))
+	for code, names := range c.names {
+		result[code] = append([]string{}, names...)
+	}
+	return result
+}
+
+// cleanMsg returns message with all whitespace runs replaced by single spaces,
+// punctuation around amounts and the trailing sentence punctuation are removed.
+// Dot is removed only from the last word without other dots, like "usd.",
+// so abbreviations like "у.е." are kept.
+func cleanMsg(message string) string {
+	words := strings.Fields(message)
+	for i, word := range words {
+		if strings.IndexFunc(word, unicode.IsDigit) >= 0 {
+			words[i] = strings.TrimFunc(word, unicode.IsPunct)
+		}
+	}
+	for n := len(words); n > 0; n = len(words) {
+		last := strings.TrimRightFunc(words[n-1], func(r rune) bool {
+			return r != '.' && unicode.IsPunct(r)
+		})
+		if strings.Count(last, ".") == 1 && strings.HasSuffix(last, ".") {
+			last = strings.TrimSuffix(last, ".")
+		}
+		if last != "" {
+			words[n-1] = last
+			break
+		}
+		words = words[:n-1]
+	}
+	return strings.Join(words, " ")
+}
+
+// foldText returns lowercase text in Unicode NFC form, so differently composed
+// equal letters match. Diacritical marks are removed if FoldDiacritics is set,
+// except "й" which is a separate letter, not "и" with a mark.
+func (c *Cfg) foldText(text string) string {
+	text = norm.NFC.String(strings.ToLower(text))
+	if !c.FoldDiacritics {
+		return text
+	}
+	var b strings.Builder
+	for _, r := range text {
+		if r == 'й' {
+			b.WriteRune(r)
+			continue
+		}
+		for _, d := range norm.NFD.String(string(r)) {
+			if !unicode.Is(unicode.Mn, d) {
+				b.WriteRune(d)
+			}
+		}
+	}
+	return norm.NFC.String(b.String())
+}
+
+// aliasBounds returns not capturing patterns of alias word boundaries.
+// RE2 \b handles ASCII only, and there are no boundaries near symbols like "$",
+// so an edge of alias is anchored only if it is a letter or digit.
+func (c *Cfg) aliasBounds(name string) (string, string) {
+	var start, end string
+	if r, _ := utf8.DecodeRuneInString(name); isWordRune(r) {
+		start = `(?:^|[^\pL\pN_])`
+	}
+	if r, _ := utf8.DecodeLastRuneInString(name); !c.PrefixAliases && isWordRune(r) {
+		end = `(?:$|[^\pL\pN_])`
+	}
+	return start, end
+}
+
+// GetCodes returns available currencies codes.
+// The catalog is cached and requested again when it is older than the codes max age,
+// the expired catalog is used if the request fails.
+func (c *Cfg) GetCodes() ([]CodeItem, error) {
+	c.catalogMu.RLock()
+	items, fetched := c.catalog, c.catalogAt
+	c.catalogMu.RUnlock()
+	if items != nil && c.Now().Sub(fetched) < c.codesMaxAge {
+		return items, nil
+	}
+	newItems, err := c.requestCodes()
+	if err != nil {
+		if items != nil {
+			c.logger.Printf("use expired codes catalog: %v", err)
+			return items, nil
+		}
+		return nil, err
+	}
+	index := codesIndex(newItems)
+	c.catalogMu.Lock()
+	c.catalog, c.catalogAt, c.catalogIdx = newItems, c.Now(), index
+	c.catalogMu.Unlock()
+	return newItems, nil
+}
+
+// LookupCode returns currency of the catalog by its char code like "USD",
+// numeric code like "840" or CBR internal ID like "R01235", the key is case-insensitive.
+// The catalog index is rebuilt with the catalog refresh.
+func (c *Cfg) LookupCode(key string) (CodeItem, bool, error) {
+	if _, err := c.GetCodes(); err != nil {
+		return CodeItem{}, false, err
+	}
+	c.catalogMu.RLock()
+	item, ok := c.catalogIdx[indexKey(key)]
+	c.catalogMu.RUnlock()
+	return item, ok, nil
+}
+
+// codesIndex returns catalog items by their lookup keys, the first item wins
+// if keys are not unique.
+func codesIndex(items []CodeItem) map[string]CodeItem {
+	index := make(map[string]CodeItem, len(items)*3)
+	for _, item := range items {
+		for _, key := range []string{item.CharCode, item.NumCode, item.ID} {
+			if key = indexKey(key); key == "" {
+				continue
+			}
+			if _, ok := index[key]; !ok {
+				index[key] = item
+			}
+		}
+	}
+	return index
+}
+
+// indexKey returns a key of codes index, numeric codes are
+// zero-padded to 3 digits, so "36" and "036" are the same key.
+func indexKey(key string) string {
+	key = strings.ToLower(strings.TrimSpace(key))
+	if n, err := strconv.ParseUint(key, 10, 16); err == nil {
+		return fmt.Sprintf("%03d", n)
+	}
+	return key
+}
+
+// SearchCodes returns available currencies codes which char code
+// or name contains search substring (case-insensitive).
+func (c *Cfg) SearchCodes(search string) ([]CodeItem, error) {
+	items, err := c.GetCodes()
+	if err != nil {
+		return nil, err
+	}
+	search = strings.ToLower(strings.TrimSpace(search))
+	if search == "" {
+		return items, nil
+	}
+	result := []CodeItem{}
+	for _, item := range items {
+		for _, value := range []string{item.CharCode, item.Name, item.EngName} {
+			if strings.Contains(strings.ToLower(value), search) {
+				result = append(result, item)
+				break
+			}
+		}
+	}
+	return result, nil
+}
+
+// newRequest returns upstream GET request with User-Agent and configured headers.
+func (c *Cfg) newRequest(reqURL string) (*http.Request, error) {
+	req, err := http.NewRequest("GET", reqURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range c.Headers {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("User-Agent", c.userAgent)
+	return req, nil
+}
+
+// requestCodes requests available currencies codes.
+func (c *Cfg) requestCodes() ([]CodeItem, error) {
+	client := c.httpClient
+	c.logger.Printf("start request to %v", c.CodesURL)
+	defer func() {
+		c.logger.Printf("done request to %v", c.CodesURL)
+	}()
+	req, err := c.newRequest(c.CodesURL)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if statusCode := resp.StatusCode; statusCode != http.StatusOK {
+		return nil, fmt.Errorf("not ok response: %v", statusCode)
+	}
+	codes := &ResponseCodes{}
+	err = c.decodeXML(resp.Body, codes, c.CodesURL)
+	if err != nil {
+		return nil, err
+	}
+	return codes.Items, nil
+}
+
+// dayRates gets currencies rates for requested day.
+// Failed request is retried with exponential backoff up to the configured number
+// of times if the retry budget of ctx is not exhausted and the error is temporary,
+// it is a network error or 5xx response. If all attempts fail,
+// expired cached rates are served while they are younger than stale age.
+func (c *Cfg) dayRates(ctx context.Context, date time.Time) (*ResponseRates, *Provenance, error) {
+	var stale *dayEntry
 	dateReq := date.Format("02/01/2006")
 	if v, ok := c.cache.Get(dateReq); ok {
-		return v.(*ResponseRates), nil
+		entry := v.(*dayEntry)
+		if c.maxCacheAge == 0 || c.Now().Sub(entry.fetched) < c.maxCacheAge {
+			return entry.rates, &Provenance{URL: entry.url, Cached: true, Fetched: entry.fetched, clock: c.Clock}, nil
+		}
+		c.logger.Printf("revalidate cached rates for %v", dateReq)
+		stale = entry
 	}
-	client := c.client()
 	values := url.Values{}
 	values.Add("date_req", dateReq)
+	reqURL := fmt.Sprintf("%v?%v", c.ratesURL(date), values.Encode())
+
+	respRates, err := c.hedgedFetchRates(ctx, reqURL)
+	delay := c.retryDelay
+	for attempt := 1; err != nil && attempt <= c.Retries && retryable(err) && takeRetry(ctx); attempt++ {
+		c.logger.Printf("retry %v of request to %v in %v: %v", attempt, reqURL, delay, err)
+		if sleep(ctx, delay) != nil {
+			break
+		}
+		respRates, err = c.hedgedFetchRates(ctx, reqURL)
+		delay *= 2
+	}
+	if err != nil {
+		if stale != nil && c.Now().Sub(stale.fetched) < c.staleAge {
+			c.logger.Printf("serve stale rates for %v: %v", dateReq, err)
+			p := &Provenance{URL: stale.url, Cached: true, Stale: true, Fetched: stale.fetched, clock: c.Clock}
+			return stale.rates, p, nil
+		}
+		return nil, nil, err
+	}
+	if currencyInfo, err := currencyMap(respRates.Items, nil); err == nil {
+		c.warnBounds(currencyInfo)
+	}
+	fetched := c.Now()
+	c.cacheRates(dateReq, &dayEntry{rates: respRates, url: reqURL, fetched: fetched})
+	return respRates, &Provenance{URL: reqURL, Fetched: fetched, clock: c.Clock}, nil
+}
+
+// cacheRates adds daily rates entry to the cache and evicts the oldest entries
+// while the cache memory size exceeds the configured budget, the new entry is kept.
+func (c *Cfg) cacheRates(key string, entry *dayEntry) {
+	entry.size = entry.memSize()
+	c.cacheMu.Lock()
+	defer c.cacheMu.Unlock()
+	// replaced value is not reported to eviction callback
+	c.cache.Remove(key)
+	c.cache.Add(key, entry)
+	c.cacheBytes += entry.size
+	for c.CacheMemory > 0 && c.cacheBytes > c.CacheMemory && c.cache.Len() > 1 {
+		if k, _, ok := c.cache.RemoveOldest(); ok {
+			c.logger.Printf("evict cached rates for %v, memory budget is exceeded", k)
+		}
+	}
+}
+
+// evictRates is a callback of daily rates cache eviction,
+// the cache is changed only by cacheRates, so cacheMu is locked.
+func (c *Cfg) evictRates(key, value interface{}) {
+	c.cacheBytes -= value.(*dayEntry).size
+}
+
+// ratesURL returns daily rates URL of the date,
+// it is the archive one for past dates if it is configured.
+func (c *Cfg) ratesURL(date time.Time) string {
+	if c.ArchiveURL != "" && date.Before(c.Today()) {
+		return c.ArchiveURL
+	}
+	return c.RatesURL
+}
 
-	reqURL := fmt.Sprintf("%v?%v", currenciesRatesURL, values.Encode())
+// decodeXML decodes XML response body of source URL to v.
+// In debug mode the body beginning is logged on decode error.
+func (c *Cfg) decodeXML(body io.Reader, v interface{}, source string) error {
+	var capture *bodyCapture
+	if c.Debug && c.LogBodySize > 0 {
+		capture = &bodyCapture{max: c.LogBodySize}
+		body = io.TeeReader(body, capture)
+	}
+	decoder := xml.NewDecoder(body)
+	decoder.CharsetReader = charset.NewReaderLabel
+	err := decoder.Decode(v)
+	if err != nil && capture != nil {
+		c.logger.Printf("decode response of %v: %v, body: %q", source, err, capture.buf.String())
+	}
+	return err
+}
+
+// bodyCapture keeps the first max bytes written to it.
+type bodyCapture struct {
+	buf bytes.Buffer
+	max int
+}
+
+// Write captures p while the buffer is not full, it never fails.
+func (b *bodyCapture) Write(p []byte) (int, error) {
+	if n := b.max - b.buf.Len(); n > 0 {
+		if n > len(p) {
+			n = len(p)
+		}
+		b.buf.Write(p[:n])
+	}
+	return len(p), nil
+}
+
+// hedgedFetchRates requests rates like fetchRates, but issues a second hedged request
+// if the first one hasn't responded during the hedge delay. The first successful
+// result is used and the other request is cancelled. Hedged requests share
+// the upstream concurrency limit, so they can't exceed it.
+func (c *Cfg) hedgedFetchRates(ctx context.Context, reqURL string) (*ResponseRates, error) {
+	if c.hedgeDelay <= 0 {
+		return c.fetchRates(ctx, reqURL)
+	}
+	type result struct {
+		rates *ResponseRates
+		err   error
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan result, 2)
+	fetch := func() {
+		respRates, err := c.fetchRates(ctx, reqURL)
+		results <- result{rates: respRates, err: err}
+	}
+	go fetch()
+	timer := time.NewTimer(c.hedgeDelay)
+	defer timer.Stop()
+	var firstErr error
+	for pending := 1; ; {
+		select {
+		case <-timer.C:
+			c.logger.Printf("hedged request to %v", reqURL)
+			pending++
+			go fetch()
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				return r.rates, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if pending == 0 {
+				return nil, firstErr
+			}
+		}
+	}
+}
+
+// fetchRates does one request of daily rates.
+// The request is limited by ctx and the configured timeout.
+func (c *Cfg) fetchRates(ctx context.Context, reqURL string) (*ResponseRates, error) {
+	var resp *http.Response
+	client := c.httpClient
 	c.logger.Printf("start request to %v", reqURL)
 	defer func() {
 		c.logger.Printf("done request to %v", reqURL)
 	}()
-	req, err := http.NewRequest("GET", reqURL, nil)
+	req, err := c.newRequest(reqURL)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Add("User-Agent", c.userAgent)
 
-	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	select {
+	case c.upstream <- struct{}{}:
+		defer func() { <-c.upstream }()
+	case <-ctx.Done():
+		return nil, fmt.Errorf("wait upstream: %v", ctx.Err())
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
 	defer cancel()
 	req = req.WithContext(ctx)
 
@@ -269,107 +1779,1532 @@ func (c *Cfg) dayRates(date time.Time) (*ResponseRates, error) {
 	select {
 	case <-ctx.Done():
 		<-ec // wait error "context deadline exceeded"
-		return nil, fmt.Errorf("timed out (%v)", c.timeout)
+		return nil, fmt.Errorf("timed out: %v", ctx.Err())
 	case err := <-ec:
 		if err != nil {
 			return nil, err
 		}
 	}
-	defer resp.Body.Close()
-	if statusCode := resp.StatusCode; statusCode != http.StatusOK {
-		return nil, fmt.Errorf("not ok response: %v", statusCode)
+	defer resp.Body.Close()
+	if statusCode := resp.StatusCode; statusCode != http.StatusOK {
+		return nil, statusError(statusCode)
+	}
+	respRates := &ResponseRates{}
+	err = c.decodeXML(resp.Body, respRates, reqURL)
+	if err != nil {
+		return nil, &decodeError{err}
+	}
+	return respRates, nil
+}
+
+// withRetryBudget returns ctx with the configured budget of upstream retries
+// shared by all requests of ctx. It is not changed if ctx already has a budget.
+func (c *Cfg) withRetryBudget(ctx context.Context) context.Context {
+	if c.RetryBudget == 0 || ctx.Value(retryBudgetKey{}) != nil {
+		return ctx
+	}
+	budget := int32(c.RetryBudget)
+	return context.WithValue(ctx, retryBudgetKey{}, &budget)
+}
+
+// reqRates prepares requested info.
+// If raw is true, not rounded values are added too. Values are rounded by the rounding mode.
+func (c *Cfg) reqRates(date time.Time, messages []parsedMsg, info map[string]float64, raw bool, places int, rounding RoundingMode) ([]RateItem, error) {
+	result := make([]RateItem, len(messages))
+	for i, m := range messages {
+		rate, ok := info[m.currency]
+		if !ok {
+			return nil, fmt.Errorf("unknown currency %v", m.currency)
+		}
+		// rub value
+		value := rate * m.value
+		if overflowed(value) {
+			if c.AmountOverflow != OverflowClamp {
+				return nil, overflowError(m.msg)
+			}
+			value = math.MaxFloat64
+			if overflowed(m.value) {
+				m.value = math.MaxFloat64
+			}
+		}
+		result[i] = RateItem{Msg: m.msg, Rate: map[string]float64{}, fixed: c.StringValues, places: places}
+		if raw {
+			result[i].Raw = map[string]float64{}
+		}
+		targets := make([]string, 0, len(c.codes))
+		if m.target != "" {
+			if _, ok := info[m.target]; !ok {
+				return nil, fmt.Errorf("unknown currency %v", m.target)
+			}
+			targets = append(targets, m.target)
+		} else {
+			for currency := range c.codes {
+				targets = append(targets, currency)
+			}
+		}
+		// other values
+		for _, currency := range targets {
+			c.logger.Printf("value=%v, rate[%v]=%v", value, currency, info[currency])
+			if currency == m.currency {
+				// self-conversion is the requested amount without rounding drift
+				result[i].Rate[currency] = m.value
+				if raw {
+					result[i].Raw[currency] = m.value
+				}
+				continue
+			}
+			v := value / info[currency]
+			result[i].Rate[currency] = rounding.Round(v, float64(places))
+			// absent target rate is not an amount problem
+			if info[currency] > 0 && (overflowed(v) || overflowed(result[i].Rate[currency])) {
+				if c.AmountOverflow != OverflowClamp {
+					return nil, overflowError(m.msg)
+				}
+				v, result[i].Rate[currency] = math.MaxFloat64, math.MaxFloat64
+			}
+			if raw {
+				result[i].Raw[currency] = v
+			}
+		}
+	}
+	return result, nil
+}
+
+// overflowed returns true if value is not finite, JSON can't represent it.
+func overflowed(value float64) bool {
+	return math.IsInf(value, 0) || math.IsNaN(value)
+}
+
+// overflowError returns an error of too large amount of the message.
+func overflowError(msg string) *RateError {
+	return &RateError{HTTPCode: http.StatusBadRequest, Msg: fmt.Sprintf("amount of %q is too large", msg)}
+}
+
+// reqInverse adds values of one target currency unit in units of requested currency
+// rounded to 6 decimal places. Currencies without valid rates are skipped.
+func (c *Cfg) reqInverse(items []RateItem, messages []parsedMsg, info map[string]float64) {
+	for i, m := range messages {
+		rate := info[m.currency]
+		if rate <= 0 || math.IsInf(rate, 0) {
+			continue
+		}
+		items[i].Inverse = make(map[string]float64, len(items[i].Rate))
+		for currency := range items[i].Rate {
+			target := info[currency]
+			if target <= 0 || math.IsInf(target, 0) {
+				continue
+			}
+			items[i].Inverse[currency] = c.Rounding.Round(target/rate, 6)
+		}
+	}
+}
+
+// reqRatios adds exact cross-rates to prepared rate items.
+func (c *Cfg) reqRatios(items []RateItem, messages []parsedMsg, exact map[string]*big.Rat) {
+	for i, m := range messages {
+		rate, ok := exact[m.currency]
+		if !ok {
+			continue
+		}
+		items[i].Ratio = make(map[string]*Ratio, len(items[i].Rate))
+		for currency := range items[i].Rate {
+			target, ok := exact[currency]
+			if !ok || target.Sign() == 0 {
+				continue
+			}
+			ratio := new(big.Rat).Quo(rate, target)
+			items[i].Ratio[currency] = &Ratio{Numerator: ratio.Num(), Denominator: ratio.Denom()}
+		}
+	}
+}
+
+// GetRates returns currencies rates info.
+func (c *Cfg) GetRates(date time.Time, msg string) (*Info, error) {
+	return c.GetRatesWith(date, msg, Options{})
+}
+
+// GetRatesWith returns currencies rates info using request options.
+func (c *Cfg) GetRatesWith(date time.Time, msg string, opts Options) (*Info, error) {
+	return c.getRates(context.Background(), date, msg, opts)
+}
+
+// getRates returns currencies rates info, upstream requests are limited by ctx.
+// A result of identical query for the same date and options is reused
+// during the deduplication window, so the query is parsed and converted once.
+func (c *Cfg) getRates(ctx context.Context, date time.Time, msg string, opts Options) (*Info, error) {
+	if c.dedupWindow <= 0 || c.results == nil {
+		return c.computeRates(ctx, date, msg, opts)
+	}
+	key := resultKey(date, msg, opts)
+	if v, ok := c.results.Get(key); ok {
+		entry := v.(*resultEntry)
+		if c.Now().Sub(entry.created) < c.dedupWindow {
+			c.logger.Printf("reuse result date=%v, msg=\"%v\"", date.Format("2006-01-02"), msg)
+			info := entry.info.clone()
+			// reused result doesn't request rates, so they are cached
+			if info.Provenance != nil {
+				info.Provenance.Cached = true
+			}
+			if info.Cached != nil {
+				cached := true
+				info.Cached = &cached
+			}
+			return info, nil
+		}
+	}
+	info, err := c.computeRates(ctx, date, msg, opts)
+	if err != nil {
+		return nil, err
+	}
+	c.results.Add(key, &resultEntry{info: info.clone(), created: c.Now()})
+	return info, nil
+}
+
+// clone returns a deep copy of info, so they can be changed independently.
+func (info *Info) clone() *Info {
+	result := *info
+	if info.Rates != nil {
+		result.Rates = make([]RateItem, len(info.Rates))
+		for i, item := range info.Rates {
+			item.Rate = cloneValues(item.Rate)
+			item.Raw = cloneValues(item.Raw)
+			item.Inverse = cloneValues(item.Inverse)
+			if item.Values != nil {
+				item.Values = append([]CodeValue{}, item.Values...)
+			}
+			if item.Ratio != nil {
+				ratio := make(map[string]*Ratio, len(item.Ratio))
+				for code, r := range item.Ratio {
+					if r != nil {
+						r = &Ratio{Numerator: new(big.Int).Set(r.Numerator), Denominator: new(big.Int).Set(r.Denominator)}
+					}
+					ratio[code] = r
+				}
+				item.Ratio = ratio
+			}
+			result.Rates[i] = item
+		}
+	}
+	if info.Trend != nil {
+		result.Trend = make(map[string]string, len(info.Trend))
+		for code, trend := range info.Trend {
+			result.Trend[code] = trend
+		}
+	}
+	result.Basket = cloneValues(info.Basket)
+	if info.Suggestions != nil {
+		result.Suggestions = append([]Suggestion{}, info.Suggestions...)
+	}
+	if info.Precision != nil {
+		result.Precision = make(map[string]int, len(info.Precision))
+		for code, places := range info.Precision {
+			result.Precision[code] = places
+		}
+	}
+	if info.Cached != nil {
+		cached := *info.Cached
+		result.Cached = &cached
+	}
+	if info.Source != nil {
+		source := *info.Source
+		result.Source = &source
+	}
+	if info.Currencies != nil {
+		result.Currencies = make(map[string]CodeItem, len(info.Currencies))
+		for code, item := range info.Currencies {
+			result.Currencies[code] = item
+		}
+	}
+	if info.Provenance != nil {
+		provenance := *info.Provenance
+		result.Provenance = &provenance
+	}
+	if info.order != nil {
+		result.order = append([]string{}, info.order...)
+	}
+	return &result
+}
+
+// cloneValues returns a copy of currencies values, it is nil for nil values.
+func cloneValues(values map[string]float64) map[string]float64 {
+	if values == nil {
+		return nil
+	}
+	result := make(map[string]float64, len(values))
+	for code, v := range values {
+		result[code] = v
+	}
+	return result
+}
+
+// resultKey returns a key of rates result of the query, messages are compared
+// case-insensitive with collapsed spaces, options timeout doesn't change a result.
+func resultKey(date time.Time, msg string, opts Options) string {
+	opts.Timeout = 0
+	// daily rates don't depend on time of the day
+	opts.Time = 0
+	msg = strings.ToLower(strings.Join(strings.Fields(msg), " "))
+	// quoted messages keep their boundaries, so different batches have different keys
+	messages := fmt.Sprintf("%q", opts.Messages)
+	opts.Messages = nil
+	return fmt.Sprintf("%v|%v|%v|%+v", date.Format("2006-01-02"), msg, messages, opts)
+}
+
+// computeRates returns currencies rates info, upstream requests are limited by ctx.
+func (c *Cfg) computeRates(ctx context.Context, date time.Time, msg string, opts Options) (*Info, error) {
+	if c.codes == nil {
+		return nil, &RateError{HTTPCode: http.StatusInternalServerError, Msg: "uninitialized required codes"}
+	}
+	strDate := date.Format("2006-01-02")
+	c.logger.Printf("start date=%v, msg=\"%v\"", strDate, msg)
+
+	messages := opts.Messages
+	if messages == nil {
+		messages = c.Locale.Split(msg)
+	}
+	lowered := make([]string, len(messages))
+	for i, m := range messages {
+		lowered[i] = strings.ToLower(m)
+	}
+	parsedMessages := c.parseMsg(lowered)
+	if c.MergeDuplicates {
+		parsedMessages = mergeDuplicates(parsedMessages)
+	}
+	if !recognized(parsedMessages) {
+		suggestions := c.suggest(parsedMessages)
+		if c.StrictEmpty {
+			return nil, &RateError{HTTPCode: http.StatusUnprocessableEntity, Msg: emptyResultMsg + suggestionsText(suggestions)}
+		}
+		return &Info{Date: strDate, Rates: []RateItem{}, Notice: emptyResultMsg, Suggestions: suggestions}, nil
+	}
+	for _, m := range parsedMessages {
+		if m.currency == "" {
+			msg := fmt.Sprintf("unknown currency of %q", m.msg) + suggestionsText(c.suggest([]parsedMsg{m}))
+			return nil, &RateError{HTTPCode: http.StatusBadRequest, Msg: msg}
+		}
+		if m.underflow {
+			return nil, &RateError{HTTPCode: http.StatusBadRequest, Msg: fmt.Sprintf("amount of %q is too small", m.msg)}
+		}
+	}
+	ctx = c.withRetryBudget(ctx)
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+	dayInfo, provenance, err := c.dailyRates(ctx, date)
+	if err != nil {
+		return nil, &RateError{HTTPCode: http.StatusServiceUnavailable, Msg: "get daily rates"}
+	}
+	var precision map[string]int
+	if opts.Verbose {
+		precision = make(map[string]int)
+	}
+	currencyInfo, err := currencyMap(dayInfo.Items, precision)
+	if err != nil {
+		c.logger.Printf("currency map prepare: %v", err)
+		return nil, &RateError{HTTPCode: http.StatusInternalServerError, Msg: "internal error"}
+	}
+	if err = c.checkBounds(currencyInfo, c.usedCodes(parsedMessages)...); err != nil {
+		return nil, err
+	}
+
+	places := opts.Places
+	if places <= 0 && !opts.ExactPlaces {
+		places = *c.Precision.JSON
+	}
+	rounding := c.Rounding
+	if opts.CustomRounding {
+		rounding = opts.Rounding
+	}
+	items, err := c.reqRates(date, parsedMessages, currencyInfo, opts.Raw, places, rounding)
+	if err != nil {
+		if _, ok := err.(*RateError); ok {
+			return nil, err
+		}
+		c.logger.Printf("rates result prepare: %v", err)
+		return nil, &RateError{HTTPCode: http.StatusBadRequest, Msg: "prepare rates error"}
+	}
+	if opts.Ordered {
+		order := c.codesOrder()
+		for i := range items {
+			if target := parsedMessages[i].target; target != "" {
+				items[i].Values = []CodeValue{{Code: target, Value: items[i].Rate[target]}}
+				continue
+			}
+			items[i].Values = make([]CodeValue, len(order))
+			for j, code := range order {
+				items[i].Values[j] = CodeValue{Code: code, Value: items[i].Rate[code]}
+			}
+		}
+	}
+	if opts.Ratio {
+		exact, err := ratioMap(dayInfo.Items)
+		if err != nil {
+			c.logger.Printf("ratio map prepare: %v", err)
+			return nil, &RateError{HTTPCode: http.StatusInternalServerError, Msg: "internal error"}
+		}
+		c.reqRatios(items, parsedMessages, exact)
+	}
+	if opts.Verbose {
+		c.reqInverse(items, parsedMessages, currencyInfo)
+	}
+	// rates info is always requested from CBR
+	source := providerSource(&cbr{c: c})
+	info := &Info{Date: strDate, Rates: items, Source: &source, Provenance: provenance, places: places, order: c.Order}
+	if opts.Timestamp {
+		info.Timestamp = time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC).Unix()
+	}
+	if opts.Verbose {
+		info.Precision = make(map[string]int, len(c.codes))
+		for currency := range c.codes {
+			if places, ok := precision[currency]; ok {
+				info.Precision[currency] = places
+			}
+		}
+		// cache status of rates and their date resolved by upstream
+		cached := provenance.Cached
+		info.Cached, info.CacheDate = &cached, strDate
+		if d, err := time.Parse("02.01.2006", dayInfo.Date); err == nil {
+			info.CacheDate = d.Format("2006-01-02")
+		}
+	}
+	if opts.Trend {
+		prevInfo, err := c.previousDay(ctx, dayInfo, date)
+		if err != nil {
+			c.logger.Printf("previous day rates: %v", err)
+			return nil, &RateError{HTTPCode: http.StatusServiceUnavailable, Msg: "get previous day rates"}
+		}
+		prevCurrencyInfo, err := currencyMap(prevInfo.Items, nil)
+		if err != nil {
+			c.logger.Printf("previous currency map prepare: %v", err)
+			return nil, &RateError{HTTPCode: http.StatusInternalServerError, Msg: "internal error"}
+		}
+		info.Trend = make(map[string]string, len(c.codes))
+		for currency := range c.codes {
+			// a currency without rates of one of the days has no trend
+			prev, ok := prevCurrencyInfo[currency]
+			if !ok {
+				continue
+			}
+			if current, ok := currencyInfo[currency]; ok {
+				info.Trend[currency] = trend(prev, current)
+			}
+		}
+	}
+	if len(opts.Basket) > 0 {
+		basketValue, err := opts.Basket.value(currencyInfo)
+		if err != nil {
+			return nil, err
+		}
+		info.Basket = make(map[string]float64, len(c.codes))
+		for currency := range c.codes {
+			info.Basket[currency] = c.Rounding.Round(currencyInfo[currency]/basketValue, 4)
+		}
+	}
+	if opts.Metadata {
+		if err = c.attachMetadata(info); err != nil {
+			return nil, err
+		}
+	}
+	switch {
+	case opts.Numeric:
+		if err = c.numericCodes(info); err != nil {
+			return nil, err
+		}
+	case c.UpperCodes:
+		info.upperCodes()
+	}
+	return info, nil
+}
+
+// previousDay returns rates of the business day before the day of dayInfo.
+// CBR responds by the last known rates, so the day is detected by response date,
+// the requested date is used if the response date is unknown.
+// Weekends and configured holidays are skipped without requests.
+func (c *Cfg) previousDay(ctx context.Context, dayInfo *ResponseRates, date time.Time) (*ResponseRates, error) {
+	if d, err := time.Parse("02.01.2006", dayInfo.Date); err == nil {
+		date = d
+	}
+	prevInfo, _, err := c.dailyRates(ctx, c.businessDay(date.AddDate(0, 0, -1)))
+	return prevInfo, err
+}
+
+// provider returns active rates provider, it is a chain if fallbacks are configured.
+func (c *Cfg) provider() Provider {
+	providers := c.providers()
+	if len(providers) == 1 {
+		return providers[0]
+	}
+	return &chain{c: c, base: "rub", providers: providers}
+}
+
+// dailyRates returns daily rates of the first succeeded provider of the chain.
+// CBR rates are used as is with their cache, tables of other providers
+// are converted to CBR response with one unit nominals.
+func (c *Cfg) dailyRates(ctx context.Context, date time.Time) (*ResponseRates, *Provenance, error) {
+	var err error
+	for _, provider := range c.providers() {
+		var (
+			dayInfo    *ResponseRates
+			provenance *Provenance
+		)
+		if _, ok := provider.(*cbr); ok {
+			dayInfo, provenance, err = c.dayRates(ctx, date)
+		} else {
+			dayInfo, provenance, err = c.providerRates(ctx, provider, date)
+		}
+		if err == nil {
+			return dayInfo, provenance, nil
+		}
+		c.logger.Printf("provider %v failed: %v", provider.Name(), err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, nil, err
+}
+
+// providerRates returns rates table of the provider for the date as CBR response.
+func (c *Cfg) providerRates(ctx context.Context, provider Provider, date time.Time) (*ResponseRates, *Provenance, error) {
+	table, err := provider.Rates(ctx, date)
+	if err != nil {
+		return nil, nil, err
+	}
+	if table, err = table.Rebase("rub"); err != nil {
+		return nil, nil, err
+	}
+	// tables of other providers are not cached, so they are fetched by every call
+	c.warnBounds(table.Rates)
+	codes := make([]string, 0, len(table.Rates))
+	for code := range table.Rates {
+		if code != "rub" {
+			codes = append(codes, code)
+		}
+	}
+	sort.Strings(codes)
+	dayInfo := &ResponseRates{Items: make([]CurrencyItem, len(codes))}
+	if d, err := time.Parse("2006-01-02", table.Date); err == nil {
+		dayInfo.Date = d.Format("02.01.2006")
+	}
+	for i, code := range codes {
+		value := strconv.FormatFloat(table.Rates[code], 'f', -1, 64)
+		dayInfo.Items[i] = CurrencyItem{
+			CharCode: strings.ToUpper(code),
+			Nominal:  1,
+			Value:    strings.Replace(value, ".", ",", 1),
+		}
+	}
+	c.logger.Printf("rates for %v are served by provider %v", date.Format("2006-01-02"), provider.Name())
+	return dayInfo, &Provenance{URL: providerSource(provider).URL, Fetched: table.Fetched, clock: c.Clock}, nil
+}
+
+// providers returns all configured rates providers, the primary one is first.
+func (c *Cfg) providers() []Provider {
+	var primary Provider = &cbr{c: c}
+	if c.Provider != nil {
+		primary = c.Provider
+	}
+	return append([]Provider{primary}, c.Fallbacks...)
+}
+
+// CompareProviders returns rates of one code unit in units of base currency
+// from all configured providers for the date, values are rounded to 6 decimal places.
+// A failed provider doesn't fail the comparison unless all of them fail.
+func (c *Cfg) CompareProviders(ctx context.Context, date time.Time, code, base string) (*Comparison, error) {
+	code, base = strings.ToLower(code), strings.ToLower(base)
+	providers := c.providers()
+	result := &Comparison{
+		Date:  date.Format("2006-01-02"),
+		Code:  code,
+		Base:  base,
+		Rates: make([]ProviderRate, len(providers)),
+	}
+	errs := make([]error, len(providers))
+	var wg sync.WaitGroup
+	for i, provider := range providers {
+		wg.Add(1)
+		go func(i int, provider Provider) {
+			defer wg.Done()
+			item := ProviderRate{Provider: provider.Name(), Source: providerSource(provider)}
+			table, err := provider.Rates(ctx, date)
+			if err == nil {
+				item.Rate, err = table.Cross(code, base)
+			}
+			if err != nil {
+				c.logger.Printf("compare provider %v: %v", provider.Name(), err)
+				if _, ok := err.(*RateError); !ok {
+					err = &RateError{HTTPCode: http.StatusServiceUnavailable, Msg: "get daily rates"}
+				}
+				item.Error, errs[i] = err.Error(), err
+			} else {
+				item.Rate = c.Rounding.Round(item.Rate, 6)
+			}
+			result.Rates[i] = item
+		}(i, provider)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err == nil {
+			return result, nil
+		}
+	}
+	return nil, errs[0]
+}
+
+// Source returns attribution of active rates provider of conversions.
+func (c *Cfg) Source() Source {
+	return providerSource(c.provider())
+}
+
+// Convert returns amount of currency "from" converted to currency "to".
+func (c *Cfg) Convert(date time.Time, from, to string, amount float64) (float64, error) {
+	receipt, err := c.ConvertReceipt(date, from, to, amount)
+	if err != nil {
+		return 0, err
+	}
+	return receipt.Result, nil
+}
+
+// ConvertReceipt converts amount of currency "from" to currency "to" like Convert
+// and returns a receipt of the conversion with not rounded used rate.
+// Receipt date is a date of used rates, it is requested date if the provider doesn't know it.
+func (c *Cfg) ConvertReceipt(date time.Time, from, to string, amount float64) (*Receipt, error) {
+	return c.convertReceipt(date, from, to, amount, 0)
+}
+
+// BuyReceipt returns a receipt of buying currency "to" for rub amount like ConvertReceipt,
+// but the currency markup is applied to the exact rate before rounding.
+func (c *Cfg) BuyReceipt(date time.Time, rub float64, to string) (*Receipt, error) {
+	return c.convertReceipt(date, "rub", to, rub, c.MarkupOf(to))
+}
+
+// convertReceipt returns a receipt of the conversion with markup percentage applied to the rate.
+func (c *Cfg) convertReceipt(date time.Time, from, to string, amount, markup float64) (*Receipt, error) {
+	c.logger.Printf("convert date=%v, %v %v to %v", date.Format("2006-01-02"), amount, from, to)
+	table, err := c.rateTable(context.Background(), date, from, to)
+	if err != nil {
+		return nil, err
+	}
+	rate, err := table.Cross(from, to)
+	if err != nil {
+		c.logger.Printf("cross rate %v/%v: %v", from, to, err)
+		return nil, err
+	}
+	receipt := &Receipt{
+		Amount:    amount,
+		From:      strings.ToLower(from),
+		To:        strings.ToLower(to),
+		Result:    amount,
+		Date:      table.Date,
+		FetchedAt: table.Fetched,
+	}
+	if receipt.Date == "" {
+		receipt.Date = date.Format("2006-01-02")
+	}
+	if receipt.FetchedAt.IsZero() {
+		receipt.FetchedAt = c.Now()
+	}
+	if receipt.From != receipt.To {
+		// JSON can't represent overflowed result of too large amount
+		if overflowed(amount * rate) {
+			return nil, overflowError(fmt.Sprintf("%v %v", amount, receipt.From))
+		}
+		receipt.Result = c.Rounding.Round(amount*rate, 2)
+	}
+	if markup > 0 {
+		receipt.Markup, receipt.Unmarked = markup, receipt.Result
+		rate /= 1 + markup/100
+		receipt.Result = c.Rounding.Round(amount*rate, 2)
+	}
+	receipt.Rate = rate
+	return receipt, nil
+}
+
+// CrossRate returns not rounded value of one unit of currency "from" in units of currency "to".
+func (c *Cfg) CrossRate(date time.Time, from, to string) (float64, error) {
+	table, err := c.rateTable(context.Background(), date, from, to)
+	if err != nil {
+		return 0, err
+	}
+	rate, err := table.Cross(from, to)
+	if err != nil {
+		c.logger.Printf("cross rate %v/%v: %v", from, to, err)
+		return 0, err
+	}
+	return rate, nil
+}
+
+// rateTable returns rates table of the date from the configured provider,
+// provider errors which are not RateError are reported as unavailable daily rates.
+// RUB rates of used codes are checked by their expected ranges.
+func (c *Cfg) rateTable(ctx context.Context, date time.Time, codes ...string) (*RateTable, error) {
+	table, err := c.provider().Rates(ctx, date)
+	if err != nil {
+		if _, ok := err.(*RateError); ok {
+			return nil, err
+		}
+		c.logger.Printf("get daily rates: %v", err)
+		return nil, &RateError{HTTPCode: http.StatusServiceUnavailable, Msg: "get daily rates"}
+	}
+	if c.RejectOutOfBounds {
+		// a table without RUB rate can't be checked
+		if rubTable, err := table.Rebase("rub"); err == nil {
+			if err = c.checkBounds(rubTable.Rates, codes...); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return table, nil
+}
+
+// Buy returns how many units of currency "to" can be bought for rub amount.
+func (c *Cfg) Buy(date time.Time, rub float64, to string) (float64, error) {
+	return c.Convert(date, "rub", to, rub)
+}
+
+// MarkupOf returns buying markup percentage of the currency.
+func (c *Cfg) MarkupOf(code string) float64 {
+	if m, ok := c.Markups[strings.ToLower(code)]; ok {
+		return m
+	}
+	return c.Markup
+}
+
+// CrossRates returns cross-rates matrix of required currencies for the date,
+// values are rounded to 6 decimal places.
+func (c *Cfg) CrossRates(date time.Time) (*Matrix, error) {
+	if c.codes == nil {
+		return nil, &RateError{HTTPCode: http.StatusInternalServerError, Msg: "uninitialized required codes"}
+	}
+	if n := len(c.codes); n > maxMatrixSize {
+		return nil, &RateError{HTTPCode: http.StatusInternalServerError, Msg: fmt.Sprintf("too many currencies for matrix, max %v", maxMatrixSize)}
+	}
+	dayInfo, _, err := c.dailyRates(c.withRetryBudget(context.Background()), date)
+	if err != nil {
+		c.logger.Printf("cross rates: %v", err)
+		return nil, &RateError{HTTPCode: http.StatusServiceUnavailable, Msg: "get daily rates"}
+	}
+	currencyInfo, err := currencyMap(dayInfo.Items, nil)
+	if err != nil {
+		c.logger.Printf("currency map prepare: %v", err)
+		return nil, &RateError{HTTPCode: http.StatusInternalServerError, Msg: "internal error"}
+	}
+	codes := c.codesOrder()
+	matrix := &Matrix{Date: date.Format("2006-01-02"), Codes: codes, Rates: make(map[string]map[string]float64, len(codes))}
+	for _, from := range codes {
+		matrix.Rates[from] = make(map[string]float64, len(codes))
+		for _, to := range codes {
+			fromRate, fromOk := currencyInfo[from]
+			toRate, toOk := currencyInfo[to]
+			if !fromOk || !toOk || toRate <= 0 {
+				return nil, &RateError{HTTPCode: http.StatusInternalServerError, Msg: fmt.Sprintf("no valid rate of %v/%v", from, to)}
+			}
+			matrix.Rates[from][to] = c.Rounding.Round(fromRate/toRate, 6)
+		}
+	}
+	return matrix, nil
+}
+
+// ChangedRates returns required currencies which RUB rates of the date differ
+// from ones of the base date more than the threshold, values are rounded to 4 decimal places.
+func (c *Cfg) ChangedRates(ctx context.Context, date, base time.Time, threshold float64) (*Changes, error) {
+	if c.codes == nil {
+		return nil, &RateError{HTTPCode: http.StatusInternalServerError, Msg: "uninitialized required codes"}
+	}
+	if threshold < 0 {
+		return nil, &RateError{HTTPCode: http.StatusBadRequest, Msg: "negative threshold"}
+	}
+	ctx = c.withRetryBudget(ctx)
+	dates := []time.Time{date, base}
+	infos := make([]map[string]float64, len(dates))
+	err := c.forEachDay(ctx, len(dates), func(ctx context.Context, i int) error {
+		dayInfo, _, err := c.dailyRates(ctx, dates[i])
+		if err != nil {
+			c.logger.Printf("changes date %v: %v", dates[i], err)
+			return &RateError{HTTPCode: http.StatusServiceUnavailable, Msg: "get daily rates"}
+		}
+		infos[i], err = currencyMap(dayInfo.Items, nil)
+		if err != nil {
+			c.logger.Printf("currency map prepare: %v", err)
+			return &RateError{HTTPCode: http.StatusInternalServerError, Msg: "internal error"}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	changes := &Changes{
+		Date:      date.Format("2006-01-02"),
+		Base:      base.Format("2006-01-02"),
+		Threshold: threshold,
+		Items:     []Change{},
+	}
+	for _, code := range c.codesOrder() {
+		rate, ok := infos[0][code]
+		baseRate, baseOk := infos[1][code]
+		if !ok || !baseOk {
+			continue
+		}
+		if delta := rate - baseRate; math.Abs(delta) > threshold {
+			changes.Items = append(changes.Items, Change{
+				Code:  code,
+				Rate:  c.Rounding.Round(rate, 4),
+				Base:  c.Rounding.Round(baseRate, 4),
+				Delta: c.Rounding.Round(delta, 4),
+			})
+		}
+	}
+	return changes, nil
+}
+
+// GetRatesRange returns currencies rates info for every date in the range.
+// Dates are requested concurrently by the configured number of workers,
+// the whole range request is limited by ctx.
+func (c *Cfg) GetRatesRange(ctx context.Context, from, to time.Time, msg string, opts Options) ([]*Info, error) {
+	var result []*Info
+	err := c.StreamRatesRange(ctx, from, to, msg, opts, func(info *Info) error {
+		result = append(result, info)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// StreamRatesRange calls f for currencies rates info of every date in the range
+// in dates order as soon as the info is ready. Dates are requested concurrently
+// by the configured number of workers, the whole range request is limited by ctx.
+// It stops on the first error of rates getting or f and returns it.
+func (c *Cfg) StreamRatesRange(ctx context.Context, from, to time.Time, msg string, opts Options, f func(*Info) error) error {
+	days, err := rangeDays(from, to)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(c.withRetryBudget(ctx))
+	defer cancel()
+	result := make([]*Info, days)
+	ready := make([]chan struct{}, days)
+	for i := range ready {
+		ready[i] = make(chan struct{})
+	}
+	emit := func(date time.Time, info *Info) error {
+		return f(info)
+	}
+	var p *interpolation
+	if opts.Interpolate {
+		p = &interpolation{c: c, f: f}
+		emit = p.add
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- c.forEachDay(ctx, days, func(ctx context.Context, i int) error {
+			defer close(ready[i])
+			info, err := c.getRates(ctx, from.AddDate(0, 0, i), msg, opts)
+			result[i] = info
+			return err
+		})
+	}()
+	for i := range ready {
+		select {
+		case <-ready[i]:
+		case err := <-errc:
+			if err != nil {
+				return err
+			}
+			// all dates are done
+			errc = nil
+			<-ready[i]
+		}
+		if result[i] == nil {
+			return <-errc
+		}
+		if err := emit(from.AddDate(0, 0, i), result[i]); err != nil {
+			return err
+		}
+	}
+	if p != nil {
+		return p.flush()
+	}
+	return nil
+}
+
+// interpolation buffers rates info of non-business days until the next
+// business day to pass them to f with interpolated values.
+type interpolation struct {
+	c       *Cfg
+	f       func(*Info) error
+	prev    *Info
+	pending []*Info
+}
+
+// add passes info of the date to f, info of a non-business day is delayed.
+func (p *interpolation) add(date time.Time, info *Info) error {
+	if !p.c.businessDay(date).Equal(date) {
+		p.pending = append(p.pending, info)
+		return nil
+	}
+	n := float64(len(p.pending) + 1)
+	for i, item := range p.pending {
+		if p.prev != nil {
+			item = p.c.interpolate(item, p.prev, info, float64(i+1)/n)
+		}
+		if err := p.f(item); err != nil {
+			return err
+		}
+	}
+	p.pending = p.pending[:0]
+	p.prev = info
+	return p.f(info)
+}
+
+// flush passes delayed info to f as is, there is no next business day for them.
+func (p *interpolation) flush() error {
+	for _, item := range p.pending {
+		if err := p.f(item); err != nil {
+			return err
+		}
+	}
+	p.pending = nil
+	return nil
+}
+
+// interpolate returns a copy of info with values linearly interpolated between
+// prev and next ones by weight k in (0, 1). Exact ratios are removed as they
+// can't be interpolated. Info is returned as is if items don't match.
+func (c *Cfg) interpolate(info, prev, next *Info, k float64) *Info {
+	n := len(info.Rates)
+	if len(prev.Rates) != n || len(next.Rates) != n {
+		return info
+	}
+	result := *info
+	result.Rates = make([]RateItem, n)
+	result.Interpolated = true
+	line := func(a, b map[string]float64, places int) map[string]float64 {
+		if a == nil || b == nil {
+			return nil
+		}
+		values := make(map[string]float64, len(a))
+		for code, v := range a {
+			if w, ok := b[code]; ok {
+				values[code] = v + (w-v)*k
+				if places >= 0 {
+					values[code] = c.Rounding.Round(values[code], float64(places))
+				}
+			}
+		}
+		return values
+	}
+	for i, item := range info.Rates {
+		a, b := prev.Rates[i], next.Rates[i]
+		item.Rate = line(a.Rate, b.Rate, info.places)
+		item.Raw = line(a.Raw, b.Raw, -1)
+		item.Inverse = line(a.Inverse, b.Inverse, 6)
+		item.Ratio = nil
+		if item.Values != nil {
+			values := make([]CodeValue, len(item.Values))
+			for j, v := range item.Values {
+				values[j] = CodeValue{Code: v.Code, Value: item.Rate[v.Code]}
+			}
+			item.Values = values
+		}
+		result.Rates[i] = item
+	}
+	return &result
+}
+
+// Calendar returns rates data availability for every date in the range.
+// CBR responds by the last known rates for a date without own data,
+// so a date is available only if the response has the same date.
+// The whole range request is limited by ctx.
+func (c *Cfg) Calendar(ctx context.Context, from, to time.Time) ([]DayStatus, error) {
+	days, err := rangeDays(from, to)
+	if err != nil {
+		return nil, err
 	}
-	respRates := &ResponseRates{}
-	decoder := xml.NewDecoder(resp.Body)
-	decoder.CharsetReader = charset.NewReaderLabel
-	err = decoder.Decode(respRates)
+	ctx = c.withRetryBudget(ctx)
+	result := make([]DayStatus, days)
+	err = c.forEachDay(ctx, days, func(ctx context.Context, i int) error {
+		date := from.AddDate(0, 0, i)
+		dayInfo, _, err := c.dailyRates(ctx, date)
+		if err != nil {
+			c.logger.Printf("calendar date %v: %v", date, err)
+			return &RateError{HTTPCode: http.StatusServiceUnavailable, Msg: "get daily rates"}
+		}
+		result[i] = DayStatus{
+			Date:      date.Format("2006-01-02"),
+			Available: dayInfo.Date == date.Format("02.01.2006"),
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	c.cache.Add(dateReq, respRates)
-	return respRates, nil
+	return result, nil
 }
 
-// reqRates prepares requested info.
-func (c *Cfg) reqRates(date time.Time, messages []parsedMsg, info map[string]float64) ([]RateItem, error) {
-	result := make([]RateItem, len(messages))
-	for i, m := range messages {
-		rate, ok := info[m.currency]
-		if !ok {
-			return nil, fmt.Errorf("unknown currency %v", m.currency)
+// VolatilityCross returns sample standard deviation of daily a/b cross-rates in the dates range
+// rounded to 6 significant digits. Weekends and holidays are skipped, at least 2 business days are required.
+func (c *Cfg) VolatilityCross(a, b string, from, to time.Time) (float64, error) {
+	days, err := rangeDays(from, to)
+	if err != nil {
+		return 0, err
+	}
+	var (
+		mu     sync.Mutex
+		values []float64
+	)
+	err = c.forEachDay(context.Background(), days, func(ctx context.Context, i int) error {
+		date := from.AddDate(0, 0, i)
+		if !c.businessDay(date).Equal(date) {
+			return nil
 		}
-		// rub value
-		value := rate * m.value
-		result[i] = RateItem{Msg: m.msg, Rate: map[string]float64{}}
-		// other values
-		for currency := range c.codes {
-			c.logger.Printf("value=%v, rate[%v]=%v", value, currency, info[currency])
-			result[i].Rate[currency] = round(value/info[currency], 2)
+		table, err := c.rateTable(ctx, date, a, b)
+		if err != nil {
+			return err
+		}
+		// not rounded rate keeps significant digits of low values
+		rate, err := table.Cross(a, b)
+		if err != nil {
+			return err
 		}
+		mu.Lock()
+		values = append(values, rate)
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return 0, err
 	}
-	return result, nil
+	n := float64(len(values))
+	if n < 2 {
+		return 0, &RateError{HTTPCode: http.StatusBadRequest, Msg: "not enough business days for volatility"}
+	}
+	var sum, squares float64
+	for _, v := range values {
+		sum += v
+	}
+	mean := sum / n
+	for _, v := range values {
+		squares += (v - mean) * (v - mean)
+	}
+	return c.Rounding.RoundSignificant(math.Sqrt(squares/(n-1)), 6), nil
 }
 
-// GetRates returns currencies rates info.
-func (c *Cfg) GetRates(date time.Time, msg string) (*Info, error) {
-	if c.codes == nil {
-		return nil, &RateError{HTTPCode: http.StatusInternalServerError, Msg: "uninitialized required codes"}
+// TimeWeightedAverage returns average RUB rate of one currency unit in the dates range
+// rounded to 6 decimal places. Every business day rate is weighted by the number
+// of calendar days it was effective, so a Friday rate covers the weekend too.
+// A range starting on a non-business day uses the previous business day rate.
+func (c *Cfg) TimeWeightedAverage(currency string, from, to time.Time) (float64, error) {
+	days, err := rangeDays(from, to)
+	if err != nil {
+		return 0, err
 	}
-	strDate := date.Format("2006-01-02")
-	c.logger.Printf("start date=%v, msg=\"%v\"", strDate, msg)
-
-	messages := strings.Split(strings.ToLower(msg), ",")
-	if len(messages) == 0 {
-		return &Info{Date: strDate, Rates: []RateItem{}}, nil
+	var businessDays []time.Time
+	weights := make(map[time.Time]int)
+	for i := 0; i < days; i++ {
+		day := c.businessDay(from.AddDate(0, 0, i))
+		if weights[day] == 0 {
+			businessDays = append(businessDays, day)
+		}
+		weights[day]++
 	}
-	parsedMessages := c.parseMsg(messages)
-	dayInfo, err := c.dayRates(date)
+	values := make([]float64, len(businessDays))
+	err = c.forEachDay(context.Background(), len(businessDays), func(ctx context.Context, i int) error {
+		table, err := c.rateTable(ctx, businessDays[i], currency)
+		if err != nil {
+			return err
+		}
+		// values are rounded once for the average
+		values[i], err = table.Cross(currency, "rub")
+		return err
+	})
 	if err != nil {
-		return nil, &RateError{HTTPCode: http.StatusServiceUnavailable, Msg: "get daily rates"}
+		return 0, err
 	}
-	currencyInfo, err := currencyMap(dayInfo.Items)
-	if err != nil {
-		c.logger.Printf("currency map prepare: %v", err)
-		return nil, &RateError{HTTPCode: http.StatusInternalServerError, Msg: "internal error"}
+	var sum float64
+	for i, day := range businessDays {
+		sum += values[i] * float64(weights[day])
+	}
+	return c.Rounding.Round(sum/float64(days), 6), nil
+}
+
+// WarmUpDates returns the configured number of the last business days
+// in reverse order starting from today or the previous business day.
+func (c *Cfg) WarmUpDates() []time.Time {
+	dates := make([]time.Time, 0, c.WarmUpDays)
+	date := c.businessDay(c.Today())
+	for len(dates) < c.WarmUpDays {
+		dates = append(dates, date)
+		date = c.businessDay(date.AddDate(0, 0, -1))
 	}
+	return dates
+}
 
-	items, err := c.reqRates(date, parsedMessages, currencyInfo)
+// WarmUp prefetches daily rates of WarmUpDates to the cache using not more than
+// the configured number of concurrent workers. Failed dates are logged and skipped,
+// it returns a number of cached dates. Only CBR rates are cached, so fallback providers
+// are not requested. Warm-up stops if the next rates can exceed the cache memory budget.
+func (c *Cfg) WarmUp(ctx context.Context) int {
+	dates := c.WarmUpDates()
+	var cached int32
+	var largest int64
+	ctx = c.withRetryBudget(ctx)
+	err := c.forEachDay(ctx, len(dates), func(ctx context.Context, i int) error {
+		if c.CacheMemory > 0 && c.cachedBytes()+atomic.LoadInt64(&largest) > c.CacheMemory {
+			return fmt.Errorf("cache memory budget is exhausted by %v dates", atomic.LoadInt32(&cached))
+		}
+		dayInfo, provenance, err := c.dayRates(ctx, dates[i])
+		if err != nil {
+			c.logger.Printf("warm-up rates of %v: %v", dates[i].Format("2006-01-02"), err)
+			return nil
+		}
+		size := (&dayEntry{rates: dayInfo, url: provenance.URL}).memSize()
+		for {
+			n := atomic.LoadInt64(&largest)
+			if size <= n || atomic.CompareAndSwapInt64(&largest, n, size) {
+				break
+			}
+		}
+		atomic.AddInt32(&cached, 1)
+		return nil
+	})
 	if err != nil {
-		c.logger.Printf("rates result prepare: %v", err)
-		return nil, &RateError{HTTPCode: http.StatusBadRequest, Msg: "prepare rates error"}
+		c.logger.Printf("warm-up stopped: %v", err)
+	}
+	return int(cached)
+}
+
+// cachedBytes returns approximate memory size in bytes of cached daily rates.
+func (c *Cfg) cachedBytes() int64 {
+	c.cacheMu.Lock()
+	defer c.cacheMu.Unlock()
+	return c.cacheBytes
+}
+
+// forEachDay calls f for day indexes [0, days) using not more than the configured
+// number of concurrent workers. It stops on the first error and returns it.
+func (c *Cfg) forEachDay(ctx context.Context, days int, f func(context.Context, int) error) error {
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	workers := c.RangeWorkers
+	if workers > days {
+		workers = days
+	}
+	workerCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	indexes := make(chan int)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				if err := f(workerCtx, i); err != nil {
+					once.Do(func() {
+						firstErr = err
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+loop:
+	for i := 0; i < days; i++ {
+		select {
+		case indexes <- i:
+		case <-workerCtx.Done():
+			break loop
+		}
+	}
+	close(indexes)
+	wg.Wait()
+	if firstErr == nil && ctx.Err() != nil {
+		return &RateError{HTTPCode: http.StatusServiceUnavailable, Msg: "get daily rates"}
 	}
-	return &Info{Date: strDate, Rates: items}, nil
+	return firstErr
 }
 
-// String returns string representation Info value.
+// String returns string representation Info value,
+// values have decimal places of rates rounding. Currencies follow
+// the configured order, other ones are in alphabetical order.
 func (i *Info) String() string {
+	places := i.places
+	if places <= 0 {
+		places = 3
+	}
 	result := fmt.Sprintf("%v\n", i.Date)
 	for _, rate := range i.Rates {
 		result += fmt.Sprintf("\t%v\n", rate.Msg)
-		for code, value := range rate.Rate {
-			result += fmt.Sprintf("\t\t%v: %.3f\n", code, value)
+		codes := make([]string, 0, len(rate.Rate))
+		for code := range rate.Rate {
+			codes = append(codes, code)
+		}
+		sortCodes(codes, i.order)
+		for _, code := range codes {
+			result += fmt.Sprintf("\t\t%v: %.*f\n", code, places, rate.Rate[code])
+		}
+	}
+	return result
+}
+
+// Flat returns rates info as flat list of currencies values, items are in
+// the requested order and their currencies are in the configured order.
+// Trend, notice and source are kept as is.
+func (i *Info) Flat() *FlatInfo {
+	result := &FlatInfo{Date: i.Date, Rates: []FlatRate{}, Trend: i.Trend, Notice: i.Notice, Source: i.Source}
+	for _, rate := range i.Rates {
+		codes := make([]string, 0, len(rate.Rate))
+		for code := range rate.Rate {
+			codes = append(codes, code)
+		}
+		sortCodes(codes, i.order)
+		for _, code := range codes {
+			result.Rates = append(result.Rates, FlatRate{Msg: rate.Msg, Currency: code, Value: rate.Rate[code]})
+		}
+	}
+	return result
+}
+
+// Compact returns rates info as arrays of values, items are in the requested order
+// and currencies codes are in the configured order.
+func (i *Info) Compact() *CompactInfo {
+	known := make(map[string]bool)
+	codes := []string{}
+	for _, rate := range i.Rates {
+		for code := range rate.Rate {
+			if !known[code] {
+				known[code] = true
+				codes = append(codes, code)
+			}
+		}
+	}
+	sortCodes(codes, i.order)
+	result := &CompactInfo{Schema: CompactSchema, Date: i.Date, Codes: codes, Rates: make([][]*float64, len(i.Rates))}
+	for j, rate := range i.Rates {
+		values := make([]*float64, len(codes))
+		for k, code := range codes {
+			if v, ok := rate.Rate[code]; ok {
+				values[k] = &v
+			}
 		}
+		result.Rates[j] = values
 	}
 	return result
 }
 
+// upperCodes converts currencies codes of info to canonical uppercase ISO codes.
+func (i *Info) upperCodes() {
+	i.renameCodes(strings.ToUpper)
+}
+
+// renameCodes replaces currencies codes of info by results of rename.
+func (i *Info) renameCodes(rename func(string) string) {
+	for j := range i.Rates {
+		item := &i.Rates[j]
+		item.Rate = renameKeys(item.Rate, rename)
+		item.Raw = renameKeys(item.Raw, rename)
+		item.Inverse = renameKeys(item.Inverse, rename)
+		for k := range item.Values {
+			item.Values[k].Code = rename(item.Values[k].Code)
+		}
+		if item.Ratio != nil {
+			ratio := make(map[string]*Ratio, len(item.Ratio))
+			for code, value := range item.Ratio {
+				ratio[rename(code)] = value
+			}
+			item.Ratio = ratio
+		}
+	}
+	if i.Trend != nil {
+		trend := make(map[string]string, len(i.Trend))
+		for code, value := range i.Trend {
+			trend[rename(code)] = value
+		}
+		i.Trend = trend
+	}
+	i.Basket = renameKeys(i.Basket, rename)
+	if i.Currencies != nil {
+		currencies := make(map[string]CodeItem, len(i.Currencies))
+		for code, value := range i.Currencies {
+			currencies[rename(code)] = value
+		}
+		i.Currencies = currencies
+	}
+	if i.Precision != nil {
+		precision := make(map[string]int, len(i.Precision))
+		for code, value := range i.Precision {
+			precision[rename(code)] = value
+		}
+		i.Precision = precision
+	}
+}
+
+// attachMetadata adds catalog entries of currencies returned in info,
+// currencies missing in the catalog like RUB are skipped.
+func (c *Cfg) attachMetadata(info *Info) error {
+	info.Currencies = make(map[string]CodeItem)
+	for _, item := range info.Rates {
+		for code := range item.Rate {
+			if _, ok := info.Currencies[code]; ok {
+				continue
+			}
+			codeItem, ok, err := c.LookupCode(code)
+			if err != nil {
+				c.logger.Printf("currencies metadata: %v", err)
+				return &RateError{HTTPCode: http.StatusServiceUnavailable, Msg: "get currencies codes"}
+			}
+			if !ok {
+				c.logger.Printf("no catalog entry of %v", code)
+				continue
+			}
+			info.Currencies[code] = codeItem
+		}
+	}
+	return nil
+}
+
+// numericCodes converts all currencies codes of info to ISO numeric codes of the catalog,
+// including target currencies of messages like "10 usd to jpy" and CBR IDs.
+// RUB is not in the catalog, so its code is fixed.
+func (c *Cfg) numericCodes(info *Info) error {
+	numeric := map[string]string{"rub": rubNumCode}
+	// the first pass only collects codes used in info
+	info.renameCodes(func(code string) string {
+		if _, ok := numeric[code]; !ok {
+			numeric[code] = ""
+		}
+		return code
+	})
+	for code, num := range numeric {
+		if num != "" {
+			continue
+		}
+		item, ok, err := c.LookupCode(code)
+		if err != nil {
+			c.logger.Printf("numeric codes: %v", err)
+			return &RateError{HTTPCode: http.StatusServiceUnavailable, Msg: "get currencies codes"}
+		}
+		if !ok || item.NumCode == "" {
+			return &RateError{HTTPCode: http.StatusInternalServerError, Msg: fmt.Sprintf("unknown numeric code of %v", code)}
+		}
+		numeric[code] = indexKey(item.NumCode)
+	}
+	info.renameCodes(func(code string) string {
+		return numeric[code]
+	})
+	return nil
+}
+
+// MarshalInfo encodes rates info to gob binary format for internal callers,
+// JSON stays the format of service responses.
+func MarshalInfo(info *Info) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(info); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalInfo decodes rates info from gob binary format.
+func UnmarshalInfo(data []byte) (*Info, error) {
+	info := &Info{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
 // New returns new rates configuration.
-func New(logger *log.Logger, userAgent string) (*Cfg, error) {
-	c := &Cfg{logger: logger, userAgent: userAgent}
-	cache, err := lru.New(c.CacheSize)
+// The file is parsed as YAML if it has .yaml or .yml extension, otherwise as JSON.
+func New(filename string, logger *log.Logger, userAgent string) (*Cfg, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	c := &Cfg{logger: logger, userAgent: userAgent, Normalize: NormalizeQuery, Clock: systemClock{}}
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, c)
+	default:
+		err = json.Unmarshal(data, c)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if c.RatesURL == "" {
+		c.RatesURL = currenciesRatesURL
+	}
+	if c.CodesURL == "" {
+		c.CodesURL = currenciesCodesURL
+	}
+	if c.ERAPIURL == "" {
+		c.ERAPIURL = erapiURL
+	}
+	if c.DialTimeout == 0 {
+		c.DialTimeout = defaultDialTimeout
+	}
+	if c.TLSTimeout == 0 {
+		c.TLSTimeout = defaultTLSTimeout
+	}
+	if c.IdleTimeout == 0 {
+		c.IdleTimeout = defaultIdleTimeout
+	}
+	if c.RangeWorkers == 0 {
+		c.RangeWorkers = defaultRangeWorkers
+	}
+	if c.MaxUpstream == 0 {
+		c.MaxUpstream = defaultMaxUpstream
+	}
+	if c.MaxCodes == 0 {
+		c.MaxCodes = defaultMaxCodes
+	}
+	if len(c.CompressAlgorithms) == 0 {
+		c.CompressAlgorithms = []string{CompressGzip}
+	}
+	if c.MaxRedirects == 0 {
+		c.MaxRedirects = defaultMaxRedirects
+	}
+	if c.RetryDelay == 0 {
+		c.RetryDelay = defaultRetryDelay
+	}
+	if c.Precision.JSON == nil {
+		places := defaultJSONPrecision
+		c.Precision.JSON = &places
+	}
+	if c.Precision.Max == 0 {
+		c.Precision.Max = maxPrecision
+	}
+	if c.CodesMaxAge == 0 {
+		c.CodesMaxAge = defaultCodesMaxAge
+	}
+	if c.FieldNaming == "" {
+		c.FieldNaming = NamingSnake
+	}
+	if c.AmountOverflow == "" {
+		c.AmountOverflow = OverflowReject
+	}
+	if c.DefaultQuery = strings.TrimSpace(c.DefaultQuery); c.DefaultQuery == "" {
+		c.DefaultQuery = defaultQuery
+	}
+	if c.BasePath = strings.Trim(c.BasePath, "/"); c.BasePath != "" {
+		c.BasePath = "/" + c.BasePath
+	}
+	err = c.isValid()
+	if err != nil {
+		return nil, err
+	}
+	// markups are looked up by lower case codes
+	markups := make(map[string]float64, len(c.Markups))
+	for code, m := range c.Markups {
+		markups[strings.ToLower(code)] = m
+	}
+	c.Markups = markups
+	// empty timezone is UTC
+	c.location, err = time.LoadLocation(c.Timezone)
+	if err != nil {
+		return nil, err
+	}
+	cache, err := lru.NewWithEvict(c.CacheSize, c.evictRates)
 	if err != nil {
 		return nil, err
 	}
 	if c.Debug {
 		c.logger.SetOutput(os.Stdout)
 	}
+	holidays := c.Holidays
+	if c.HolidaysFile != "" {
+		dates, err := readHolidays(c.HolidaysFile)
+		if err != nil {
+			return nil, err
+		}
+		holidays = append(holidays, dates...)
+	}
+	if err = c.SetHolidays(holidays); err != nil {
+		return nil, err
+	}
 	c.cache = cache
+	if c.results, err = lru.New(resultsCacheSize); err != nil {
+		return nil, err
+	}
+	c.httpClient, err = c.newClient()
+	if err != nil {
+		return nil, err
+	}
+	c.upstream = make(chan struct{}, c.MaxUpstream)
+	for _, name := range c.FallbackProviders {
+		c.Fallbacks = append(c.Fallbacks, fallbackProviders[name](c))
+	}
 	c.timeout = time.Duration(c.Timeout) * time.Second
+	c.maxCacheAge = time.Duration(c.MaxCacheAge) * time.Second
+	c.staleAge = time.Duration(c.StaleAge) * time.Second
+	c.dedupWindow = time.Duration(c.DedupWindow) * time.Second
+	c.hedgeDelay = time.Duration(c.HedgeDelay) * time.Millisecond
+	c.retryDelay = time.Duration(c.RetryDelay) * time.Millisecond
+	c.codesMaxAge = time.Duration(c.CodesMaxAge) * time.Second
 	return c, err
 }
 
-// currencyMap converts currencies response to float64 map.
-func currencyMap(values []CurrencyItem) (map[string]float64, error) {
+// rangeDays returns a number of days in the dates range.
+func rangeDays(from, to time.Time) (int, error) {
+	if from.After(to) {
+		return 0, &RateError{HTTPCode: http.StatusBadRequest, Msg: "invalid dates range"}
+	}
+	days := int(to.Sub(from).Hours()/24) + 1
+	if days > maxRangeDays {
+		return 0, &RateError{HTTPCode: http.StatusBadRequest, Msg: fmt.Sprintf("too long dates range, max %v days", maxRangeDays)}
+	}
+	return days, nil
+}
+
+// dateLayout returns a date layout detected by value's length and separators.
+// Day-first formats with separators other than dots are ambiguous.
+func dateLayout(value string) (string, error) {
+	switch len(value) {
+	case 7:
+		if value[4] == '-' {
+			return monthLayout, nil
+		}
+	case 8:
+		if strings.Trim(value, "0123456789") == "" {
+			return "20060102", nil
+		}
+	case 10:
+		if sep := value[4]; strings.IndexByte("-./", sep) >= 0 && value[7] == sep {
+			return fmt.Sprintf("2006%c01%c02", sep, sep), nil
+		}
+		if sep := value[2]; value[5] == sep {
+			switch sep {
+			case '.':
+				return "02.01.2006", nil
+			case '-', '/':
+				return "", errors.New("ambiguous date format")
+			}
+		}
+	}
+	return "", errors.New("bad date format")
+}
+
+// checkURL checks that value is absolute HTTP(S) URL.
+func checkURL(value string) error {
+	u, err := url.Parse(value)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid HTTP URL %q", value)
+	}
+	return nil
+}
+
+// currencyMap converts currencies response to float64 map,
+// values are indexed by lower case char codes and CBR internal IDs.
+// If precision is not nil, it is filled by numbers of decimal places
+// of source values by lower case char codes.
+func currencyMap(values []CurrencyItem, precision map[string]int) (map[string]float64, error) {
 	result := make(map[string]float64)
 	result["rub"] = 1.0
 	for _, value := range values {
@@ -378,23 +3313,185 @@ func currencyMap(values []CurrencyItem) (map[string]float64, error) {
 		if err != nil {
 			return nil, err
 		}
+		if precision != nil {
+			precision[strings.ToLower(value.CharCode)] = decimalPlaces(floatStr)
+		}
 		result[strings.ToLower(value.CharCode)] = v / float64(value.Nominal)
+		if value.ID != "" {
+			result[strings.ToLower(value.ID)] = v / float64(value.Nominal)
+		}
 	}
 	return result, nil
 }
 
-// round rounds positive val.
-func round(val, places float64) float64 {
-	const roundOn float64 = 0.5
-	var round float64
-	pow := math.Pow(10, places)
-	digit := pow * val
-	_, div := math.Modf(digit)
+// decimalPlaces returns a number of digits after decimal point of number string.
+func decimalPlaces(value string) int {
+	i := strings.IndexByte(value, '.')
+	if i < 0 {
+		return 0
+	}
+	return len(strings.TrimSpace(value[i+1:]))
+}
+
+// renameKeys returns a copy of values with keys replaced by results of rename,
+// it is nil for nil values.
+func renameKeys(values map[string]float64, rename func(string) string) map[string]float64 {
+	if values == nil {
+		return nil
+	}
+	result := make(map[string]float64, len(values))
+	for code, value := range values {
+		result[rename(code)] = value
+	}
+	return result
+}
+
+// recognized returns true if some currency is found in parsed messages.
+func recognized(messages []parsedMsg) bool {
+	for _, m := range messages {
+		if m.currency != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeDuplicates returns messages where amounts of the same currency and target
+// are summed to the first of them, messages are joined by " + ".
+func mergeDuplicates(messages []parsedMsg) []parsedMsg {
+	result := make([]parsedMsg, 0, len(messages))
+	positions := make(map[[2]string]int, len(messages))
+	for _, m := range messages {
+		if m.currency == "" {
+			result = append(result, m)
+			continue
+		}
+		key := [2]string{m.currency, m.target}
+		if i, ok := positions[key]; ok {
+			result[i].value += m.value
+			result[i].msg += " + " + m.msg
+			result[i].underflow = result[i].underflow || m.underflow
+			continue
+		}
+		positions[key] = len(result)
+		result = append(result, m)
+	}
+	return result
+}
+
+// splitTarget splits message "SOURCE to TARGET" by a target keyword,
+// it returns false if the message has no target.
+func splitTarget(message string) (string, string, bool) {
+	fields := strings.Fields(message)
+	for i := 1; i < len(fields)-1; i++ {
+		if targetKeywords[fields[i]] {
+			return strings.Join(fields[:i], " "), strings.Join(fields[i+1:], " "), true
+		}
+	}
+	return "", "", false
+}
+
+// isAmount returns true if s is an amount of digits with optional decimal part.
+func isAmount(s string) bool {
+	point := -1
+	for i := 0; i < len(s); i++ {
+		switch {
+		case isDigit(s[i]):
+		case s[i] == '.' && point < 0:
+			point = i
+		default:
+			return false
+		}
+	}
+	return len(s) > 0 && point != 0 && point != len(s)-1
+}
+
+// isWordRune returns true if r is a letter, digit or underscore.
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// statusError is an error of not OK upstream response status code.
+type statusError int
+
+// Error returns a text of the error.
+func (e statusError) Error() string {
+	return fmt.Sprintf("not ok response: %v", int(e))
+}
+
+// decodeError is an error of upstream response decoding.
+type decodeError struct {
+	err error
+}
+
+// Error returns a text of the error.
+func (e *decodeError) Error() string {
+	return e.err.Error()
+}
+
+// retryable returns true if the failed upstream request can succeed on retry,
+// it is false for not 5xx responses and decoding errors.
+func retryable(err error) bool {
+	switch e := err.(type) {
+	case statusError:
+		return e >= http.StatusInternalServerError
+	case *decodeError:
+		return false
+	}
+	return true
+}
+
+// sleep waits for the delay and returns an error if ctx is done before.
+func sleep(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// takeRetry takes one retry from the budget of ctx and returns true if it was available.
+// There is no limit if ctx doesn't have a budget.
+func takeRetry(ctx context.Context) bool {
+	budget, ok := ctx.Value(retryBudgetKey{}).(*int32)
+	if !ok {
+		return true
+	}
+	return atomic.AddInt32(budget, -1) >= 0
+}
+
+// trend returns a direction of RUB rate change from prev to current value.
+func trend(prev, current float64) string {
+	switch {
+	case current > prev:
+		return TrendUp
+	case current < prev:
+		return TrendDown
+	}
+	return TrendFlat
+}
 
-	if div >= roundOn {
-		round = math.Ceil(digit)
-	} else {
-		round = math.Floor(digit)
+// ratioMap converts currencies response to exact rational numbers map,
+// values are indexed by lower case char codes and CBR internal IDs.
+func ratioMap(values []CurrencyItem) (map[string]*big.Rat, error) {
+	result := make(map[string]*big.Rat)
+	result["rub"] = big.NewRat(1, 1)
+	for _, value := range values {
+		if value.Nominal == 0 {
+			return nil, fmt.Errorf("zero nominal of %v", value.CharCode)
+		}
+		v, ok := new(big.Rat).SetString(strings.Replace(value.Value, ",", ".", 1))
+		if !ok {
+			return nil, fmt.Errorf("invalid value %v of %v", value.Value, value.CharCode)
+		}
+		v.Quo(v, new(big.Rat).SetInt64(int64(value.Nominal)))
+		result[strings.ToLower(value.CharCode)] = v
+		if value.ID != "" {
+			result[strings.ToLower(value.ID)] = v
+		}
 	}
-	return round / pow
+	return result, nil
 }
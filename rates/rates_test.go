@@ -1,16 +1,39 @@
 package rates
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"math"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
+	"reflect"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	lru "github.com/hashicorp/golang-lru"
 )
 
 const (
+	dailyFile   = "testdata/daily.xml"
+	codesFile   = "testdata/codes.xml"
+	erapiFile   = "testdata/erapi.json"
 	configFile  = "config.example.json"
+	yamlFile    = "config.example.yaml"
 	packageName = "github.com/z0rr0/exchange"
 	userAgent   = "rates_test/0.0"
 )
@@ -20,12 +43,81 @@ var (
 )
 
 func getConfig() string {
+	return getConfigFile(configFile)
+}
+
+func getConfigFile(name string) string {
 	dirs := []string{os.Getenv("GOPATH"), "src"}
 	dirs = append(dirs, strings.Split(packageName, "/")...)
-	dirs = append(dirs, configFile)
+	dirs = append(dirs, name)
 	return path.Join(dirs...)
 }
 
+// stubServer returns a test server responding by testdata file content.
+func stubServer(t *testing.T, filename string) *httptest.Server {
+	server, _ := countingServer(t, filename)
+	return server
+}
+
+// stubConfig returns a configuration of test server responding by daily rates file
+// with required codes if they are not nil. The server is closed by the test cleanup.
+func stubConfig(t *testing.T, codes map[string][]string) *Cfg {
+	t.Helper()
+	server := stubServer(t, dailyFile)
+	t.Cleanup(server.Close)
+	cfg, err := New(getConfig(), logger, userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.RatesURL = server.URL
+	if codes != nil {
+		if err = cfg.SetRequiredCodes(codes); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return cfg
+}
+
+// countingServer returns a test server responding by testdata file content
+// and a counter of handled requests.
+func countingServer(t *testing.T, filename string) (*httptest.Server, *int32) {
+	var counter int32
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&counter, 1)
+		w.Header().Set("Content-Type", "application/xml")
+		w.Write(data)
+	}))
+	return server, &counter
+}
+
+// configWith returns a temporary configuration file of the example one
+// with fields replaced by values.
+func configWith(t *testing.T, values map[string]interface{}) string {
+	data, err := ioutil.ReadFile(getConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := make(map[string]interface{})
+	if err = json.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range values {
+		fields[name] = value
+	}
+	if data, err = json.Marshal(fields); err != nil {
+		t.Fatal(err)
+	}
+	filename := path.Join(t.TempDir(), "config.json")
+	if err = ioutil.WriteFile(filename, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
 func TestNew(t *testing.T) {
 	if _, err := New("/bad_file_path.json", logger, userAgent); err == nil {
 		t.Error("unexpected behavior")
@@ -58,6 +150,32 @@ func TestCfg_HandleTimeout(t *testing.T) {
 	}
 }
 
+func TestCfg_Deadline(t *testing.T) {
+	cfg, err := New(getConfig(), logger, userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Timeout = 10
+	cfg.Deadlines = Deadlines{Range: 60, Batch: 30}
+	deadlines := map[Endpoint]time.Duration{
+		SingleEndpoint: 10 * time.Second,
+		RangeEndpoint:  60 * time.Second,
+		BatchEndpoint:  30 * time.Second,
+	}
+	for e, expected := range deadlines {
+		if d := cfg.Deadline(e); d != expected {
+			t.Errorf("unexpected deadline of %v: %v", e, d)
+		}
+	}
+	if d := cfg.HandleTimeout(); d != 60*time.Second {
+		t.Errorf("unexpected handle timeout: %v", d)
+	}
+	cfg.Deadlines.Batch = -1
+	if err := cfg.isValid(); err == nil {
+		t.Error("negative deadline is valid")
+	}
+}
+
 func TestCfg_GetCodes(t *testing.T) {
 	cfg, err := New(getConfig(), logger, userAgent)
 	if err != nil {
@@ -126,3 +244,3702 @@ func TestCfg_GetRates(t *testing.T) {
 		t.Error("unexpected behavior")
 	}
 }
+
+func TestCfg_GetRatesProvenance(t *testing.T) {
+	cfg := stubConfig(t, map[string][]string{"usd": {"$"}})
+	d := time.Date(2017, 3, 2, 0, 0, 0, 0, time.UTC)
+	info, err := cfg.GetRates(d, "1 usd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := info.Provenance
+	if p == nil || p.Cached {
+		t.Fatalf("unexpected provenance: %+v", p)
+	}
+	if !strings.HasPrefix(p.URL, cfg.RatesURL) {
+		t.Errorf("unexpected URL: %v", p.URL)
+	}
+	info, err = cfg.GetRates(d, "1 usd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := info.Provenance; p == nil || !p.Cached {
+		t.Errorf("unexpected provenance: %+v", p)
+	}
+}
+
+func TestNormalizeQuery(t *testing.T) {
+	cases := map[string]string{
+		"  100   USD  ": "100 usd",
+		"$ 100":         "usd 100",
+		"10€":           "10 eur",
+		"10\tсчёт":      "10 счет",
+	}
+	for msg, expected := range cases {
+		if n := NormalizeQuery(msg); n != expected {
+			t.Errorf("unexpected normalization %q: %q", msg, n)
+		}
+	}
+}
+
+func TestCfg_Normalize(t *testing.T) {
+	cfg, err := New(getConfig(), logger, userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cfg.SetRequiredCodes(map[string][]string{"usd": {"dollar"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := []string{"  100   USD  ", "$ 100"}
+	for _, p := range cfg.parseMsg(messages) {
+		if p.currency != "usd" || p.value != 100 {
+			t.Errorf("unexpected result for %q: %+v", p.msg, p)
+		}
+	}
+	// without normalization the symbol is unknown
+	cfg.Normalize = nil
+	if p := cfg.parseMsg([]string{"$ 100"}); p[0].currency != "" {
+		t.Errorf("unexpected result: %+v", p[0])
+	}
+}
+
+func TestCfg_Locale(t *testing.T) {
+	cfg, err := New(getConfig(), logger, userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cfg.SetRequiredCodes(map[string][]string{"usd": {"dollar"}, "eur": {"euro"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		locale   Locale
+		query    string
+		expected []float64
+	}{
+		{English, "1,500 usd", []float64{1500}},
+		{Russian, "1,500 usd", []float64{1.5}},
+		{English, "1,234,567.5 usd, 2 eur", []float64{1234567.5, 2}},
+		{Russian, "1 234 567,5 usd, 2 eur", []float64{1234567.5, 2}},
+		{English, "10 usd,20 eur", []float64{10, 20}},
+		{Russian, "usd 2,5,eur 3", []float64{2.5, 3}},
+	}
+	for i, c := range cases {
+		cfg.Locale = c.locale
+		parsed := cfg.parseMsg(cfg.Locale.Split(c.query))
+		if len(parsed) != len(c.expected) {
+			t.Errorf("failed case [%v] %v: %+v", i, c.locale, parsed)
+			continue
+		}
+		for j, p := range parsed {
+			if p.value != c.expected[j] {
+				t.Errorf("failed case [%v] %v: %+v", i, c.locale, p)
+			}
+		}
+	}
+	if _, err := ParseLocale("de"); err == nil {
+		t.Error("unexpected behavior")
+	}
+}
+
+func TestCfg_DayDate(t *testing.T) {
+	cfg, err := New(getConfig(), logger, userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	friday := time.Date(2017, 3, 3, 0, 0, 0, 0, time.UTC)
+	saturday := friday.AddDate(0, 0, 1)
+	// Friday 21:30 UTC is Saturday 00:30 in Moscow
+	now := time.Date(2017, 3, 3, 21, 30, 0, 0, time.UTC)
+	if d := cfg.DayDate(now); !d.Equal(friday) {
+		t.Errorf("unexpected UTC date: %v", d)
+	}
+	cfg.Timezone = "Europe/Moscow"
+	cfg.location, err = time.LoadLocation(cfg.Timezone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := cfg.DayDate(now); !d.Equal(saturday) {
+		t.Errorf("unexpected Moscow date: %v", d)
+	}
+	// Friday 20:59 UTC is still Friday 23:59 in Moscow
+	if d := cfg.DayDate(now.Add(-31 * time.Minute)); !d.Equal(friday) {
+		t.Errorf("unexpected Moscow date: %v", d)
+	}
+	// today's rates are rates of the Moscow date
+	data, err := ioutil.ReadFile(dailyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var requested []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = append(requested, r.FormValue("date_req"))
+		w.Header().Set("Content-Type", "application/xml")
+		w.Write(data)
+	}))
+	defer server.Close()
+	cfg.RatesURL = server.URL
+	cfg.Clock = &fixedClock{now: now}
+	if err = cfg.SetRequiredCodes(map[string][]string{"usd": {"$"}, "eur": {"€"}, "rub": {"₽"}}); err != nil {
+		t.Fatal(err)
+	}
+	info, err := cfg.GetRates(cfg.Today(), "1 usd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]float64{"usd": 1, "eur": 0.95, "rub": 58.12}
+	if !reflect.DeepEqual(info.Rates[0].Rate, expected) {
+		t.Errorf("unexpected rates: %v", info.Rates[0].Rate)
+	}
+	if info.Date != "2017-03-04" || !reflect.DeepEqual(requested, []string{"04/03/2017"}) {
+		t.Errorf("unexpected date %v, requested %v", info.Date, requested)
+	}
+}
+
+func TestCfg_SearchCodes(t *testing.T) {
+	server := stubServer(t, codesFile)
+	defer server.Close()
+
+	cfg, err := New(getConfig(), logger, userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.CodesURL = server.URL
+	cases := map[string][]string{
+		"":       {"USD", "EUR", "CAD", "JPY"},
+		"dollar": {"USD", "CAD"},
+		"ЕВРО":   {"EUR"},
+		"jp":     {"JPY"},
+		"xyz":    {},
+	}
+	for search, expected := range cases {
+		codes, err := cfg.SearchCodes(search)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(codes) != len(expected) {
+			t.Fatalf("unexpected result for %q: %v", search, codes)
+		}
+		for i, item := range codes {
+			if item.CharCode != expected[i] {
+				t.Errorf("unexpected code for %q: %v", search, item.CharCode)
+			}
+		}
+	}
+}
+
+func TestCfg_GetRatesNumeric(t *testing.T) {
+	dailyServer := stubServer(t, dailyFile)
+	defer dailyServer.Close()
+	codesServer := stubServer(t, codesFile)
+	defer codesServer.Close()
+
+	cfg, err := New(getConfig(), logger, userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.RatesURL, cfg.CodesURL = dailyServer.URL, codesServer.URL
+	cfg.UpperCodes = true
+	err = cfg.SetRequiredCodes(map[string][]string{"usd": {"$"}, "eur": {"€"}, "jpy": {"¥"}, "rub": {"руб"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := time.Date(2017, 3, 2, 0, 0, 0, 0, time.UTC)
+	info, err := cfg.GetRatesWith(d, "1 usd", Options{Numeric: true, Ordered: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]float64{"840": 1, "978": 0.95, "392": 113.51, "643": 58.12}
+	if item := info.Rates[0]; !reflect.DeepEqual(item.Rate, expected) {
+		t.Errorf("unexpected numeric rates: %v", item.Rate)
+	}
+	for _, v := range info.Rates[0].Values {
+		if _, ok := expected[v.Code]; !ok {
+			t.Errorf("unexpected value code: %v", v.Code)
+		}
+	}
+	// char codes are not changed
+	info, err = cfg.GetRatesWith(d, "1 usd", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := info.Rates[0].Rate["USD"]; !ok {
+		t.Errorf("unexpected char codes rates: %v", info.Rates[0].Rate)
+	}
+	// target currencies of messages are not required ones
+	err = cfg.SetRequiredCodes(map[string][]string{"usd": {"$"}, "rub": {"руб"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err = cfg.GetRatesWith(d, "10 usd to jpy, 10 r01239", Options{Numeric: true, Verbose: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rate := info.Rates[0].Rate; len(rate) != 1 || rate["392"] != 1135.07 {
+		t.Errorf("unexpected numeric target rates: %v", rate)
+	}
+	if inverse := info.Rates[0].Inverse; len(inverse) != 1 || inverse["392"] == 0 {
+		t.Errorf("unexpected numeric inverse rates: %v", inverse)
+	}
+	for code := range info.Rates[1].Rate {
+		if code != "840" && code != "643" {
+			t.Errorf("unexpected numeric code: %v", code)
+		}
+	}
+	// GBP is absent in the catalog
+	err = cfg.SetRequiredCodes(map[string][]string{"usd": {"$"}, "gbp": {"£"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cfg.GetRatesWith(d, "1 usd", Options{Numeric: true})
+	if rateErr, ok := err.(*RateError); !ok || rateErr.HTTPCode != http.StatusInternalServerError {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestCfg_StringValues(t *testing.T) {
+	cfg := stubConfig(t, map[string][]string{"usd": {"$"}, "eur": {"€"}, "rub": {"руб"}})
+	d := time.Date(2017, 3, 2, 0, 0, 0, 0, time.UTC)
+	expected := map[string]float64{"usd": 1, "eur": 0.95, "rub": 58.12}
+	cases := []struct {
+		stringValues bool
+		rate         string
+	}{
+		{false, `"rate":{"eur":0.95,"rub":58.12,"usd":1}`},
+		{true, `"rate":{"eur":"0.95","rub":"58.12","usd":"1.00"}`},
+	}
+	for _, c := range cases {
+		cfg.StringValues = c.stringValues
+		info, err := cfg.GetRatesWith(d, "1 usd", Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := json.Marshal(info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(data), c.rate) {
+			t.Errorf("unexpected JSON with string values %v: %s", c.stringValues, data)
+		}
+		decoded := &Info{}
+		if err = json.Unmarshal(data, decoded); err != nil {
+			t.Fatal(err)
+		}
+		if len(decoded.Rates) != 1 || !reflect.DeepEqual(decoded.Rates[0].Rate, expected) || decoded.Rates[0].Msg != "1 usd" {
+			t.Errorf("unexpected decoded info with string values %v: %+v", c.stringValues, decoded)
+		}
+	}
+	item := &RateItem{}
+	if err := json.Unmarshal([]byte(`{"msg":"x","rate":{"usd":"abc"}}`), item); err == nil {
+		t.Error("unexpected behavior for invalid value")
+	}
+}
+
+func TestCfg_GetRatesMetadata(t *testing.T) {
+	dailyServer := stubServer(t, dailyFile)
+	defer dailyServer.Close()
+	codesServer, counter := countingServer(t, codesFile)
+	defer codesServer.Close()
+
+	cfg, err := New(getConfig(), logger, userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.RatesURL, cfg.CodesURL = dailyServer.URL, codesServer.URL
+	err = cfg.SetRequiredCodes(map[string][]string{"usd": {"$"}, "jpy": {"¥"}, "rub": {"руб"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := time.Date(2017, 3, 2, 0, 0, 0, 0, time.UTC)
+	info, err := cfg.GetRatesWith(d, "1 usd", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Currencies != nil || atomic.LoadInt32(counter) != 0 {
+		t.Errorf("unexpected metadata: %v", info.Currencies)
+	}
+	info, err = cfg.GetRatesWith(d, "1 usd", Options{Metadata: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// RUB is absent in the catalog
+	if n := len(info.Currencies); n != 2 {
+		t.Errorf("unexpected number of currencies: %v", n)
+	}
+	usd, jpy := info.Currencies["usd"], info.Currencies["jpy"]
+	if usd.EngName != "US Dollar" || usd.NumCode != "840" || usd.Nominal != 1 {
+		t.Errorf("unexpected usd metadata: %+v", usd)
+	}
+	if jpy.EngName != "Japanese Yen" || jpy.NumCode != "392" || jpy.Nominal != 100 {
+		t.Errorf("unexpected jpy metadata: %+v", jpy)
+	}
+	info, err = cfg.GetRatesWith(d, "1 usd", Options{Metadata: true, Numeric: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usd := info.Currencies["840"]; usd.CharCode != "USD" {
+		t.Errorf("unexpected numeric metadata: %v", info.Currencies)
+	}
+}
+
+func TestCfg_LookupCode(t *testing.T) {
+	server, counter := countingServer(t, codesFile)
+	defer server.Close()
+
+	cfg, err := New(getConfig(), logger, userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.CodesURL = server.URL
+	cases := map[string]string{
+		"USD":    "USD",
+		"eur":    "EUR",
+		"840":    "USD",
+		"124":    "CAD",
+		"r01820": "JPY",
+		"R01235": "USD",
+		" 978 ":  "EUR",
+		"xyz":    "",
+		"999":    "",
+		"":       "",
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key, expected := range cases {
+				item, ok, err := cfg.LookupCode(key)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if ok != (expected != "") || item.CharCode != expected {
+					t.Errorf("unexpected item for %q: %+v, %v", key, item, ok)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(counter); n < 1 {
+		t.Errorf("unexpected requests: %v", n)
+	}
+	// index is rebuilt with the catalog
+	cfg.Clock = &fixedClock{now: time.Now().Add(cfg.codesMaxAge)}
+	if item, ok, err := cfg.LookupCode("840"); err != nil || !ok || item.CharCode != "USD" {
+		t.Errorf("unexpected item: %+v, %v, %v", item, ok, err)
+	}
+	if n := atomic.LoadInt32(counter); n < 2 {
+		t.Errorf("catalog is not refreshed: %v", n)
+	}
+	cfg.CodesURL = "http://127.0.0.1:1"
+	cfg.catalog = nil
+	if _, _, err := cfg.LookupCode("usd"); err == nil {
+		t.Error("unexpected behavior without catalog")
+	}
+}
+
+func TestCfg_CodesMaxAge(t *testing.T) {
+	server, counter := countingServer(t, codesFile)
+	defer server.Close()
+
+	cfg, err := New(getConfig(), logger, userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.codesMaxAge != 24*time.Hour {
+		t.Errorf("unexpected default codes max age: %v", cfg.codesMaxAge)
+	}
+	cfg.CodesURL = server.URL
+	clock := &fixedClock{now: time.Date(2017, 3, 2, 12, 0, 0, 0, time.UTC)}
+	cfg.Clock = clock
+	for i := 0; i < 2; i++ {
+		if _, err := cfg.GetCodes(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(counter); n != 1 {
+		t.Errorf("unexpected requests: %v", n)
+	}
+	// forced expiration
+	clock.now = clock.now.Add(cfg.codesMaxAge)
+	codes, err := cfg.GetCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(counter); n != 2 || len(codes) != 4 {
+		t.Errorf("unexpected requests %v of %v codes", n, len(codes))
+	}
+	// expired catalog is used if the request fails
+	clock.now = clock.now.Add(cfg.codesMaxAge)
+	cfg.CodesURL = "http://127.0.0.1:1"
+	if codes, err = cfg.GetCodes(); err != nil || len(codes) != 4 {
+		t.Errorf("unexpected result: %v, %v", codes, err)
+	}
+	cfg.CodesMaxAge = -1
+	if err = cfg.isValid(); err == nil {
+		t.Error("negative codes max age is valid")
+	}
+}
+
+func TestRoundingMode_Round(t *testing.T) {
+	cases := []struct {
+		mode     RoundingMode
+		val      float64
+		expected float64
+	}{
+		{HalfUp, 0.125, 0.13},
+		{HalfUp, -0.125, -0.13},
+		{HalfUp, 0.375, 0.38},
+		{HalfEven, 0.125, 0.12},
+		{HalfEven, -0.125, -0.12},
+		{HalfEven, 0.375, 0.38},
+		{HalfEven, -0.375, -0.38},
+		{Floor, 0.125, 0.12},
+		{Floor, -0.125, -0.13},
+		{Ceil, 0.125, 0.13},
+		{Ceil, -0.125, -0.12},
+		{Truncate, 0.125, 0.12},
+		{Truncate, -0.125, -0.12},
+		// decimal halves which are not exact binary values
+		{HalfUp, 1.005, 1.01},
+		{HalfUp, 2.675, 2.68},
+		{HalfUp, -1.005, -1.01},
+		{HalfEven, 1.005, 1},
+		{HalfEven, 2.675, 2.68},
+		{HalfEven, -1.005, -1},
+		{HalfEven, 1.0051, 1.01},
+		{Floor, 1.005, 1},
+		{Floor, 2.675, 2.67},
+		{Floor, -1.005, -1.01},
+		{Ceil, 1.005, 1.01},
+		{Ceil, 2.675, 2.68},
+		{Ceil, -1.005, -1},
+		{Truncate, 1.005, 1},
+		{Truncate, 2.675, 2.67},
+		{Truncate, -1.005, -1},
+		// carry and exact values
+		{HalfUp, 9.995, 10},
+		{Ceil, 0.001, 0.01},
+		{Floor, 1.5, 1.5},
+		{HalfUp, 0, 0},
+	}
+	for i, c := range cases {
+		if v := c.mode.Round(c.val, 2); v != c.expected {
+			t.Errorf("failed case [%v] %v(%v): %v", i, c.mode, c.val, v)
+		}
+	}
+	if v := HalfUp.Round(1234.5, 0); v != 1235 {
+		t.Errorf("unexpected integer rounding: %v", v)
+	}
+	if v := HalfUp.Round(math.Inf(1), 2); !math.IsInf(v, 1) {
+		t.Errorf("unexpected infinity rounding: %v", v)
+	}
+	// rounded to zero negative values aren't negative zero
+	for _, mode := range []RoundingMode{HalfUp, HalfEven, Ceil, Truncate} {
+		for _, places := range []float64{2, 1.5} {
+			if v := mode.Round(-0.001, places); v != 0 || math.Signbit(v) {
+				t.Errorf("unexpected %v rounding of %v places: %v", mode, places, v)
+			}
+		}
+	}
+	if v := HalfUp.Round(math.Copysign(0, -1), 2); math.Signbit(v) {
+		t.Errorf("unexpected negative zero rounding: %v", v)
+	}
+}
+
+func TestRoundingMode_RoundSignificant(t *testing.T) {
+	cases := []struct {
+		val, expected float64
+	}{
+		{1.5811388, 1.581},
+		{0.0000053758, 0.000005376},
+		{-0.0000053758, -0.000005376},
+		{123456.7, 123457},
+		{0, 0},
+	}
+	for _, c := range cases {
+		if v := HalfUp.RoundSignificant(c.val, 4); v != c.expected {
+			t.Errorf("unexpected rounding of %v: %v", c.val, v)
+		}
+	}
+}
+
+func TestParseRoundingMode(t *testing.T) {
+	for _, name := range []string{"half_up", "HALF_EVEN", "floor", "Ceil", "truncate"} {
+		mode, err := ParseRoundingMode(name)
+		if err != nil {
+			t.Error(err)
+		}
+		if mode.String() != strings.ToLower(name) {
+			t.Errorf("unexpected mode %v for %v", mode, name)
+		}
+	}
+	if _, err := ParseRoundingMode("bad"); err == nil {
+		t.Error("unexpected behavior")
+	}
+}
+
+func TestCfg_Buy(t *testing.T) {
+	cfg := stubConfig(t, nil)
+	d := time.Date(2017, 3, 2, 0, 0, 0, 0, time.UTC)
+	// 10000 / (51.2045 / 100)
+	value, err := cfg.Buy(d, 10000, "JPY")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != 19529.53 {
+		t.Errorf("unexpected value: %v", value)
+	}
+	_, err = cfg.Buy(d, 10000, "XYZ")
+	if e, ok := err.(*RateError); !ok || e.HTTPCode != http.StatusBadRequest {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestCfg_MaxCacheAge(t *testing.T) {
+	server, counter := countingServer(t, dailyFile)
+	defer server.Close()
+
+	cfg, err := New(getConfig(), logger, userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.RatesURL = server.URL
+	d := time.Date(2017, 3, 2, 0, 0, 0, 0, time.UTC)
+	// default age is unlimited
+	for i := 0; i < 2; i++ {
+		if _, _, err := cfg.dayRates(context.Background(), d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(counter); n != 1 {
+		t.Fatalf("unexpected number of requests: %v", n)
+	}
+	cfg.maxCacheAge = 10 * time.Millisecond
+	if _, p, err := cfg.dayRates(context.Background(), d); err != nil || !p.Cached {
+		t.Fatalf("unexpected result: %v, %v", p, err)
+	}
+	time.Sleep(2 * cfg.maxCacheAge)
+	if _, p, err := cfg.dayRates(context.Background(), d); err != nil || p.Cached {
+		t.Fatalf("unexpected result: %v, %v", p, err)
+	}
+	if _, p, err := cfg.dayRates(context.Background(), d); err != nil || !p.Cached {
+		t.Fatalf("unexpected result: %v, %v", p, err)
+	}
+	if n := atomic.LoadInt32(counter); n != 2 {
+		t.Errorf("unexpected number of requests: %v", n)
+	}
+}
+
+func TestCfg_GetRatesRatio(t *testing.T) {
+	cfg := stubConfig(t, map[string][]string{"usd": {"$"}, "eur": {"€"}, "jpy": {"¥"}, "rub": {"₽"}})
+	d := time.Date(2017, 3, 2, 0, 0, 0, 0, time.UTC)
+	info, err := cfg.GetRates(d, "1 usd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Rates[0].Ratio != nil {
+		t.Error("unexpected ratio without option")
+	}
+	info, err = cfg.GetRatesWith(d, "100 usd", Options{Ratio: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"usd": "1/1",
+		"eur": "581205/612863",
+		"jpy": "11624100/102409",
+		"rub": "116241/2000",
+	}
+	ratio := info.Rates[0].Ratio
+	if len(ratio) != len(expected) {
+		t.Fatalf("unexpected ratio: %v", ratio)
+	}
+	for code, value := range expected {
+		r := ratio[code]
+		if s := r.Numerator.String() + "/" + r.Denominator.String(); s != value {
+			t.Errorf("unexpected ratio for %v: %v", code, s)
+		}
+	}
+}
+
+func TestCfg_isValid(t *testing.T) {
+	cfg, err := New(getConfig(), logger, userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.isValid(); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Port = 70000
+	cfg.GRPCPort = 100000
+	cfg.CacheSize = 0
+	cfg.Timeout = 0
+	cfg.RatesURL = "ftp://localhost/daily"
+	cfg.CodesURL = "/codes"
+	cfg.Timezone = "Bad/Zone"
+	err = cfg.isValid()
+	configError, ok := err.(ConfigError)
+	if !ok {
+		t.Fatalf("unexpected error type: %T", err)
+	}
+	expected := []string{"port", "grpc_port", "cache", "timeout", "rates_url", "codes_url", "timezone"}
+	if len(configError) != len(expected) {
+		t.Fatalf("unexpected errors: %v", configError)
+	}
+	for i, field := range expected {
+		if f := configError[i].Field; f != field {
+			t.Errorf("unexpected field [%v]: %v", i, f)
+		}
+	}
+}
+
+func TestNewYAML(t *testing.T) {
+	cfg, err := New(getConfig(), logger, userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	yamlCfg, err := New(getConfigFile(yamlFile), logger, userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := json.Marshal(yamlCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != string(expected) {
+		t.Errorf("unexpected YAML configuration: %s", value)
+	}
+	if yamlCfg.location.String() != cfg.location.String() {
+		t.Errorf("unexpected location: %v", yamlCfg.location)
+	}
+}
+
+// businessDayServer returns a test server responding by rates of the requested
+// date or the last business day before it for weekends, and a counter of its requests.
+func businessDayServer(t *testing.T) (*httptest.Server, *int32) {
+	var counter int32
+	data, err := ioutil.ReadFile(dailyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&counter, 1)
+		date, err := time.Parse("02/01/2006", r.FormValue("date_req"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for date.Weekday() == time.Saturday || date.Weekday() == time.Sunday {
+			date = date.AddDate(0, 0, -1)
+		}
+		response := strings.Replace(string(data), `Date="02.03.2017"`, `Date="`+date.Format("02.01.2006")+`"`, 1)
+		w.Header().Set("Content-Type", "application/xml")
+		w.Write([]byte(response))
+	}))
+	return server, &counter
+}
+
+func TestCfg_Calendar(t *testing.T) {
+	server, counter := businessDayServer(t)
+	defer server.Close()
+
+	cfg, err := New(configWith(t, map[string]interface{}{"cache": 10}), logger, userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.RatesURL = server.URL
+	// Thursday - Monday
+	from, to := time.Date(2017, 3, 2, 0, 0, 0, 0, time.UTC), time.Date(2017, 3, 6, 0, 0, 0, 0, time.UTC)
+	days, err := cfg.Calendar(context.Background(), from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []DayStatus{
+		{"2017-03-02", true},
+		{"2017-03-03", true},
+		{"2017-03-04", false},
+		{"2017-03-05", false},
+		{"2017-03-06", true},
+	}
+	if len(days) != len(expected) {
+		t.Fatalf("unexpected result: %v", days)
+	}
+	for i, day := range days {
+		if day != expected[i] {
+			t.Errorf("unexpected day status: %+v", day)
+		}
+	}
+	// the same range is served from the cache
+	hits := atomic.LoadInt32(counter)
+	if _, err = cfg.Calendar(context.Background(), from, to); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(counter); n != hits {
+		t.Errorf("unexpected upstream requests: %v, expected %v", n, hits)
+	}
+	if _, err := cfg.Calendar(context.Background(), to, from); err == nil {
+		t.Error("unexpected behavior")
+	}
+	if _, err := cfg.Calendar(context.Background(), from.AddDate(-2, 0, 0), to); err == nil {
+		t.Error("unexpected behavior")
+	}
+}
+
+func TestCfg_GetRatesBareCurrency(t *testing.T) {
+	cfg := stubConfig(t, map[string][]string{"usd": {"$", "dollar"}, "eur": {"€", "euro"}, "rub": {"₽"}})
+	d := time.Date(2017, 3, 2, 0, 0, 0, 0, time.UTC)
+	info, err := cfg.GetRates(d, "usd, euro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(info.Rates); n != 2 {
+		t.Fatalf("unexpected rates: %v", info.Rates)
+	}
+	if rate := info.Rates[0].Rate; rate["usd"] != 1 || rate["rub"] != 58.12 {
+		t.Errorf("unexpected rate: %v", rate)
+	}
+	if rate := info.Rates[1].Rate; rate["eur"] != 1 || rate["rub"] != 61.29 {
+		t.Errorf("unexpected rate: %v", rate)
+	}
+	info, err = cfg.GetRates(d, "usdx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Rates) != 0 || info.Notice == "" {
+		t.Errorf("unexpected info: %+v", info)
+	}
+}
+
+func TestCfg_GetRatesOrdered(t *testing.T) {
+	cfg := stubConfig(t, map[string][]string{"usd": {"$"}, "eur": {"€"}, "jpy": {"¥"}, "rub": {"₽"}})
+	d := time.Date(2017, 3, 2, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		order    []string
+		expected []string
+	}{
+		{nil, []string{"eur", "jpy", "rub", "usd"}},
+		{[]string{"RUB", "usd", "eur", "jpy"}, []string{"rub", "usd", "eur", "jpy"}},
+		{[]string{"usd", "xyz"}, []string{"usd", "eur", "jpy", "rub"}},
+	}
+	for _, c := range cases {
+		cfg.Order = c.order
+		info, err := cfg.GetRatesWith(d, "10 usd", Options{Ordered: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		values := info.Rates[0].Values
+		if len(values) != len(c.expected) {
+			t.Fatalf("unexpected values: %v", values)
+		}
+		for i, code := range c.expected {
+			if v := values[i]; v.Code != code || v.Value != info.Rates[0].Rate[code] {
+				t.Errorf("unexpected value [%v]: %+v", i, v)
+			}
+		}
+		lines := strings.Split(strings.TrimSpace(info.String()), "\n")[2:]
+		if len(lines) != len(c.expected) {
+			t.Fatalf("unexpected string: %v", info.String())
+		}
+		for i, code := range c.expected {
+			if !strings.HasPrefix(strings.TrimSpace(lines[i]), code+":") {
+				t.Errorf("unexpected string line [%v]: %v", i, lines[i])
+			}
+		}
+	}
+}
+
+func TestCfg_GetRatesRaw(t *testing.T) {
+	cfg := stubConfig(t, map[string][]string{"usd": {"$"}, "eur": {"€"}, "rub": {"₽"}})
+	d := time.Date(2017, 3, 2, 0, 0, 0, 0, time.UTC)
+	info, err := cfg.GetRates(d, "10 usd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Rates[0].Raw != nil {
+		t.Error("unexpected raw values without option")
+	}
+	info, err = cfg.GetRatesWith(d, "10 usd", Options{Raw: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	item := info.Rates[0]
+	if len(item.Raw) != len(item.Rate) {
+		t.Fatalf("unexpected raw values: %v", item.Raw)
+	}
+	for code, value := range item.Rate {
+		raw, ok := item.Raw[code]
+		if !ok {
+			t.Errorf("no raw value for %v", code)
+		}
+		if cfg.Rounding.Round(raw, 2) != value {
+			t.Errorf("inconsistent values for %v: %v, %v", code, value, raw)
+		}
+	}
+	// 581.205 / 61.2863
+	if raw := item.Raw["eur"]; raw == item.Rate["eur"] || raw < 9.4834 || raw > 9.4835 {
+		t.Errorf("unexpected raw value: %v", raw)
+	}
+}
+
+func TestCfg_ParseDate(t *testing.T) {
+	cfg, err := New(getConfig(), logger, userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := time.Date(2017, 3, 2, 0, 0, 0, 0, time.UTC)
+	for _, value := range []string{"2017-03-02", "2017.03.02", "2017/03/02", "20170302", "02.03.2017"} {
+		date, err := cfg.ParseDate(value)
+		if err != nil {
+			t.Errorf("failed parse %v: %v", value, err)
+		}
+		if !date.Equal(expected) {
+			t.Errorf("unexpected date for %v: %v", value, date)
+		}
+	}
+	future := cfg.Today().AddDate(0, 0, 1)
+	bad := []string{"02/03/2017", "02-03-2017", "2017-03.02", "2017032", "2017-13-02", "bad", future.Format("20060102")}
+	for _, value := range bad {
+		if _, err := cfg.ParseDate(value); err == nil {
+			t.Errorf("unexpected behavior for %v", value)
+		}
+	}
+	if date, err := cfg.ParseDate(""); err != nil || !date.Equal(cfg.Today()) {
+		t.Errorf("unexpected default date: %v, %v", date, err)
+	}
+}
+
+// stubProvider is a test rates provider.
+type stubProvider struct {
+	name  string
+	table *RateTable
+	err   error
+}
+
+func (p *stubProvider) Name() string {
+	if p.name == "" {
+		return "stub"
+	}
+	return p.name
+}
+
+func (p *stubProvider) Rates(ctx context.Context, date time.Time) (*RateTable, error) {
+	return p.table, p.err
+}
+
+func TestCfg_ConvertTriangulation(t *testing.T) {
+	cfg, err := New(getConfig(), logger, userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// EUR based provider without direct USD/RUB rate
+	cfg.Provider = &stubProvider{table: &RateTable{
+		Base:  "eur",
+		Rates: map[string]float64{"usd": 0.8, "rub": 0.0125, "bad": 0},
+	}}
+	d := time.Date(2017, 3, 2, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		from, to string
+		expected float64
+	}{
+		{"USD", "RUB", 6400},
+		{"rub", "usd", 1.56},
+		{"eur", "usd", 125},
+		{"usd", "eur", 80},
+		{"usd", "usd", 100},
+	}
+	for _, c := range cases {
+		value, err := cfg.Convert(d, c.from, c.to, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != c.expected {
+			t.Errorf("unexpected value %v->%v: %v", c.from, c.to, value)
+		}
+	}
+	_, err = cfg.Convert(d, "usd", "xyz", 100)
+	if e, ok := err.(*RateError); !ok || e.HTTPCode != http.StatusBadRequest {
+		t.Errorf("unexpected error: %v", err)
+	}
+	_, err = cfg.Convert(d, "usd", "bad", 100)
+	if e, ok := err.(*RateError); !ok || e.HTTPCode != http.StatusInternalServerError {
+		t.Errorf("unexpected error: %v", err)
+	}
+	cfg.Provider = &stubProvider{err: errors.New("failed")}
+	_, err = cfg.Convert(d, "usd", "rub", 100)
+	if e, ok := err.(*RateError); !ok || e.HTTPCode != http.StatusServiceUnavailable {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestCfg_CompareProviders(t *testing.T) {
+	cfg, err := New(getConfig(), logger, userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Provider = &stubProvider{name: "cbr", table: &RateTable{
+		Base:  "rub",
+		Rates: map[string]float64{"usd": 58.1205, "eur": 61.2863},
+	}}
+	// EUR based provider, USD/RUB is triangulated
+	cfg.Fallbacks = []Provider{&stubProvider{name: "ecb", table: &RateTable{
+		Base:  "eur",
+		Rates: map[string]float64{"usd": 0.95, "rub": 0.016},
+	}}}
+	d := time.Date(2017, 3, 2, 0, 0, 0, 0, time.UTC)
+	comparison, err := cfg.CompareProviders(context.Background(), d, "USD", "RUB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if comparison.Date != "2017-03-02" || comparison.Code != "usd" || comparison.Base != "rub" {
+		t.Errorf("unexpected comparison: %+v", comparison)
+	}
+	expected := []ProviderRate{
+		{Provider: "cbr", Source: Source{Name: "cbr"}, Rate: 58.1205},
+		{Provider: "ecb", Source: Source{Name: "ecb"}, Rate: 59.375},
+	}
+	if !reflect.DeepEqual(comparison.Rates, expected) {
+		t.Errorf("unexpected rates: %+v", comparison.Rates)
+	}
+	// normalized to EUR
+	comparison, err = cfg.CompareProviders(context.Background(), d, "usd", "eur")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := comparison.Rates; r[0].Rate != 0.948344 || r[1].Rate != 0.95 {
+		t.Errorf("unexpected rates: %+v", r)
+	}
+	// a failed provider is reported
+	cfg.Fallbacks = []Provider{&stubProvider{name: "ecb", err: errors.New("failed")}}
+	comparison, err = cfg.CompareProviders(context.Background(), d, "usd", "rub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := comparison.Rates; r[0].Rate != 58.1205 || r[1].Rate != 0 || r[1].Error != "get daily rates" {
+		t.Errorf("unexpected rates: %+v", r)
+	}
+	// all providers failed
+	_, err = cfg.CompareProviders(context.Background(), d, "xyz", "rub")
+	if e, ok := err.(*RateError); !ok || e.HTTPCode != http.StatusBadRequest {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestCfg_Table(t *testing.T) {
+	cfg := stubConfig(t, nil)
+	// requested date is after the rates date
+	table, err := cfg.Table(context.Background(), time.Date(2017, 3, 4, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.Date != "2017-03-02" || len(table.Rows) == 0 {
+		t.Fatalf("unexpected table: %+v", table)
+	}
+	rows := make(map[string]TableRow, len(table.Rows))
+	for _, row := range table.Rows {
+		rows[row.Code] = row
+	}
+	jpy := 51.2045
+	if row := rows["JPY"]; row.Nominal != 100 || row.Value != jpy || row.Rate != jpy/100 || row.NumCode != "392" {
+		t.Errorf("unexpected row: %+v", row)
+	}
+	var buf bytes.Buffer
+	if err = table.WriteXLSX(&buf); err != nil {
+		t.Fatal(err)
+	}
+	z, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := make(map[string]string, len(z.File))
+	for _, f := range z.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts[f.Name] = string(data)
+	}
+	for _, name := range []string{"[Content_Types].xml", "_rels/.rels", "xl/workbook.xml", "xl/_rels/workbook.xml.rels"} {
+		if _, ok := parts[name]; !ok {
+			t.Errorf("missing part %v", name)
+		}
+	}
+	sheet := parts["xl/worksheets/sheet1.xml"]
+	expected := []string{
+		`<row r="1"><c r="A1" t="inlineStr"><is><t>Date</t></is></c><c r="B1" t="inlineStr"><is><t>2017-03-02</t></is></c></row>`,
+		`<c r="A2" t="inlineStr"><is><t>Code</t></is></c>`,
+		`<c r="A3" t="inlineStr"><is><t>USD</t></is></c><c r="B3" t="inlineStr"><is><t>840</t></is></c>`,
+		`<c r="E3"><v>58.1205</v></c>`,
+	}
+	for _, e := range expected {
+		if !strings.Contains(sheet, e) {
+			t.Errorf("missing sheet content %v", e)
+		}
+	}
+	if err = xml.Unmarshal([]byte(sheet), new(struct{})); err != nil {
+		t.Errorf("invalid sheet: %v", err)
+	}
+	cells := readXLSX(t, buf.Bytes())
+	expectedCells := map[string]string{"A1": "Date", "B1": "2017-03-02", "A2": "Code", "F2": "Rate, RUB"}
+	for i, row := range table.Rows {
+		n := strconv.Itoa(i + 3)
+		expectedCells["A"+n], expectedCells["B"+n] = row.Code, row.NumCode
+		expectedCells["D"+n] = strconv.FormatUint(uint64(row.Nominal), 10)
+		expectedCells["E"+n] = strconv.FormatFloat(row.Value, 'f', -1, 64)
+	}
+	for ref, value := range expectedCells {
+		if v, ok := cells[ref]; !ok || v != value {
+			t.Errorf("unexpected cell %v: %q, expected %q", ref, v, value)
+		}
+	}
+}
+
+// readXLSX reads the first worksheet of XLSX workbook like spreadsheet applications do:
+// the workbook and worksheet parts are found by package relationships and checked
+// by their content types. It returns cells values by their references.
+func readXLSX(t *testing.T, data []byte) map[string]string {
+	z, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decode := func(name string, v interface{}) {
+		f, err := z.Open(name)
+		if err != nil {
+			t.Fatalf("open part %v: %v", name, err)
+		}
+		defer f.Close()
+		if err = xml.NewDecoder(f).Decode(v); err != nil {
+			t.Fatalf("decode part %v: %v", name, err)
+		}
+	}
+	type relationships struct {
+		Items []struct {
+			ID     string `xml:"Id,attr"`
+			Type   string `xml:"Type,attr"`
+			Target string `xml:"Target,attr"`
+		} `xml:"http://schemas.openxmlformats.org/package/2006/relationships Relationship"`
+	}
+	var types struct {
+		Defaults []struct {
+			Extension   string `xml:"Extension,attr"`
+			ContentType string `xml:"ContentType,attr"`
+		} `xml:"http://schemas.openxmlformats.org/package/2006/content-types Default"`
+		Overrides []struct {
+			PartName    string `xml:"PartName,attr"`
+			ContentType string `xml:"ContentType,attr"`
+		} `xml:"http://schemas.openxmlformats.org/package/2006/content-types Override"`
+	}
+	decode("[Content_Types].xml", &types)
+	contentType := func(name string) string {
+		for _, o := range types.Overrides {
+			if o.PartName == "/"+name {
+				return o.ContentType
+			}
+		}
+		for _, d := range types.Defaults {
+			if strings.HasSuffix(name, "."+d.Extension) {
+				return d.ContentType
+			}
+		}
+		return ""
+	}
+	target := func(rels relationships, base, relType, id string) string {
+		for _, r := range rels.Items {
+			if (id == "" || r.ID == id) && r.Type == relType {
+				return path.Join(path.Dir(base), r.Target)
+			}
+		}
+		t.Fatalf("no relationship %v %v of %v", relType, id, base)
+		return ""
+	}
+	var rels relationships
+	decode("_rels/.rels", &rels)
+	workbookPart := target(rels, "", "http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument", "")
+	if ct := contentType(workbookPart); ct != "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml" {
+		t.Fatalf("unexpected workbook content type: %q", ct)
+	}
+	var workbook struct {
+		Sheets []struct {
+			Name string `xml:"name,attr"`
+			ID   string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+		} `xml:"http://schemas.openxmlformats.org/spreadsheetml/2006/main sheets>sheet"`
+	}
+	decode(workbookPart, &workbook)
+	if len(workbook.Sheets) == 0 {
+		t.Fatal("no worksheets")
+	}
+	decode(path.Join(path.Dir(workbookPart), "_rels", path.Base(workbookPart)+".rels"), &rels)
+	sheetPart := target(rels, workbookPart, "http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet", workbook.Sheets[0].ID)
+	if ct := contentType(sheetPart); ct != "application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml" {
+		t.Fatalf("unexpected worksheet content type: %q", ct)
+	}
+	var sheet struct {
+		Rows []struct {
+			Cells []struct {
+				Ref    string `xml:"r,attr"`
+				Type   string `xml:"t,attr"`
+				Value  string `xml:"v"`
+				Inline string `xml:"is>t"`
+			} `xml:"c"`
+		} `xml:"http://schemas.openxmlformats.org/spreadsheetml/2006/main sheetData>row"`
+	}
+	decode(sheetPart, &sheet)
+	cells := make(map[string]string)
+	for _, row := range sheet.Rows {
+		for _, c := range row.Cells {
+			switch c.Type {
+			case "inlineStr":
+				cells[c.Ref] = c.Inline
+			case "", "n":
+				if _, err := strconv.ParseFloat(c.Value, 64); err != nil {
+					t.Errorf("invalid number of cell %v: %q", c.Ref, c.Value)
+				}
+				cells[c.Ref] = c.Value
+			default:
+				t.Errorf("unexpected type of cell %v: %q", c.Ref, c.Type)
+			}
+		}
+	}
+	return cells
+}
+
+func TestCfg_ConvertReceipt(t *testing.T) {
+	cfg := stubConfig(t, nil)
+	clock := &fixedClock{now: time.Date(2017, 3, 4, 12, 0, 0, 0, time.UTC)}
+	cfg.Clock = clock
+	// requested date is after the rates date
+	d := time.Date(2017, 3, 4, 0, 0, 0, 0, time.UTC)
+	receipt, err := cfg.ConvertReceipt(d, "USD", "eur", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Receipt{
+		Amount:    100,
+		From:      "usd",
+		To:        "eur",
+		Rate:      58.1205 / 61.2863,
+		Result:    94.83,
+		Date:      "2017-03-02",
+		FetchedAt: clock.now,
+	}
+	if *receipt != expected {
+		t.Errorf("unexpected receipt: %+v", receipt)
+	}
+	// cached rates keep fetch time
+	clock.now = clock.now.Add(time.Minute)
+	receipt, err = cfg.ConvertReceipt(d, "usd", "usd", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receipt.Rate != 1 || receipt.Result != 100 || !receipt.FetchedAt.Equal(expected.FetchedAt) {
+		t.Errorf("unexpected receipt: %+v", receipt)
+	}
+	// overflowed result
+	_, err = cfg.ConvertReceipt(d, "usd", "jpy", math.MaxFloat64)
+	if e, ok := err.(*RateError); !ok || e.HTTPCode != http.StatusBadRequest {
+		t.Errorf("unexpected error: %v", err)
+	}
+	// provider without date and fetch time
+	cfg.Provider = &stubProvider{table: &RateTable{Base: "rub", Rates: map[string]float64{"usd": 60}}}
+	receipt, err = cfg.ConvertReceipt(d, "usd", "rub", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = Receipt{Amount: 2, From: "usd", To: "rub", Rate: 60, Result: 120, Date: "2017-03-04", FetchedAt: clock.now}
+	if *receipt != expected {
+		t.Errorf("unexpected receipt: %+v", receipt)
+	}
+	if _, err = cfg.ConvertReceipt(d, "xyz", "rub", 2); err == nil {
+		t.Error("unexpected behavior for unknown currency")
+	}
+}
+
+func TestProvenance_Age(t *testing.T) {
+	cfg := stubConfig(t, nil)
+	d := time.Date(2017, 3, 2, 0, 0, 0, 0, time.UTC)
+	_, p, err := cfg.dayRates(context.Background(), d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if age := p.Age(); age < 0 || age > time.Second {
+		t.Errorf("unexpected age of fetched data: %v", age)
+	}
+	// make cached entry older
+	v, ok := cfg.cache.Get(d.Format("02/01/2006"))
+	if !ok {
+		t.Fatal("no cached entry")
+	}
+	v.(*dayEntry).fetched = time.Now().Add(-time.Hour)
+	_, p, err = cfg.dayRates(context.Background(), d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if age := p.Age(); !p.Cached || age < time.Hour || age > time.Hour+time.Second {
+		t.Errorf("unexpected age of cached data: %v", age)
+	}
+}
+
+func TestCfg_Transport(t *testing.T) {
+	cfg, err := New(getConfig(), logger, userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := cfg.httpClient.Transport.(*http.Transport)
+	if tr.TLSHandshakeTimeout != 10*time.Second || tr.IdleConnTimeout != 10*time.Second {
+		t.Errorf("unexpected default timeouts: %v, %v", tr.TLSHandshakeTimeout, tr.IdleConnTimeout)
+	}
+	cfg.DialTimeout, cfg.TLSTimeout, cfg.IdleTimeout = 3, 5, 60
+	client, err := cfg.newClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr = client.Transport.(*http.Transport)
+	if tr.TLSHandshakeTimeout != 5*time.Second || tr.IdleConnTimeout != 60*time.Second {
+		t.Errorf("unexpected timeouts: %v, %v", tr.TLSHandshakeTimeout, tr.IdleConnTimeout)
+	}
+	if tr.DialContext == nil {
+		t.Error("empty dialer")
+	}
+	cfg.TLSTimeout = -1
+	if err := cfg.isValid(); err == nil {
+		t.Error("negative timeout is valid")
+	}
+}
+
+func TestCfg_HedgeDelay(t *testing.T) {
+	data, err := ioutil.ReadFile(dailyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var requests, cancelled int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the first request is slow
+		if atomic.AddInt32(&requests, 1) == 1 {
+			select {
+			case <-time.After(5 * time.Second):
+			case <-r.Context().Done():
+				atomic.AddInt32(&cancelled, 1)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	cfg, err := New(getConfig(), logger, userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.RatesURL = server.URL
+	cfg.hedgeDelay = 50 * time.Millisecond
+	d := time.Date(2017, 3, 2, 0, 0, 0, 0, time.UTC)
+	start := time.Now()
+	dayInfo, _, err := cfg.dayRates(context.Background(), d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("hedged request is slow: %v", elapsed)
+	}
+	if dayInfo.Date != "02.03.2017" || len(dayInfo.Items) != 3 {
+		t.Errorf("unexpected rates: %+v", dayInfo)
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("unexpected number of requests: %v", n)
+	}
+	// the slow request is cancelled
+	for i := 0; i < 100 && atomic.LoadInt32(&cancelled) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&cancelled); n != 1 {
+		t.Errorf("slow request is not cancelled: %v", n)
+	}
+	// fast response doesn't need hedging
+	if _, _, err = cfg.dayRates(context.Background(), d.AddDate(0, 0, -1)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * cfg.hedgeDelay)
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Errorf("unexpected number of requests: %v", n)
+	}
+	cfg.HedgeDelay = -1
+	if err = cfg.isValid(); err == nil {
+		t.Error("negative hedge delay is valid")
+	}
+}
+
+func TestCfg_CacheMemory(t *testing.T) {
+	server, counter := countingServer(t, dailyFile)
+	defer server.Close()
+
+	cfg, err := New(getConfig(), logger, userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.RatesURL = server.URL
+	// the configured cache has only one entry
+	if cfg.cache, err = lru.NewWithEvict(10, cfg.evictRates); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	d := time.Date(2017, 3, 2, 0, 0, 0, 0, time.UTC)
+	if _, _, err = cfg.dayRates(ctx, d); err != nil {
+		t.Fatal(err)
+	}
+	size := cfg.cacheBytes
+	if size < 100 {
+		t.Fatalf("unexpected entry size: %v", size)
+	}
+	// two entries fit the budget
+	cfg.CacheMemory = 2*size + size/2
+	for i := 1; i < 3; i++ {
+		if _, _, err = cfg.dayRates(ctx, d.AddDate(0, 0, -i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := cfg.cache.Len(); n != 2 || cfg.cacheBytes != 2*size {
+		t.Errorf("unexpected cache state: %v entries, %v bytes", n, cfg.cacheBytes)
+	}
+	atomic.StoreInt32(counter, 0)
+	// the oldest one is evicted
+	if _, _, err = cfg.dayRates(ctx, d); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = cfg.dayRates(ctx, d.AddDate(0, 0, -2)); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(counter); n != 1 {
+		t.Errorf("unexpected number of requests: %v", n)
+	}
+	// an entry exceeding the budget is kept
+	cfg.CacheMemory = size / 2
+	if _, _, err = cfg.dayRates(ctx, d.AddDate(0, 0, -3)); err != nil {
+		t.Fatal(err)
+	}
+	if n := cfg.cache.Len(); n != 1 || cfg.cacheBytes != size {
+		t.Errorf("unexpected cache state: %v entries, %v bytes", n, cfg.cacheBytes)
+	}
+	cfg.CacheMemory = -1
+	if err = cfg.isValid(); err == nil {
+		t.Error("negative cache memory is valid")
+	}
+}
+
+func TestCfg_CompressAlgorithms(t *testing.T) {
+	cfg, err := New(getConfig(), logger, userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.CompressMinSize != 0 || !reflect.DeepEqual(cfg.CompressAlgorithms, []string{CompressGzip}) {
+		t.Errorf("unexpected compression defaults: %v, %v", cfg.CompressMinSize, cfg.CompressAlgorithms)
+	}
+	cfg.CompressAlgorithms = []string{CompressDeflate, "br"}
+	if err = cfg.isValid(); err == nil {
+		t.Error("unsupported algorithm is valid")
+	}
+	cfg.CompressAlgorithms, cfg.CompressMinSize = nil, -1
+	if err = cfg.isValid(); err == nil {
+		t.Error("negative size is valid")
+	}
+}
+
+func TestCfg_Redirects(t *testing.T) {
+	data, err := ioutil.ReadFile(dailyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old" {
+			http.Redirect(w, r, "/new?"+r.URL.RawQuery, http.StatusMovedPermanently)
+			return
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	var buf bytes.Buffer
+	cfg, err := New(getConfig(), logger, userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a test logger, New redirects output of the shared one in debug mode
+	cfg.logger = log.New(&buf, "", 0)
+	cfg.RatesURL = server.URL + "/old"
+	d := time.Date(2017, 3, 2, 0, 0, 0, 0, time.UTC)
+	if _, _, err = cfg.dayRates(context.Background(), d); err != nil {
+		t.Fatal(err)
+	}
+	if out := buf.String(); !strings.Contains(out, "redirect "+server.URL+"/old") {
+		t.Errorf("redirect is not logged: %v", out)
+	}
+	cfg.MaxRedirects = -1
+	if _, _, err = cfg.dayRates(context.Background(), d.AddDate(0, 0, -1)); err == nil {
+		t.Error("unexpected behavior for denied redirect")
+	}
+	cfg.RatesURL = server.URL + "/new"
+	if _, _, err = cfg.dayRates(context.Background(), d.AddDate(0, 0, -1)); err != nil {
+		t.Errorf("failed request without redirect: %v", err)
+	}
+}
+
+func TestCfg_GetRatesTrend(t *testing.T) {
+	data, err := ioutil.ReadFile(dailyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	monday := time.Date(2017, 3, 6, 0, 0, 0, 0, time.UTC)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		date, err := time.Parse("02/01/2006", r.FormValue("date_req"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for date.Weekday() == time.Saturday || date.Weekday() == time.Sunday {
+			date = date.AddDate(0, 0, -1)
+		}
+		response := strings.Replace(string(data), `Date="02.03.2017"`, `Date="`+date.Format("02.01.2006")+`"`, 1)
+		if date.Before(monday) {
+			// Friday: USD is cheaper, JPY is more expensive
+			response = strings.NewReplacer("58,1205", "57,9000", "51,2045", "52,0000").Replace(response)
+		}
+		if date.Equal(monday.AddDate(0, 0, 4)) {
+			// next Friday: EUR is absent
+			i, j := strings.Index(response, `<Valute ID="R01239">`), strings.Index(response, `<Valute ID="R01820">`)
+			response = response[:i] + response[j:]
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		w.Write([]byte(response))
+	}))
+	defer server.Close()
+
+	cfg, err := New(getConfig(), logger, userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.RatesURL = server.URL
+	cfg.CacheSize = 10
+	err = cfg.SetRequiredCodes(map[string][]string{"usd": {"$"}, "eur": {"€"}, "jpy": {"¥"}, "rub": {"₽"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := cfg.GetRatesWith(monday, "1 usd", Options{Trend: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"usd": TrendUp, "eur": TrendFlat, "jpy": TrendDown, "rub": TrendFlat}
+	for code, value := range expected {
+		if v := info.Trend[code]; v != value {
+			t.Errorf("unexpected trend of %v: %v", code, v)
+		}
+	}
+	info, err = cfg.GetRates(monday, "1 usd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Trend != nil {
+		t.Errorf("unexpected trend: %v", info.Trend)
+	}
+	// a currency absent on the previous day has no trend instead of growth from zero
+	info, err = cfg.GetRatesWith(monday.AddDate(0, 0, 7), "1 usd", Options{Trend: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = map[string]string{"usd": TrendFlat, "jpy": TrendFlat, "rub": TrendFlat}
+	if !reflect.DeepEqual(info.Trend, expected) {
+		t.Errorf("unexpected trend: %v", info.Trend)
+	}
+}
+
+func TestCfg_RetryBudget(t *testing.T) {
+	data, err := ioutil.ReadFile(dailyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		mu       sync.Mutex
+		attempts = make(map[string]int)
+		total    int
+	)
+	// every date fails twice before success
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		date := r.FormValue("date_req")
+		attempts[date]++
+		n := attempts[date]
+		total++
+		mu.Unlock()
+		if n < 3 {
+			http.Error(w, "try again", http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	cfg, err := New(getConfig(), logger, userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.RatesURL = server.URL
+	cfg.CacheSize = 10
+	cfg.Retries = 3
+	cfg.RetryBudget = 4
+	cfg.RangeWorkers = 1
+	cfg.retryDelay = time.Millisecond
+	from, to := time.Date(2017, 2, 27, 0, 0, 0, 0, time.UTC), time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC)
+	if _, err := cfg.Calendar(context.Background(), from, to); err == nil {
+		t.Error("unexpected behavior")
+	}
+	// 3 + 3 attempts for two dates, the third one has no retries
+	if total != 7 {
+		t.Errorf("unexpected number of attempts: %v", total)
+	}
+	cfg.RetryBudget = 0
+	total, attempts = 0, make(map[string]int)
+	cfg.cache.Purge()
+	if _, err := cfg.Calendar(context.Background(), from, to); err != nil {
+		t.Fatal(err)
+	}
+	if total != 9 {
+		t.Errorf("unexpected number of attempts: %v", total)
+	}
+}
+
+func TestCfg_Retries(t *testing.T) {
+	data, err := ioutil.ReadFile(dailyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		mu     sync.Mutex
+		status int
+		body   []byte
+		total  int
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		total++
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(status)
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	cfg, err := New(getConfig(), logger, userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.retryDelay != defaultRetryDelay*time.Millisecond {
+		t.Errorf("unexpected default retry delay: %v", cfg.retryDelay)
+	}
+	cfg.RatesURL = server.URL
+	cfg.Retries = 2
+	cfg.retryDelay = 20 * time.Millisecond
+	d := time.Date(2017, 3, 2, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		status   int
+		body     []byte
+		attempts int
+	}{
+		{http.StatusServiceUnavailable, nil, 3},
+		{http.StatusNotFound, nil, 1},
+		{http.StatusOK, []byte("<ValCurs"), 1},
+	}
+	for i, c := range cases {
+		status, body, total = c.status, c.body, 0
+		start := time.Now()
+		if _, _, err = cfg.dayRates(context.Background(), d); err == nil {
+			t.Errorf("unexpected behavior of case %v", i)
+		}
+		if total != c.attempts {
+			t.Errorf("unexpected number of attempts of case %v: %v", i, total)
+		}
+		// delays are 20ms and 40ms
+		if elapsed := time.Since(start); c.attempts > 1 && elapsed < 60*time.Millisecond {
+			t.Errorf("unexpected retries without backoff of case %v: %v", i, elapsed)
+		}
+	}
+	// canceled context stops backoff
+	status, body, total = http.StatusServiceUnavailable, nil, 0
+	cfg.retryDelay = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, _, err = cfg.dayRates(ctx, d); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if total != 1 {
+		t.Errorf("unexpected number of attempts: %v", total)
+	}
+	status, body, total = http.StatusOK, data, 0
+	if _, _, err = cfg.dayRates(context.Background(), d); err != nil {
+		t.Fatal(err)
+	}
+	cfg.RetryDelay = -1
+	if err = cfg.isValid(); err == nil {
+		t.Error("negative retry delay is valid")
+	}
+}
+
+func TestMarshalInfo(t *testing.T) {
+	cfg := stubConfig(t, map[string][]string{"usd": {"$"}, "eur": {"€"}, "rub": {"₽"}})
+	d := time.Date(2017, 3, 2, 0, 0, 0, 0, time.UTC)
+	info, err := cfg.GetRatesWith(d, "10 usd, 5 eur", Options{Ratio: true, Ordered: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := MarshalInfo(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := UnmarshalInfo(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := json.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := json.Marshal(decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(expected) != string(result) {
+		t.Errorf("unexpected decoded info: %s", result)
+	}
+	if p := decoded.Provenance; p == nil || p.URL != info.Provenance.URL {
+		t.Errorf("unexpected provenance: %+v", p)
+	}
+	if _, err := UnmarshalInfo(data[:len(data)/2]); err == nil {
+		t.Error("unexpected behavior")
+	}
+}
+
+func TestCfg_AliasBoundaries(t *testing.T) {
+	cfg, err := New(getConfig(), logger, userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes := map[string][]string{"rub": {"₽", "руб"}, "usd": {"$", "dollar"}}
+	if err = cfg.SetRequiredCodes(codes); err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]string{
+		"scrub 5":      "",
+		"scrubber":     "",
+		"сруб 5":       "",
+		"rub 5":        "rub",
+		"5 rub":        "rub",
+		"5rub":         "rub",
+		"руб 5":        "rub",
+		"5 rub.":       "rub",
+		"x$5":          "usd",
+		"price: usd 5": "usd",
+		"5 dollar":     "usd",
+		"5 dollars":    "",
+		"5 rubber":     "",
+		"10 рублей":    "",
+	}
+	for msg, expected := range cases {
+		if p := cfg.parseMsg([]string{msg}); p[0].currency != expected {
+			t.Errorf("unexpected currency for %q: %+v", msg, p[0])
+		}
+	}
+	cfg.PrefixAliases = true
+	if err = cfg.SetRequiredCodes(codes); err != nil {
+		t.Fatal(err)
+	}
+	cases["5 dollars"], cases["5 rubber"], cases["10 рублей"] = "usd", "rub", "rub"
+	for msg, expected := range cases {
+		if p := cfg.parseMsg([]string{msg}); p[0].currency != expected {
+			t.Errorf("unexpected currency with prefix aliases for %q: %+v", msg, p[0])
+		}
+	}
+}
+
+func TestCfg_Suggestions(t *testing.T) {
+	cfg := stubConfig(t, map[string][]string{"usd": {"$", "dollar"}, "eur": {"€", "euro"}, "rub": {"₽", "руб"}})
+	d := time.Date(2017, 3, 2, 0, 0, 0, 0, time.UTC)
+	info, err := cfg.GetRates(d, "10 dollr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Suggestions) == 0 || info.Suggestions[0] != (Suggestion{Alias: "dollar", Code: "usd"}) {
+		t.Errorf("unexpected suggestions: %+v", info.Suggestions)
+	}
+	info, err = cfg.GetRates(d, "5 eru")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// "eur" needs one edit, "euro" and "rub" need two ones
+	expected := []Suggestion{{Alias: "eur", Code: "eur"}, {Alias: "euro", Code: "eur"}, {Alias: "rub", Code: "rub"}}
+	if !reflect.DeepEqual(info.Suggestions, expected) {
+		t.Errorf("unexpected suggestions: %+v", info.Suggestions)
+	}
+	if info, err = cfg.GetRates(d, "10 abcdef"); err != nil || len(info.Suggestions) != 0 {
+		t.Errorf("unexpected suggestions: %+v, %v", info, err)
+	}
+	// not recognized message of the query
+	_, err = cfg.GetRates(d, "10 usd, 3 dolar")
+	if e, ok := err.(*RateError); !ok || e.HTTPCode != http.StatusBadRequest ||
+		e.Msg != `unknown currency of "3 dolar", did you mean: dollar (usd)` {
+		t.Errorf("unexpected error: %v", err)
+	}
+	cfg.StrictEmpty = true
+	_, err = cfg.GetRates(d, "10 dollr")
+	if e, ok := err.(*RateError); !ok || !strings.HasPrefix(e.Msg, emptyResultMsg+", did you mean: dollar (usd)") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	// words are folded like aliases
+	cfg.FoldDiacritics = true
+	if err = cfg.SetRequiredCodes(map[string][]string{"mxn": {"peso"}, "jpy": {"йена"}}); err != nil {
+		t.Fatal(err)
+	}
+	expected = []Suggestion{{Alias: "peso", Code: "mxn"}}
+	if s := cfg.suggest([]parsedMsg{{msg: "5 pésós"}}); !reflect.DeepEqual(s, expected) {
+		t.Errorf("unexpected suggestions: %+v", s)
+	}
+	expected = []Suggestion{{Alias: "йена", Code: "jpy"}}
+	if s := cfg.suggest([]parsedMsg{{msg: "5 ЙЕНЫ"}}); !reflect.DeepEqual(s, expected) {
+		t.Errorf("unexpected suggestions: %+v", s)
+	}
+}
+
+func TestLevenshtein(t *testing.T) {
+	cases := []struct {
+		a, b     string
+		expected int
+	}{
+		{"", "", 0},
+		{"dollr", "dollar", 1},
+		{"kitten", "sitting", 3},
+		{"рубь", "руб", 1},
+		{"usd", "", 3},
+	}
+	for _, c := range cases {
+		if d := levenshtein(c.a, c.b); d != c.expected {
+			t.Errorf("unexpected distance of %q and %q: %v", c.a, c.b, d)
+		}
+	}
+}
+
+func TestCfg_ParseMsgUnicode(t *testing.T) {
+	cfg, err := New(getConfig(), logger, userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// decomposed "йена" and "café": base letters and combining marks
+	codes := map[string][]string{"jpy": {"\u0438\u0306\u0435\u043d\u0430"}, "eur": {"cafe\u0301"}}
+	if err = cfg.SetRequiredCodes(codes); err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]string{
+		// precomposed letters
+		"10 \u0439\u0435\u043d\u0430": "jpy",
+		"\u0419\u0435\u043d\u0430 10": "jpy",
+		"5 caf\u00e9":                 "eur",
+		"5 cafe\u0301":                "eur",
+		"10 \u0438\u0435\u043d\u0430": "",
+		"5 cafe":                      "",
+	}
+	for msg, expected := range cases {
+		if p := cfg.parseMsg([]string{msg}); p[0].currency != expected {
+			t.Errorf("unexpected currency for %q: %+v", msg, p[0])
+		}
+	}
+	cfg.FoldDiacritics = true
+	if err = cfg.SetRequiredCodes(codes); err != nil {
+		t.Fatal(err)
+	}
+	// "й" is a separate letter, it isn't folded to "и"
+	cases["5 cafe"] = "eur"
+	for msg, expected := range cases {
+		if p := cfg.parseMsg([]string{msg}); p[0].currency != expected || p[0].msg != msg {
+			t.Errorf("unexpected currency for %q with folding: %+v", msg, p[0])
+		}
+	}
+}
+
+func TestCfg_CleanQueries(t *testing.T) {
+	cfg, err := New(getConfig(), logger, userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Locale = Russian
+	cfg.PrefixAliases = true
+	codes := map[string][]string{"usd": {"$", "доллар"}, "rub": {"у.е."}}
+	if err = cfg.SetRequiredCodes(codes); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		msg      string
+		currency string
+		value    float64
+		dirty    bool
+	}{
+		{"100\u00a0usd", "usd", 100, false},
+		{"1\u00a0000,5\u202fusd", "usd", 1000.5, false},
+		{"  100 \t usd  ", "usd", 100, false},
+		{"(100) usd", "usd", 100, true},
+		{"100! usd?!", "usd", 100, true},
+		{"100 долларов.", "usd", 100, false},
+		{"usd 100.", "usd", 100, false},
+		{"«$100»", "usd", 100, false},
+		{"5 у.е.", "rub", 5, false},
+	}
+	for _, c := range cases {
+		p := cfg.parseMsg([]string{c.msg})[0]
+		if ok := p.currency == c.currency && p.value == c.value; ok == c.dirty {
+			t.Errorf("unexpected result without cleaning for %q: %+v", c.msg, p)
+		}
+	}
+	cfg.CleanQueries = true
+	for _, c := range cases {
+		p := cfg.parseMsg([]string{c.msg})[0]
+		if p.currency != c.currency || p.value != c.value || p.msg != strings.TrimSpace(c.msg) {
+			t.Errorf("unexpected result for %q: %+v", c.msg, p)
+		}
+	}
+	cleaned := map[string]string{
+		"\u00a0(100\u00a0usd)!\u00a0": "100 usd",
+		"100 usd . ":                  "100 usd",
+		"5 у.е.":                      "5 у.е.",
+		"?!":                          "",
+		"":                            "",
+	}
+	for msg, expected := range cleaned {
+		if result := cleanMsg(msg); result != expected {
+			t.Errorf("unexpected cleaned message for %q: %q", msg, result)
+		}
+	}
+}
+
+func TestFormatValue(t *testing.T) {
+	cases := []struct {
+		code     string
+		value    float64
+		expected string
+	}{
+		{"usd", 1234.56, "$1,234.56"},
+		{"EUR", 1234.56, "1.234,56\u00a0€"},
+		{"rub", 1234.56, "1\u00a0234,56\u00a0₽"},
+		{"gbp", 0.5, "£0.50"},
+		{"jpy", 1234.56, "¥1,235"},
+		{"cad", 1234.56, "1,234.56\u00a0CAD"},
+		{"xyz", 1234.567, "1,234.57\u00a0XYZ"},
+	}
+	for _, c := range cases {
+		if v := FormatValue(c.code, c.value); v != c.expected {
+			t.Errorf("unexpected format of %v %v: %q", c.value, c.code, v)
+		}
+	}
+	scales := map[int]string{-1: "$1,234.57", 0: "$1,235", 3: "$1,234.567"}
+	for scale, expected := range scales {
+		if v := FormatValueScale("usd", 1234.567, scale); v != expected {
+			t.Errorf("unexpected format with scale %v: %q", scale, v)
+		}
+	}
+}
+
+func TestCfg_GetRatesRange(t *testing.T) {
+	data, err := ioutil.ReadFile(dailyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var active, maxActive int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&active, 1)
+		defer atomic.AddInt32(&active, -1)
+		for {
+			m := atomic.LoadInt32(&maxActive)
+			if n <= m || atomic.CompareAndSwapInt32(&maxActive, m, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/xml")
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	cfg, err := New(getConfig(), logger, userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.RatesURL = server.URL
+	err = cfg.SetRequiredCodes(map[string][]string{"usd": {"$"}, "rub": {"₽"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	from, to := time.Date(2017, 2, 1, 0, 0, 0, 0, time.UTC), time.Date(2017, 2, 20, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		workers  int
+		upstream int
+		limit    int32
+	}{
+		{3, 8, 3},
+		{8, 2, 2},
+	}
+	for _, c := range cases {
+		cfg.RangeWorkers = c.workers
+		cfg.upstream = make(chan struct{}, c.upstream)
+		cfg.cache.Purge()
+		atomic.StoreInt32(&maxActive, 0)
+		result, err := cfg.GetRatesRange(context.Background(), from, to, "1 usd", Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := atomic.LoadInt32(&maxActive); n < 2 || n > c.limit {
+			t.Errorf("unexpected number of concurrent requests: %v", n)
+		}
+		if len(result) != 20 {
+			t.Fatalf("unexpected result length: %v", len(result))
+		}
+		for i, info := range result {
+			if d := from.AddDate(0, 0, i).Format("2006-01-02"); info.Date != d {
+				t.Errorf("unexpected date [%v]: %v", i, info.Date)
+			}
+		}
+	}
+	if _, err := cfg.GetRatesRange(context.Background(), to, from, "1 usd", Options{}); err == nil {
+		t.Error("unexpected behavior")
+	}
+}
+
+func TestCfg_Headers(t *testing.T) {
+	var headers []http.Header
+	mux := http.NewServeMux()
+	for path, name := range map[string]string{"/daily": dailyFile, "/codes": codesFile} {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			headers = append(headers, r.Header)
+			w.Header().Set("Content-Type", "application/xml")
+			w.Write(data)
+		})
+	}
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	cfg, err := New(getConfig(), logger, userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.RatesURL = server.URL + "/daily"
+	cfg.CodesURL = server.URL + "/codes"
+	cfg.Headers = map[string]string{"Accept": "application/xml", "From": "admin@example.com", "User-Agent": "custom"}
+	if _, _, err := cfg.dayRates(context.Background(), time.Date(2017, 3, 2, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfg.GetCodes(); err != nil {
+		t.Fatal(err)
+	}
+	if len(headers) != 2 {
+		t.Fatalf("unexpected number of requests: %v", len(headers))
+	}
+	for _, h := range headers {
+		if h.Get("Accept") != "application/xml" || h.Get("From") != "admin@example.com" || h.Get("User-Agent") != userAgent {
+			t.Errorf("unexpected headers: %v", h)
+		}
+	}
+	cfg.Headers = map[string]string{"Bad Name": "value"}
+	if err := cfg.isValid(); err == nil {
+		t.Error("invalid header is valid")
+	}
+}
+
+func TestCfg_GetRatesBasket(t *testing.T) {
+	cfg := stubConfig(t, map[string][]string{"usd": {"$"}, "eur": {"€"}, "rub": {"₽"}})
+	d := time.Date(2017, 3, 2, 0, 0, 0, 0, time.UTC)
+	basket, err := ParseBasket("USD:0.5, eur:0.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := cfg.GetRatesWith(d, "1 usd", Options{Basket: basket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// basket is 0.5 * 58.1205 + 0.5 * 61.2863 = 59.7034 rub
+	expected := map[string]float64{"usd": 0.9735, "eur": 1.0265, "rub": 0.0167}
+	for code, value := range expected {
+		if v := info.Basket[code]; v != value {
+			t.Errorf("unexpected basket value of %v: %v", code, v)
+		}
+	}
+	_, err = cfg.GetRatesWith(d, "1 usd", Options{Basket: Basket{"usd": 0.5, "xyz": 0.5}})
+	if e, ok := err.(*RateError); !ok || e.HTTPCode != http.StatusBadRequest {
+		t.Errorf("unexpected error: %v", err)
+	}
+	for _, value := range []string{"usd:0.5,eur:0.4", "usd:1.5,eur:-0.5", "usd", "usd:0.5,usd:0.5", "usd:abc", ""} {
+		if _, err := ParseBasket(value); err == nil {
+			t.Errorf("unexpected behavior for %q", value)
+		}
+	}
+	if _, err := ParseBasket("usd:0.3333333,eur:0.3333333,cny:0.3333334"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCfg_LogBody(t *testing.T) {
+	body := `<?xml version="1.0" encoding="UTF-8"?><ValCurs Date="02.03.2017"><Valute>` + strings.Repeat("x", 100)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/xml")
+		io.WriteString(w, body)
+	}))
+	defer server.Close()
+
+	var buf bytes.Buffer
+	cfg, err := New(getConfig(), logger, userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.logger = log.New(&buf, "", 0)
+	cfg.RatesURL = server.URL
+	cfg.CodesURL = server.URL
+	cfg.LogBodySize = 60
+	d := time.Date(2017, 3, 2, 0, 0, 0, 0, time.UTC)
+	if _, _, err = cfg.dayRates(context.Background(), d); err == nil {
+		t.Fatal("unexpected behavior for broken XML")
+	}
+	out := buf.String()
+	if expected := fmt.Sprintf("body: %q\n", body[:60]); !strings.Contains(out, expected) {
+		t.Errorf("unexpected log: %v", out)
+	}
+	buf.Reset()
+	if _, err = cfg.GetCodes(); err == nil {
+		t.Fatal("unexpected behavior for broken XML")
+	}
+	if out := buf.String(); !strings.Contains(out, "decode response of "+server.URL) {
+		t.Errorf("unexpected log: %v", out)
+	}
+	// not debug mode
+	cfg.Debug = false
+	buf.Reset()
+	if _, err = cfg.GetCodes(); err == nil {
+		t.Fatal("unexpected behavior for broken XML")
+	}
+	if out := buf.String(); strings.Contains(out, "body:") {
+		t.Errorf("body is logged: %v", out)
+	}
+	cfg.LogBodySize = -1
+	if err = cfg.isValid(); err == nil {
+		t.Error("negative log body size is valid")
+	}
+}
+
+// seriesProvider is a provider of rates tables by dates YYYY-MM-DD.
+type seriesProvider map[string]*RateTable
+
+func (p seriesProvider) Name() string {
+	return "series"
+}
+
+func (p seriesProvider) Rates(ctx context.Context, date time.Time) (*RateTable, error) {
+	table, ok := p[date.Format("2006-01-02")]
+	if !ok {
+		return nil, fmt.Errorf("no rates of %v", date.Format("2006-01-02"))
+	}
+	return table, nil
+}
+
+func TestCfg_VolatilityCross(t *testing.T) {
+	cfg, err := New(getConfig(), logger, userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Monday - Friday, weekend is absent
+	provider := seriesProvider{}
+	for i, usd := range []float64{60, 61, 62, 63, 64} {
+		date := time.Date(2017, 2, 27+i, 0, 0, 0, 0, time.UTC).Format("2006-01-02")
+		// jpy/usd is a low value with more than 6 decimal places
+		jpy := usd * (0.0088 + float64(i)*0.0000034)
+		provider[date] = &RateTable{Base: "rub", Rates: map[string]float64{"usd": usd, "eur": 2 * usd, "jpy": jpy}}
+	}
+	cfg.Provider = provider
+	from := time.Date(2017, 2, 27, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2017, 3, 5, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		a, b     string
+		expected float64
+	}{
+		{"usd", "rub", 1.58114}, // sqrt(10/4)
+		{"eur", "usd", 0},
+		{"jpy", "usd", 0.00000537587}, // 0.000006 for rates rounded to 6 decimal places
+	}
+	for _, c := range cases {
+		v, err := cfg.VolatilityCross(c.a, c.b, from, to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != c.expected {
+			t.Errorf("unexpected volatility %v/%v: %v", c.a, c.b, v)
+		}
+	}
+	// Wednesday is a holiday
+	if err = cfg.SetHolidays([]string{"2017-03-01"}); err != nil {
+		t.Fatal(err)
+	}
+	v, err := cfg.VolatilityCross("usd", "rub", from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != 1.82574 { // sqrt(10/3)
+		t.Errorf("unexpected volatility with holiday: %v", v)
+	}
+	// insufficient data points
+	ranges := [][2]time.Time{
+		{time.Date(2017, 3, 4, 0, 0, 0, 0, time.UTC), to},
+		{time.Date(2017, 3, 3, 0, 0, 0, 0, time.UTC), to},
+	}
+	for _, r := range ranges {
+		_, err = cfg.VolatilityCross("usd", "rub", r[0], r[1])
+		if rateErr, ok := err.(*RateError); !ok || rateErr.HTTPCode != http.StatusBadRequest {
+			t.Errorf("unexpected error for %v - %v: %v", r[0], r[1], err)
+		}
+	}
+	if _, err = cfg.VolatilityCross("usd", "xyz", from, to); err == nil {
+		t.Error("unexpected behavior for unknown currency")
+	}
+}
+
+func TestCfg_TimeWeightedAverage(t *testing.T) {
+	cfg, err := New(getConfig(), logger, userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Thursday - Monday, weekend is absent
+	provider := seriesProvider{}
+	for day, usd := range map[int]float64{2: 60, 3: 64, 6: 70} {
+		date := time.Date(2017, 3, day, 0, 0, 0, 0, time.UTC).Format("2006-01-02")
+		provider[date] = &RateTable{Base: "rub", Rates: map[string]float64{"usd": usd}}
+	}
+	cfg.Provider = provider
+	thursday := time.Date(2017, 3, 2, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		from, to time.Time
+		expected float64
+	}{
+		// Friday rate is effective 3 days: (60 + 3*64 + 70) / 5
+		{thursday, thursday.AddDate(0, 0, 4), 64.4},
+		{thursday, thursday.AddDate(0, 0, 1), 62},
+		// Saturday - Monday: (2*64 + 70) / 3
+		{thursday.AddDate(0, 0, 2), thursday.AddDate(0, 0, 4), 66},
+		{thursday.AddDate(0, 0, 3), thursday.AddDate(0, 0, 3), 64},
+	}
+	for _, c := range cases {
+		v, err := cfg.TimeWeightedAverage("usd", c.from, c.to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != c.expected {
+			t.Errorf("unexpected average %v - %v: %v", c.from, c.to, v)
+		}
+	}
+	// Thursday rate is effective till Monday with the Friday holiday: (4*60 + 70) / 5
+	if err = cfg.SetHolidays([]string{"2017-03-03"}); err != nil {
+		t.Fatal(err)
+	}
+	provider["2017-03-03"] = &RateTable{Base: "rub", Rates: map[string]float64{"usd": 1000}}
+	v, err := cfg.TimeWeightedAverage("usd", thursday, thursday.AddDate(0, 0, 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != 62 {
+		t.Errorf("unexpected average with holiday: %v", v)
+	}
+	// not rounded values: (2*1.0000009 + 3*1.0000004) / 5 = 1.0000006,
+	// values rounded to 6 decimal places give 1.0000004
+	for day, cny := range map[string]float64{"2017-03-02": 1.0000009, "2017-03-03": 1.0000004, "2017-03-06": 1.0000009} {
+		provider[day].Rates["cny"] = cny
+	}
+	if err = cfg.SetHolidays(nil); err != nil {
+		t.Fatal(err)
+	}
+	if v, err = cfg.TimeWeightedAverage("cny", thursday, thursday.AddDate(0, 0, 4)); err != nil {
+		t.Fatal(err)
+	}
+	if v != 1.000001 {
+		t.Errorf("unexpected average of small changes: %v", v)
+	}
+	if _, err = cfg.TimeWeightedAverage("usd", thursday, thursday.AddDate(0, 0, -1)); err == nil {
+		t.Error("unexpected behavior for invalid range")
+	}
+}
+
+func TestCfg_ArchiveURL(t *testing.T) {
+	live, liveCounter := countingServer(t, dailyFile)
+	defer live.Close()
+	archive, archiveCounter := countingServer(t, dailyFile)
+	defer archive.Close()
+
+	cfg, err := New(getConfig(), logger, userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.RatesURL = live.URL
+	cfg.Clock = &fixedClock{now: time.Date(2017, 3, 2, 12, 0, 0, 0, time.UTC)}
+	today, past := cfg.Today(), time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC)
+	// live URL for all dates by default
+	if url := cfg.ratesURL(past); url != live.URL {
+		t.Errorf("unexpected URL: %v", url)
+	}
+	cfg.ArchiveURL = archive.URL
+	for _, d := range []time.Time{today, past} {
+		if _, _, err := cfg.dayRates(context.Background(), d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if l, a := atomic.LoadInt32(liveCounter), atomic.LoadInt32(archiveCounter); l != 1 || a != 1 {
+		t.Errorf("unexpected requests: live=%v, archive=%v", l, a)
+	}
+	cfg.ArchiveURL = "ftp://example.com"
+	if err = cfg.isValid(); err == nil {
+		t.Error("invalid archive URL is valid")
+	}
+}
+
+func TestCfg_BuyReceipt(t *testing.T) {
+	server := stubServer(t, dailyFile)
+	defer server.Close()
+
+	values := map[string]interface{}{"markup": 2, "markups": map[string]float64{"EUR": 5, "jpy": 0}}
+	cfg, err := New(configWith(t, values), logger, userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.RatesURL = server.URL
+	d := time.Date(2017, 3, 2, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		code                     string
+		result, unmarked, markup float64
+	}{
+		// 10000 / 58.1205 / 1.02, markup of rounded 172.06 is 168.69
+		{"usd", 168.68, 172.06, 2},
+		{"eur", 155.4, 163.17, 5},
+		{"JPY", 19529.53, 0, 0},
+	}
+	for _, c := range cases {
+		receipt, err := cfg.BuyReceipt(d, 10000, c.code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if receipt.Result != c.result || receipt.Unmarked != c.unmarked || receipt.Markup != c.markup {
+			t.Errorf("unexpected receipt of %v: %+v", c.code, receipt)
+		}
+	}
+	if m := cfg.MarkupOf("Eur"); m != 5 {
+		t.Errorf("unexpected markup: %v", m)
+	}
+	cfg.Markups["jpy"] = 100
+	if err = cfg.isValid(); err == nil {
+		t.Error("too big markup is valid")
+	}
+	cfg.Markups = map[string]float64{"usd": 1, "USD": 2}
+	if err = cfg.isValid(); err == nil {
+		t.Error("duplicate markup is valid")
+	}
+	cfg.Markups, cfg.Markup = nil, -1
+	if err = cfg.isValid(); err == nil {
+		t.Error("negative markup is valid")
+	}
+}
+
+func TestCfg_Bounds(t *testing.T) {
+	var buf bytes.Buffer
+	cfg := stubConfig(t, map[string][]string{"usd": {"$"}, "rub": {"₽"}})
+	cfg.logger = log.New(&buf, "", 0)
+	// USD rate 58.1205 is out of range
+	cfg.Bounds = map[string]Bounds{"USD": {Min: 60, Max: 100}, "eur": {Min: 50}, "jpy": {Max: 1}}
+	d := time.Date(2017, 3, 2, 0, 0, 0, 0, time.UTC)
+	if _, err := cfg.GetRates(d, "1 usd"); err != nil {
+		t.Fatal(err)
+	}
+	if out := buf.String(); !strings.Contains(out, "WARNING: rate of USD 58.1205 is out of expected range [60, 100]") {
+		t.Errorf("unexpected log: %v", out)
+	}
+	if strings.Contains(buf.String(), "rate of eur") || strings.Contains(buf.String(), "rate of jpy") {
+		t.Errorf("unexpected warning: %v", buf.String())
+	}
+	cfg.RejectOutOfBounds = true
+	_, err := cfg.GetRates(d, "1 usd")
+	if e, ok := err.(*RateError); !ok || e.HTTPCode != http.StatusBadGateway || e.Msg != "rate of usd is out of expected range" {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err = cfg.Convert(d, "usd", "rub", 1); err == nil {
+		t.Error("out of range rates are used by conversion")
+	}
+	// only currencies used by a request are checked
+	if _, err = cfg.Convert(d, "eur", "rub", 1); err != nil {
+		t.Errorf("unexpected conversion error: %v", err)
+	}
+	if _, err = cfg.GetRates(d, "1 eur to jpy"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	// the warning is logged once for fetched rates
+	if n := strings.Count(buf.String(), "WARNING: rate of USD"); n != 1 {
+		t.Errorf("unexpected number of warnings: %v", n)
+	}
+	cfg.Bounds["USD"] = Bounds{Min: 50, Max: 60}
+	if _, err = cfg.GetRates(d, "1 usd"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	cfg.Bounds["USD"] = Bounds{Min: 60, Max: 50}
+	if err = cfg.isValid(); err == nil {
+		t.Error("invalid bounds are valid")
+	}
+}
+
+func TestCfg_ProviderChain(t *testing.T) {
+	var buf bytes.Buffer
+	cfg, err := New(getConfig(), logger, userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.logger = log.New(&buf, "", 0)
+	cfg.Provider = &stubProvider{name: "primary", err: errors.New("failed")}
+	cfg.Fallbacks = []Provider{
+		// without RUB rate
+		&stubProvider{name: "broken", table: &RateTable{Base: "eur", Rates: map[string]float64{"usd": 0.8}}},
+		// USD based provider
+		&stubProvider{name: "secondary", table: &RateTable{Base: "usd", Rates: map[string]float64{"rub": 0.016, "eur": 1.25}}},
+	}
+	d := time.Date(2017, 3, 2, 0, 0, 0, 0, time.UTC)
+	value, err := cfg.Convert(d, "usd", "rub", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != 6250 {
+		t.Errorf("unexpected value: %v", value)
+	}
+	table, err := cfg.provider().Rates(context.Background(), d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if table.Base != "rub" || table.Rates["usd"] != 62.5 {
+		t.Errorf("unexpected table: %+v", table)
+	}
+	if !strings.Contains(buf.String(), "served by provider secondary") {
+		t.Errorf("unexpected log: %v", buf.String())
+	}
+	cfg.Fallbacks = cfg.Fallbacks[:1]
+	_, err = cfg.Convert(d, "usd", "rub", 100)
+	if err == nil {
+		t.Error("unexpected behavior")
+	}
+}
+
+func TestCfg_ResolveDate(t *testing.T) {
+	server, _ := businessDayServer(t)
+	defer server.Close()
+
+	cfg, err := New(getConfig(), logger, userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.RatesURL = server.URL
+	cases := map[string]time.Time{
+		// Tuesday
+		"2017-02": time.Date(2017, 2, 28, 0, 0, 0, 0, time.UTC),
+		// Sunday -> Friday
+		"2017-04":    time.Date(2017, 4, 28, 0, 0, 0, 0, time.UTC),
+		"2017-04-30": time.Date(2017, 4, 30, 0, 0, 0, 0, time.UTC),
+	}
+	for value, expected := range cases {
+		date, err := cfg.ResolveDate(context.Background(), value)
+		if err != nil {
+			t.Errorf("failed resolve %v: %v", value, err)
+		}
+		if !date.Equal(expected) {
+			t.Errorf("unexpected date for %v: %v", value, date)
+		}
+	}
+	today := cfg.Today()
+	if date, err := cfg.ParseDate(today.Format("2006-01")); err != nil || !date.Equal(today) {
+		t.Errorf("unexpected current month date: %v, %v", date, err)
+	}
+	for _, value := range []string{today.AddDate(0, 1, 0).Format("2006-01"), "2017-13", "2017/04"} {
+		if _, err := cfg.ResolveDate(context.Background(), value); err == nil {
+			t.Errorf("unexpected behavior for %v", value)
+		}
+	}
+}
+
+func TestCfg_Holidays(t *testing.T) {
+	server, counter := countingServer(t, dailyFile)
+	defer server.Close()
+
+	cfg, err := New(getConfig(), logger, userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.RatesURL = server.URL
+	holidaysFile := path.Join(t.TempDir(), "holidays.txt")
+	err = ioutil.WriteFile(holidaysFile, []byte("# end of March\n2017-03-31\n\n 2017-03-30\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dates, err := readHolidays(holidaysFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cfg.SetHolidays(dates); err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]time.Time{
+		// Friday and Thursday are holidays -> Wednesday
+		"2017-03": time.Date(2017, 3, 29, 0, 0, 0, 0, time.UTC),
+		// Sunday -> Friday
+		"2017-04": time.Date(2017, 4, 28, 0, 0, 0, 0, time.UTC),
+		// not a month
+		"2017-03-31": time.Date(2017, 3, 31, 0, 0, 0, 0, time.UTC),
+	}
+	for value, expected := range cases {
+		date, err := cfg.ResolveDate(context.Background(), value)
+		if err != nil {
+			t.Errorf("failed resolve %v: %v", value, err)
+		}
+		if !date.Equal(expected) {
+			t.Errorf("unexpected date for %v: %v", value, date)
+		}
+	}
+	if n := atomic.LoadInt32(counter); n != 0 {
+		t.Errorf("unexpected requests: %v", n)
+	}
+	if err = cfg.SetHolidays([]string{"2017-03-32"}); err == nil {
+		t.Error("unexpected behavior for bad holiday")
+	}
+	if _, err = readHolidays(path.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Error("unexpected behavior for missing holidays file")
+	}
+}
+
+func TestCfg_GetRatesInverse(t *testing.T) {
+	cfg := stubConfig(t, map[string][]string{"usd": {"$"}, "eur": {"€"}, "jpy": {"¥"}, "rub": {"₽"}})
+	d := time.Date(2017, 3, 2, 0, 0, 0, 0, time.UTC)
+	info, err := cfg.GetRatesWith(d, "100 usd, 1000 jpy", Options{Verbose: true, Raw: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	amounts := []float64{100, 1000}
+	for i, item := range info.Rates {
+		if len(item.Inverse) != 4 {
+			t.Fatalf("unexpected inverse: %v", item.Inverse)
+		}
+		for code, inverse := range item.Inverse {
+			// value of one requested unit multiplied by inverse rate is one
+			if v := item.Raw[code] / amounts[i] * inverse; v < 0.9999 || v > 1.0001 {
+				t.Errorf("inconsistent rates of %v: %v, %v", code, item.Raw[code], inverse)
+			}
+		}
+	}
+	if v := info.Rates[0].Inverse["rub"]; v != 0.017206 {
+		t.Errorf("unexpected inverse rate: %v", v)
+	}
+	info, err = cfg.GetRates(d, "100 usd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Rates[0].Inverse != nil {
+		t.Errorf("unexpected inverse: %v", info.Rates[0].Inverse)
+	}
+	// zero rate guard
+	items := []RateItem{{Rate: map[string]float64{"usd": 0, "xyz": 0}}}
+	cfg.reqInverse(items, []parsedMsg{{currency: "usd", value: 1}}, map[string]float64{"usd": 58, "xyz": 0})
+	if _, ok := items[0].Inverse["xyz"]; ok {
+		t.Errorf("unexpected inverse: %v", items[0].Inverse)
+	}
+}
+
+// fixedClock is a test clock with manually set time.
+type fixedClock struct {
+	now time.Time
+}
+
+func (c *fixedClock) Now() time.Time {
+	return c.now
+}
+
+func TestCfg_MergeDuplicates(t *testing.T) {
+	cfg := stubConfig(t, map[string][]string{"usd": {"$"}, "eur": {"€"}, "rub": {"₽"}})
+	d := time.Date(2017, 3, 2, 0, 0, 0, 0, time.UTC)
+	query := "100 usd, 5 eur, 50 usd, 10 usd to eur"
+	// separate items by default
+	info, err := cfg.GetRates(d, query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs := make([]string, len(info.Rates))
+	for i, item := range info.Rates {
+		msgs[i] = item.Msg
+	}
+	if expected := []string{"100 usd", "5 eur", "50 usd", "10 usd to eur"}; !reflect.DeepEqual(msgs, expected) {
+		t.Errorf("unexpected messages: %v", msgs)
+	}
+	if v := info.Rates[2].Rate["usd"]; v != 50 {
+		t.Errorf("unexpected value: %v", v)
+	}
+	cfg.MergeDuplicates = true
+	info, err = cfg.GetRates(d, query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs = msgs[:0]
+	for _, item := range info.Rates {
+		msgs = append(msgs, item.Msg)
+	}
+	if expected := []string{"100 usd + 50 usd", "5 eur", "10 usd to eur"}; !reflect.DeepEqual(msgs, expected) {
+		t.Fatalf("unexpected messages: %v", msgs)
+	}
+	// 150 * 58.1205
+	if item := info.Rates[0]; item.Rate["usd"] != 150 || item.Rate["rub"] != 8718.08 {
+		t.Errorf("unexpected merged item: %+v", item)
+	}
+	if item := info.Rates[2]; len(item.Rate) != 1 || item.Rate["eur"] != 9.48 {
+		t.Errorf("unexpected target item: %+v", item)
+	}
+}
+
+func TestCfg_DedupWindow(t *testing.T) {
+	server, counter := countingServer(t, dailyFile)
+	defer server.Close()
+
+	cfg, err := New(getConfig(), logger, userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.RatesURL = server.URL
+	if err = cfg.SetRequiredCodes(map[string][]string{"usd": {"$"}, "eur": {"€"}, "rub": {"₽"}}); err != nil {
+		t.Fatal(err)
+	}
+	clock := &fixedClock{now: time.Date(2017, 3, 2, 12, 0, 0, 0, time.UTC)}
+	cfg.Clock = clock
+	cfg.dedupWindow = time.Second
+	d := time.Date(2017, 3, 2, 0, 0, 0, 0, time.UTC)
+	// a computed result requests daily rates which are not cached
+	requests := func() int32 {
+		cfg.cache.Purge()
+		return atomic.LoadInt32(counter)
+	}
+	first, err := cfg.GetRates(d, "100 usd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Provenance == nil || first.Provenance.Cached {
+		t.Errorf("unexpected first provenance: %+v", first.Provenance)
+	}
+	expected := cloneValues(first.Rates[0].Rate)
+	// changes of a result don't affect reused ones
+	first.Rates[0].Rate["usd"] = 0
+	first.Provenance.URL = "changed"
+	n := requests()
+	clock.now = clock.now.Add(500 * time.Millisecond)
+	second, err := cfg.GetRates(d, " 100  USD ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests() != n {
+		t.Error("computed result is not reused")
+	}
+	if !reflect.DeepEqual(second.Rates[0].Rate, expected) {
+		t.Errorf("unexpected reused rates: %v", second.Rates[0].Rate)
+	}
+	if p := second.Provenance; p == nil || !p.Cached || p.URL == "changed" {
+		t.Errorf("unexpected reused provenance: %+v", p)
+	}
+	second.Rates[0].Rate["eur"] = 0
+	reused, err := cfg.GetRates(d, "100 usd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(reused.Rates[0].Rate, expected) {
+		t.Errorf("unexpected rates after reused result change: %v", reused.Rates[0].Rate)
+	}
+	// other options
+	if _, err = cfg.GetRatesWith(d, "100 usd", Options{Verbose: true}); err != nil {
+		t.Fatal(err)
+	}
+	if requests() != n+1 {
+		t.Error("result of other options is reused")
+	}
+	clock.now = clock.now.Add(time.Second)
+	third, err := cfg.GetRates(d, "100 usd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests() != n+2 {
+		t.Error("expired result is reused")
+	}
+	if !reflect.DeepEqual(third.Rates[0].Rate, expected) {
+		t.Errorf("unexpected rates: %+v", third.Rates)
+	}
+	// disabled window
+	cfg.dedupWindow = 0
+	if _, err = cfg.GetRates(d, "100 usd"); err != nil {
+		t.Fatal(err)
+	}
+	if requests() != n+3 {
+		t.Error("result is reused without window")
+	}
+}
+
+func TestCfg_Clock(t *testing.T) {
+	server, counter := countingServer(t, dailyFile)
+	defer server.Close()
+
+	cfg, err := New(getConfig(), logger, userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.RatesURL = server.URL
+	cfg.Timezone = "Europe/Moscow"
+	cfg.location, err = time.LoadLocation(cfg.Timezone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Thursday 23:59 in Moscow
+	clock := &fixedClock{now: time.Date(2017, 3, 2, 20, 59, 0, 0, time.UTC)}
+	cfg.Clock = clock
+	thursday := time.Date(2017, 3, 2, 0, 0, 0, 0, time.UTC)
+	if d := cfg.Today(); !d.Equal(thursday) {
+		t.Errorf("unexpected today: %v", d)
+	}
+	if _, err := cfg.ParseDate("2017-03-03"); err == nil {
+		t.Error("future date is valid")
+	}
+	clock.now = clock.now.Add(time.Minute)
+	if d, err := cfg.ParseDate("2017-03-03"); err != nil || !d.Equal(cfg.Today()) {
+		t.Errorf("unexpected date: %v, %v", d, err)
+	}
+	cfg.maxCacheAge = time.Hour
+	if _, _, err := cfg.dayRates(context.Background(), thursday); err != nil {
+		t.Fatal(err)
+	}
+	clock.now = clock.now.Add(59 * time.Minute)
+	_, p, err := cfg.dayRates(context.Background(), thursday)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.Cached || p.Age() != 59*time.Minute {
+		t.Errorf("unexpected provenance: %+v, %v", p, p.Age())
+	}
+	clock.now = clock.now.Add(time.Minute)
+	if _, p, err := cfg.dayRates(context.Background(), thursday); err != nil || p.Cached || p.Age() != 0 {
+		t.Errorf("unexpected result: %+v, %v", p, err)
+	}
+	if n := atomic.LoadInt32(counter); n != 2 {
+		t.Errorf("unexpected number of requests: %v", n)
+	}
+}
+
+func TestCfg_ChangedRates(t *testing.T) {
+	data, err := ioutil.ReadFile(dailyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response := string(data)
+		if r.FormValue("date_req") == "01/03/2017" {
+			// USD and JPY are changed, EUR is the same
+			response = strings.NewReplacer("58,1205", "57,9000", "51,2045", "51,2145").Replace(response)
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		w.Write([]byte(response))
+	}))
+	defer server.Close()
+
+	cfg, err := New(getConfig(), logger, userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.RatesURL = server.URL
+	cfg.CacheSize = 10
+	err = cfg.SetRequiredCodes(map[string][]string{"usd": {"$"}, "eur": {"€"}, "jpy": {"¥"}, "rub": {"₽"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	date := time.Date(2017, 3, 2, 0, 0, 0, 0, time.UTC)
+	base := date.AddDate(0, 0, -1)
+	changes, err := cfg.ChangedRates(context.Background(), date, base, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changes.Date != "2017-03-02" || changes.Base != "2017-03-01" {
+		t.Errorf("unexpected dates: %+v", changes)
+	}
+	expected := []Change{
+		{Code: "jpy", Rate: 0.512, Base: 0.5121, Delta: -0.0001},
+		{Code: "usd", Rate: 58.1205, Base: 57.9, Delta: 0.2205},
+	}
+	if !reflect.DeepEqual(changes.Items, expected) {
+		t.Errorf("unexpected changes: %+v", changes.Items)
+	}
+	changes, err = cfg.ChangedRates(context.Background(), date, base, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes.Items) != 1 || changes.Items[0].Code != "usd" {
+		t.Errorf("unexpected changes: %+v", changes.Items)
+	}
+	if _, err := cfg.ChangedRates(context.Background(), date, base, -1); err == nil {
+		t.Error("negative threshold is valid")
+	}
+}
+
+func TestCfg_GetRatesSameCode(t *testing.T) {
+	cfg := stubConfig(t, map[string][]string{"usd": {"$"}, "jpy": {"¥"}, "rub": {"₽"}})
+	d := time.Date(2017, 3, 2, 0, 0, 0, 0, time.UTC)
+	info, err := cfg.GetRatesWith(d, "100.005 usd, 0.1 jpy, 12345.678 rub", Options{Raw: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		code  string
+		value float64
+	}{
+		{"usd", 100.005},
+		{"jpy", 0.1},
+		{"rub", 12345.678},
+	}
+	for i, e := range expected {
+		item := info.Rates[i]
+		if v := item.Rate[e.code]; v != e.value {
+			t.Errorf("unexpected %v rate: %v", e.code, v)
+		}
+		if v := item.Raw[e.code]; v != e.value {
+			t.Errorf("unexpected %v raw value: %v", e.code, v)
+		}
+	}
+	if v := info.Rates[0].Rate["rub"]; v != 5812.34 {
+		t.Errorf("unexpected rub rate: %v", v)
+	}
+	for _, amount := range []float64{100.005, 0.1, 12345.678} {
+		v, err := cfg.Convert(d, "usd", "USD", amount)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != amount {
+			t.Errorf("unexpected self-conversion of %v: %v", amount, v)
+		}
+	}
+	if _, err := cfg.Convert(d, "xyz", "xyz", 1); err == nil {
+		t.Error("unknown currency is converted")
+	}
+}
+
+func TestCfg_CAFile(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	cfg, err := New(getConfig(), logger, userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr := cfg.httpClient.Transport.(*http.Transport); tr.TLSClientConfig != nil {
+		t.Error("unexpected custom TLS config")
+	}
+	if _, err := cfg.httpClient.Get(server.URL); err == nil {
+		t.Error("unknown authority is trusted")
+	}
+	caFile := path.Join(t.TempDir(), "ca.pem")
+	block := &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}
+	if err := ioutil.WriteFile(caFile, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg.CAFile = caFile
+	client, err := cfg.newClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("unexpected status code: %v", resp.StatusCode)
+	}
+	if err := ioutil.WriteFile(caFile, []byte("bad"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfg.newClient(); err == nil {
+		t.Error("bad CA file is loaded")
+	}
+	cfg.CAFile = "/bad_file_path.pem"
+	if _, err := cfg.newClient(); err == nil {
+		t.Error("missing CA file is loaded")
+	}
+}
+
+func TestCfg_GetRatesEmpty(t *testing.T) {
+	server, counter := countingServer(t, dailyFile)
+	defer server.Close()
+
+	cfg, err := New(getConfig(), logger, userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.RatesURL = server.URL
+	err = cfg.SetRequiredCodes(map[string][]string{"usd": {"$"}, "rub": {"₽"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := time.Date(2017, 3, 2, 0, 0, 0, 0, time.UTC)
+	for _, msg := range []string{"", "abc", "10 xyz, 5"} {
+		info, err := cfg.GetRates(d, msg)
+		if err != nil {
+			t.Fatalf("failed %q: %v", msg, err)
+		}
+		if info.Rates == nil || len(info.Rates) != 0 || info.Notice != emptyResultMsg {
+			t.Errorf("unexpected info of %q: %+v", msg, info)
+		}
+	}
+	cfg.StrictEmpty = true
+	_, err = cfg.GetRates(d, "abc")
+	if e, ok := err.(*RateError); !ok || e.HTTPCode != http.StatusUnprocessableEntity {
+		t.Errorf("unexpected error: %v", err)
+	}
+	info, err := cfg.GetRates(d, "1 usd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Rates) != 1 || info.Notice != "" {
+		t.Errorf("unexpected info: %+v", info)
+	}
+	if n := atomic.LoadInt32(counter); n != 1 {
+		t.Errorf("unexpected number of requests: %v", n)
+	}
+}
+
+func TestCfg_UpperCodes(t *testing.T) {
+	cfg := stubConfig(t, map[string][]string{"usd": {"$"}, "eur": {"€"}, "rub": {"₽"}})
+	cfg.CacheSize = 10
+	d := time.Date(2017, 3, 2, 0, 0, 0, 0, time.UTC)
+	opts := Options{Raw: true, Ordered: true, Ratio: true, Verbose: true, Trend: true, Basket: Basket{"usd": 0.5, "eur": 0.5}}
+	info, err := cfg.GetRatesWith(d, "1 USD", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := info.Rates[0].Rate["usd"]; !ok {
+		t.Errorf("unexpected rate: %v", info.Rates[0].Rate)
+	}
+	cfg.UpperCodes = true
+	info, err = cfg.GetRatesWith(d, "1 usd, 2 Eur", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes := []string{"USD", "EUR", "RUB"}
+	for _, item := range info.Rates {
+		for _, code := range codes {
+			maps := []map[string]float64{item.Rate, item.Raw, item.Inverse, info.Basket}
+			for _, m := range maps {
+				if _, ok := m[code]; !ok {
+					t.Errorf("absent %v in %v", code, m)
+				}
+			}
+			if _, ok := item.Ratio[code]; !ok {
+				t.Errorf("absent %v in ratio", code)
+			}
+			if _, ok := info.Trend[code]; !ok {
+				t.Errorf("absent %v in trend", code)
+			}
+		}
+		for _, v := range item.Values {
+			if v.Code != strings.ToUpper(v.Code) {
+				t.Errorf("unexpected code: %v", v.Code)
+			}
+		}
+	}
+	if v := info.Rates[0].Rate["USD"]; v != 1 {
+		t.Errorf("unexpected rate: %v", v)
+	}
+	if v := info.Rates[1].Rate["EUR"]; v != 2 {
+		t.Errorf("unexpected rate: %v", v)
+	}
+}
+
+func TestCfg_InternalID(t *testing.T) {
+	cfg := stubConfig(t, map[string][]string{"usd": {"$"}, "eur": {"€"}, "rub": {"₽"}})
+	cfg.CacheSize = 10
+	d := time.Date(2017, 3, 2, 0, 0, 0, 0, time.UTC)
+	info, err := cfg.GetRatesWith(d, "100 R01235, r01820, 2.5r01239", Options{Ratio: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []map[string]float64{
+		{"usd": 100, "rub": 5812.05, "eur": 94.83},
+		{"usd": 0.01, "rub": 0.51, "eur": 0.01},
+		{"usd": 2.64, "rub": 153.22, "eur": 2.5},
+	}
+	for i, e := range expected {
+		for code, value := range e {
+			if v := info.Rates[i].Rate[code]; v != value {
+				t.Errorf("unexpected rate %v of %q: %v", code, info.Rates[i].Msg, v)
+			}
+		}
+		if len(info.Rates[i].Ratio) != 3 {
+			t.Errorf("unexpected ratio: %v", info.Rates[i].Ratio)
+		}
+	}
+	conversions := []struct {
+		from, to string
+		amount   float64
+		expected float64
+	}{
+		{"R01235", "rub", 10, 581.21},
+		{"rub", "r01820", 100, 195.3},
+		{"R01235", "R01239", 100, 94.83},
+	}
+	for _, c := range conversions {
+		v, err := cfg.Convert(d, c.from, c.to, c.amount)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != c.expected {
+			t.Errorf("unexpected conversion %v %v to %v: %v", c.amount, c.from, c.to, v)
+		}
+	}
+	if _, err := cfg.GetRates(d, "1 R99999"); err == nil {
+		t.Error("unknown ID is valid")
+	}
+	if _, err := cfg.Convert(d, "R99999", "rub", 1); err == nil {
+		t.Error("unknown ID is converted")
+	}
+}
+
+func TestCfg_StaleAge(t *testing.T) {
+	data, err := ioutil.ReadFile(dailyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var failed int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failed) == 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	cfg, err := New(getConfig(), logger, userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.RatesURL = server.URL
+	clock := &fixedClock{now: time.Date(2017, 3, 2, 12, 0, 0, 0, time.UTC)}
+	cfg.Clock = clock
+	cfg.maxCacheAge = time.Minute
+	cfg.staleAge = time.Hour
+	d := cfg.Today()
+	if _, p, err := cfg.dayRates(context.Background(), d); err != nil || p.Cached || p.Stale {
+		t.Fatalf("unexpected result: %+v, %v", p, err)
+	}
+	atomic.StoreInt32(&failed, 1)
+	clock.now = clock.now.Add(30 * time.Minute)
+	result, p, err := cfg.dayRates(context.Background(), d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.Cached || !p.Stale || p.Age() != 30*time.Minute || result.Date != "02.03.2017" {
+		t.Errorf("unexpected result: %+v", p)
+	}
+	clock.now = clock.now.Add(30 * time.Minute)
+	if _, _, err := cfg.dayRates(context.Background(), d); err == nil {
+		t.Error("too old stale rates are served")
+	}
+	atomic.StoreInt32(&failed, 0)
+	if _, p, err := cfg.dayRates(context.Background(), d); err != nil || p.Cached || p.Stale {
+		t.Fatalf("unexpected result: %+v, %v", p, err)
+	}
+	// stale rates are not served by default
+	cfg.staleAge = 0
+	atomic.StoreInt32(&failed, 1)
+	clock.now = clock.now.Add(2 * time.Minute)
+	if _, _, err := cfg.dayRates(context.Background(), d); err == nil {
+		t.Error("stale rates are served")
+	}
+	cfg.StaleAge = -1
+	if err := cfg.isValid(); err == nil {
+		t.Error("negative stale age is valid")
+	}
+}
+
+func TestCfg_GetRatesPrecision(t *testing.T) {
+	data, err := ioutil.ReadFile(dailyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response := strings.NewReplacer("58,1205", "58,12", "51,2045", "51,2").Replace(string(data))
+		w.Header().Set("Content-Type", "application/xml")
+		w.Write([]byte(response))
+	}))
+	defer server.Close()
+
+	cfg, err := New(getConfig(), logger, userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.RatesURL = server.URL
+	err = cfg.SetRequiredCodes(map[string][]string{"usd": {"$"}, "eur": {"€"}, "jpy": {"¥"}, "rub": {"₽"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := time.Date(2017, 3, 2, 0, 0, 0, 0, time.UTC)
+	info, err := cfg.GetRatesWith(d, "1 usd", Options{Verbose: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]int{"usd": 2, "eur": 4, "jpy": 1}
+	if !reflect.DeepEqual(info.Precision, expected) {
+		t.Errorf("unexpected precision: %v", info.Precision)
+	}
+	info, err = cfg.GetRates(d, "1 usd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Precision != nil {
+		t.Errorf("unexpected precision: %v", info.Precision)
+	}
+	values := map[string]int{"75,1234": 4, "75.1": 1, "75": 0, "0,50": 2}
+	for value, places := range values {
+		if n := decimalPlaces(strings.Replace(value, ",", ".", 1)); n != places {
+			t.Errorf("unexpected decimal places of %v: %v", value, n)
+		}
+	}
+}
+
+func TestCfg_MaxCodes(t *testing.T) {
+	cfg, err := New(getConfig(), logger, userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MaxCodes != defaultMaxCodes {
+		t.Errorf("unexpected default max codes: %v", cfg.MaxCodes)
+	}
+	cfg.MaxCodes = 2
+	if err := cfg.SetRequiredCodes(map[string][]string{"usd": {"$"}, "eur": {"€"}}); err != nil {
+		t.Fatal(err)
+	}
+	err = cfg.SetRequiredCodes(map[string][]string{"usd": {"$"}, "eur": {"€"}, "rub": {"₽"}})
+	if err == nil {
+		t.Error("too many codes are set")
+	}
+	if n := len(cfg.codes); n != 2 {
+		t.Errorf("unexpected number of codes: %v", n)
+	}
+	cfg.MaxCodes = 0
+	if err := cfg.isValid(); err == nil {
+		t.Error("zero max codes is valid")
+	}
+}
+
+func TestCfg_MatchExact(t *testing.T) {
+	cfg, err := New(getConfig(), logger, userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cfg.SetRequiredCodes(map[string][]string{"usd": {"$", "dollar"}, "eur": {"€", "euro"}, "rub": {"₽", "rubles"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := []string{"100 usd", "1.5 euro", "100$", "2.25 rubles", "10 dollar"}
+	for _, msg := range messages {
+		message := cfg.Normalize(msg)
+		code, value, ok := cfg.matchExact(message)
+		if !ok {
+			t.Errorf("not matched %q", msg)
+			continue
+		}
+		expected := parsedMsg{}
+		cfg.matchRegexp(&expected, message)
+		if code != expected.currency || value != expected.value {
+			t.Errorf("unexpected result of %q: %v %v, expected %v %v", msg, code, value, expected.currency, expected.value)
+		}
+	}
+	for _, msg := range []string{"usd 100", "100usd", "100 xyz", "0 usd", "-5 usd", "1e3 usd", ".5 usd", "5. usd", "1.2.3 usd", "abc usd", " usd"} {
+		if code, value, ok := cfg.matchExact(msg); ok {
+			t.Errorf("unexpected match of %q: %v %v", msg, code, value)
+		}
+	}
+	result := cfg.parseMsg([]string{"100 usd", "euro 5", "usd"})
+	expected := []parsedMsg{
+		{msg: "100 usd", currency: "usd", value: 100},
+		{msg: "euro 5", currency: "eur", value: 5},
+		{msg: "usd", currency: "usd", value: 1},
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("unexpected parsed messages: %+v", result)
+	}
+}
+
+func BenchmarkCfg_ParseMsg(b *testing.B) {
+	cfg, err := New(getConfig(), logger, userAgent)
+	if err != nil {
+		b.Fatal(err)
+	}
+	codes := map[string][]string{"usd": {"$", "dollar"}, "eur": {"€", "euro"}, "rub": {"₽", "rubles"}}
+	for _, code := range []string{"gbp", "jpy", "cny", "chf", "uah", "kzt", "byn", "try"} {
+		codes[code] = []string{code + "s"}
+	}
+	if err := cfg.SetRequiredCodes(codes); err != nil {
+		b.Fatal(err)
+	}
+	message := "100 kzt"
+	b.Run("exact", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			cfg.matchExact(message)
+		}
+	})
+	b.Run("regexp", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			cfg.matchRegexp(&parsedMsg{}, message)
+		}
+	})
+}
+
+func TestCfg_GetRatesCacheStatus(t *testing.T) {
+	server, _ := businessDayServer(t)
+	defer server.Close()
+
+	cfg, err := New(getConfig(), logger, userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.RatesURL = server.URL
+	cfg.CacheSize = 10
+	err = cfg.SetRequiredCodes(map[string][]string{"usd": {"$"}, "rub": {"₽"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	saturday := time.Date(2017, 3, 4, 0, 0, 0, 0, time.UTC)
+	for _, hit := range []bool{false, true} {
+		info, err := cfg.GetRatesWith(saturday, "1 usd", Options{Verbose: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Cached == nil || *info.Cached != hit {
+			t.Errorf("unexpected cache status: %v", info.Cached)
+		}
+		if info.Date != "2017-03-04" || info.CacheDate != "2017-03-03" {
+			t.Errorf("unexpected dates: %v, %v", info.Date, info.CacheDate)
+		}
+	}
+	info, err := cfg.GetRates(saturday, "1 usd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Cached != nil || info.CacheDate != "" {
+		t.Errorf("unexpected cache status: %v, %v", info.Cached, info.CacheDate)
+	}
+}
+
+func TestCfg_Precision(t *testing.T) {
+	server := stubServer(t, dailyFile)
+	defer server.Close()
+
+	cfg, err := New(getConfig(), logger, userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *cfg.Precision.JSON != defaultJSONPrecision || cfg.Precision.Text != 0 {
+		t.Errorf("unexpected default precision: %+v", cfg.Precision)
+	}
+	cfg.RatesURL = server.URL
+	err = cfg.SetRequiredCodes(map[string][]string{"eur": {"€"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := time.Date(2017, 3, 2, 0, 0, 0, 0, time.UTC)
+	expected := map[int]struct {
+		rate float64
+		text string
+	}{
+		0: {0.95, "\t\teur: 0.95\n"},
+		1: {0.9, "\t\teur: 0.9\n"},
+		4: {0.9483, "\t\teur: 0.9483\n"},
+	}
+	for places, e := range expected {
+		info, err := cfg.GetRatesWith(d, "1 R01235", Options{Places: places})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := info.Rates[0].Rate["eur"]; v != e.rate {
+			t.Errorf("unexpected rate with %v places: %v", places, v)
+		}
+		if s := info.String(); !strings.HasSuffix(s, e.text) {
+			t.Errorf("unexpected string with %v places: %q", places, s)
+		}
+	}
+	cfg.Precision.Text = maxPrecision + 1
+	if err := cfg.isValid(); err == nil {
+		t.Error("too big precision is valid")
+	}
+	// zero JSON precision is configurable
+	cfgFile := configWith(t, map[string]interface{}{"precision": map[string]interface{}{"json": 0}})
+	if cfg, err = New(cfgFile, logger, userAgent); err != nil {
+		t.Fatal(err)
+	}
+	cfg.RatesURL = server.URL
+	if err = cfg.SetRequiredCodes(map[string][]string{"eur": {"€"}}); err != nil {
+		t.Fatal(err)
+	}
+	info, err := cfg.GetRates(d, "1 R01235")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := info.Rates[0].Rate["eur"]; *cfg.Precision.JSON != 0 || v != 1 {
+		t.Errorf("unexpected rate with zero JSON precision: %v", v)
+	}
+}
+
+func TestCfg_GetRatesTimestamp(t *testing.T) {
+	cfg := stubConfig(t, map[string][]string{"usd": {"$"}, "rub": {"₽"}})
+	cfg.CacheSize = 10
+	d, err := cfg.ParseDate("2017-03-02")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := cfg.GetRatesWith(d, "1 usd", Options{Timestamp: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2017-03-02T00:00:00Z
+	if info.Timestamp != 1488412800 || info.Date != "2017-03-02" {
+		t.Errorf("unexpected timestamp: %v, %v", info.Timestamp, info.Date)
+	}
+	if ts := time.Unix(info.Timestamp, 0).UTC().Format("2006-01-02"); ts != info.Date {
+		t.Errorf("timestamp date %v doesn't match %v", ts, info.Date)
+	}
+	info, err = cfg.GetRates(d, "1 usd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Timestamp != 0 {
+		t.Errorf("unexpected timestamp: %v", info.Timestamp)
+	}
+}
+
+func TestCfg_Source(t *testing.T) {
+	cfg := stubConfig(t, map[string][]string{"usd": {"$"}, "rub": {"₽"}})
+	d := time.Date(2017, 3, 2, 0, 0, 0, 0, time.UTC)
+	info, err := cfg.GetRates(d, "1 usd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Source{Name: "Central Bank of Russia", URL: "https://www.cbr.ru"}
+	if info.Source == nil || *info.Source != expected {
+		t.Errorf("unexpected source: %v", info.Source)
+	}
+	if s := cfg.Source(); s != expected {
+		t.Errorf("unexpected source: %v", s)
+	}
+	cfg.Provider = &stubProvider{name: "ecb"}
+	if s := cfg.Source(); s != (Source{Name: "ecb"}) {
+		t.Errorf("unexpected source: %v", s)
+	}
+}
+
+func TestDiffInfo(t *testing.T) {
+	// repeated messages are separate items
+	a := &Info{Date: "2017-03-01", Rates: []RateItem{
+		{Msg: "1 usd", Rate: map[string]float64{"usd": 1, "rub": 57.5, "eur": 0.95}},
+		{Msg: "1 usd", Rate: map[string]float64{"usd": 1, "rub": 57.5}},
+	}}
+	b := &Info{Date: "2017-03-02", Rates: []RateItem{
+		{Msg: "1 usd", Rate: map[string]float64{"usd": 1, "rub": 58.25, "jpy": 113.5}},
+		{Msg: "1 usd", Rate: map[string]float64{"usd": 1, "rub": 58}},
+		{Msg: "1 gbp", Rate: map[string]float64{"gbp": 1}},
+	}}
+	expected := []RateDiff{
+		{Msg: "1 usd", Delta: map[string]float64{"usd": 0, "rub": 0.75}, Added: []string{"jpy"}, Removed: []string{"eur"}},
+		{Msg: "1 usd", Delta: map[string]float64{"usd": 0, "rub": 0.5}},
+		{Msg: "1 gbp", Delta: map[string]float64{}, Added: []string{"gbp"}},
+	}
+	if diff := DiffInfo(a, b); !reflect.DeepEqual(diff, expected) {
+		t.Errorf("unexpected diff: %+v", diff)
+	}
+	diff := DiffInfo(a, a)
+	if n := len(diff); n != 2 {
+		t.Fatalf("unexpected diff length: %v", n)
+	}
+	for _, d := range diff {
+		if len(d.Added) != 0 || len(d.Removed) != 0 {
+			t.Errorf("unexpected changed currencies: %+v", d)
+		}
+		for code, delta := range d.Delta {
+			if delta != 0 {
+				t.Errorf("unexpected delta of %v: %v", code, delta)
+			}
+		}
+	}
+	if diff := DiffInfo(b, a); len(diff) != 3 || !reflect.DeepEqual(diff[2].Removed, []string{"gbp"}) {
+		t.Errorf("unexpected diff: %+v", diff)
+	}
+	if diff := DiffInfo(nil, nil); len(diff) != 0 {
+		t.Errorf("unexpected diff: %+v", diff)
+	}
+	if diff := DiffInfo(nil, b); len(diff) != 3 || !reflect.DeepEqual(diff[0].Added, []string{"jpy", "rub", "usd"}) {
+		t.Errorf("unexpected diff: %+v", diff)
+	}
+}
+
+func TestCfg_GetRatesTarget(t *testing.T) {
+	cfg := stubConfig(t, nil)
+	cfg.PrefixAliases = true
+	err := cfg.SetRequiredCodes(map[string][]string{"usd": {"$", "dollar"}, "eur": {"€", "euro"}, "rub": {"₽", "руб"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := time.Date(2017, 3, 2, 0, 0, 0, 0, time.UTC)
+	info, err := cfg.GetRatesWith(d, "100 usd to eur, 100 usd в рублях, 10$ in jpy, 5 euro", Options{Ordered: true, Ratio: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []map[string]float64{
+		{"eur": 94.83},
+		{"rub": 5812.05},
+		{"jpy": 1135.07},
+		{"usd": 5.27, "eur": 5, "rub": 306.43},
+	}
+	for i, e := range expected {
+		item := info.Rates[i]
+		if !reflect.DeepEqual(item.Rate, e) {
+			t.Errorf("unexpected rate of %q: %v", item.Msg, item.Rate)
+		}
+		if len(item.Values) != len(e) || len(item.Ratio) != len(e) {
+			t.Errorf("unexpected values of %q: %v, %v", item.Msg, item.Values, item.Ratio)
+		}
+	}
+	if info.Rates[1].Msg != "100 usd в рублях" {
+		t.Errorf("unexpected message: %v", info.Rates[1].Msg)
+	}
+	if _, err := cfg.GetRates(d, "100 usd to xyz"); err == nil {
+		t.Error("unknown target currency is valid")
+	}
+	// keyword without target is not a compound query
+	info, err = cfg.GetRates(d, "100 usd to")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(info.Rates[0].Rate); n != 3 {
+		t.Errorf("unexpected rate: %v", info.Rates[0].Rate)
+	}
+}
+
+func TestCfg_StreamRatesRangeInterpolate(t *testing.T) {
+	cfg, err := New(getConfig(), logger, userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(dailyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Friday - Monday, weekend has Friday rates like upstream
+	values := map[string]string{"03/03/2017": "60,0000", "04/03/2017": "60,0000", "05/03/2017": "60,0000", "06/03/2017": "66,0000"}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/xml")
+		w.Write([]byte(strings.Replace(string(data), "58,1205", values[r.FormValue("date_req")], 1)))
+	}))
+	defer server.Close()
+	cfg.RatesURL = server.URL
+	if err = cfg.SetRequiredCodes(map[string][]string{"usd": {"$"}, "rub": {"руб"}}); err != nil {
+		t.Fatal(err)
+	}
+	from, to := time.Date(2017, 3, 3, 0, 0, 0, 0, time.UTC), time.Date(2017, 3, 6, 0, 0, 0, 0, time.UTC)
+	collect := func(opts Options) ([]*Info, error) {
+		var result []*Info
+		err := cfg.StreamRatesRange(context.Background(), from, to, "usd", opts, func(info *Info) error {
+			result = append(result, info)
+			return nil
+		})
+		return result, err
+	}
+	result, err := collect(Options{Interpolate: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		date         string
+		value        float64
+		interpolated bool
+	}{
+		{"2017-03-03", 60, false},
+		{"2017-03-04", 62, true},
+		{"2017-03-05", 64, true},
+		{"2017-03-06", 66, false},
+	}
+	if len(result) != len(expected) {
+		t.Fatalf("unexpected result length: %v", len(result))
+	}
+	for i, e := range expected {
+		info := result[i]
+		if info.Date != e.date || info.Interpolated != e.interpolated {
+			t.Errorf("unexpected info: %v %v", info.Date, info.Interpolated)
+		}
+		if v := info.Rates[0].Rate["rub"]; v != e.value {
+			t.Errorf("unexpected value of %v: %v", e.date, v)
+		}
+		if e.interpolated && (info.Rates[0].Rate["rub"] <= 60 || info.Rates[0].Rate["rub"] >= 66) {
+			t.Errorf("value of %v is not between business days", e.date)
+		}
+	}
+	// cached weekend values are not changed by interpolation
+	result, err = collect(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, info := range result[:3] {
+		if info.Interpolated || info.Rates[0].Rate["rub"] != 60 {
+			t.Errorf("unexpected not interpolated info: %v %v", info.Date, info.Rates[0].Rate)
+		}
+	}
+	// no next business day, weekend is returned as is
+	to = to.AddDate(0, 0, -1)
+	result, err = collect(Options{Interpolate: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 3 || result[2].Interpolated || result[2].Rates[0].Rate["rub"] != 60 {
+		t.Error("unexpected trailing weekend info")
+	}
+}
+
+func TestCfg_GetRatesOverflow(t *testing.T) {
+	cfg := stubConfig(t, map[string][]string{"usd": {"$"}, "jpy": {"¥"}, "rub": {"руб"}})
+	d := time.Date(2017, 3, 2, 0, 0, 0, 0, time.UTC)
+	huge := "1" + strings.Repeat("0", 308)
+	// too small amounts are not parsed as plain ones like "400 usd"
+	cases := []struct {
+		msg string
+		rub float64
+		err string
+	}{
+		{"1e308 usd", 0, "too large"},
+		{"1e309 usd", 0, "too large"},
+		{"1.7e308 rub", 0, "too large"},
+		{"1e308 usd in jpy", 0, "too large"},
+		{huge + " usd", 0, "too large"},
+		{"1e-400 usd", 0, "too small"},
+		{"1.5e-330 usd", 0, "too small"},
+		{"5 usd, 1e-400 $", 0, "too small"},
+		{"1e3 usd", 58120.5, ""},
+		{"2.5e-1 usd", 14.53, ""},
+		{"1e+2 $", 5812.05, ""},
+	}
+	for _, c := range cases {
+		info, err := cfg.GetRatesWith(d, c.msg, Options{})
+		if c.err != "" {
+			rateErr, ok := err.(*RateError)
+			if !ok || rateErr.HTTPCode != http.StatusBadRequest || !strings.Contains(rateErr.Msg, c.err) {
+				t.Errorf("unexpected error of %q: %v", c.msg, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := info.Rates[0].Rate["rub"]; v != c.rub {
+			t.Errorf("unexpected value of %q: %v", c.msg, v)
+		}
+	}
+	info, err := cfg.GetRatesWith(d, "1e300 usd", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := info.Rates[0].Rate["rub"]; math.IsInf(v, 0) || v <= 0 {
+		t.Errorf("unexpected large value: %v", v)
+	}
+	cfg.AmountOverflow = OverflowClamp
+	for _, c := range cases {
+		if c.err != "too large" {
+			continue
+		}
+		info, err = cfg.GetRatesWith(d, c.msg, Options{})
+		if err != nil {
+			t.Fatalf("unexpected error of %q: %v", c.msg, err)
+		}
+		for code, v := range info.Rates[0].Rate {
+			if math.IsInf(v, 0) || math.IsNaN(v) {
+				t.Errorf("unexpected value of %q in %v: %v", c.msg, code, v)
+			}
+		}
+		if _, err = json.Marshal(info); err != nil {
+			t.Errorf("unexpected JSON error of %q: %v", c.msg, err)
+		}
+	}
+	cfg.AmountOverflow = "ignore"
+	if err = cfg.isValid(); err == nil {
+		t.Error("unknown overflow behavior is valid")
+	}
+}
+
+func TestCfg_WarmUp(t *testing.T) {
+	server, counter := countingServer(t, dailyFile)
+	defer server.Close()
+
+	cfg, err := New(configWith(t, map[string]interface{}{"cache": 10, "warm_up_days": 3}), logger, userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.RatesURL = server.URL
+	// Monday, the previous business days are Friday and Thursday
+	clock := &fixedClock{now: time.Date(2017, 3, 6, 12, 0, 0, 0, time.UTC)}
+	cfg.Clock = clock
+	if n := cfg.WarmUp(context.Background()); n != 3 {
+		t.Errorf("unexpected number of cached dates: %v", n)
+	}
+	expected := []string{"06/03/2017", "03/03/2017", "02/03/2017"}
+	for _, key := range expected {
+		if !cfg.cache.Contains(key) {
+			t.Errorf("date %v is not cached", key)
+		}
+	}
+	if n := cfg.cache.Len(); n != len(expected) {
+		t.Errorf("unexpected cache size: %v", n)
+	}
+	if n := atomic.LoadInt32(counter); n != 3 {
+		t.Errorf("unexpected number of upstream requests: %v", n)
+	}
+	// warm dates are not requested again
+	if err = cfg.SetRequiredCodes(map[string][]string{"usd": {"$"}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, day := range []int{2, 3, 6} {
+		if _, err = cfg.GetRatesWith(time.Date(2017, 3, day, 0, 0, 0, 0, time.UTC), "1 usd", Options{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(counter); n != 3 {
+		t.Errorf("unexpected number of upstream requests after warm-up: %v", n)
+	}
+	cfg.WarmUpDays = -1
+	if err = cfg.isValid(); err == nil {
+		t.Error("negative warm-up days are valid")
+	}
+	// warmed rates don't fit the cache
+	configs := []map[string]interface{}{
+		{"cache": 2, "warm_up_days": 3},
+		{"cache": 10, "warm_up_days": 3, "cache_memory": 300},
+	}
+	for _, values := range configs {
+		if _, err = New(configWith(t, values), logger, userAgent); err == nil {
+			t.Errorf("warm-up is valid: %v", values)
+		}
+	}
+	// memory budget stops warm-up, one entry is larger than the half of it
+	cfg, err = New(configWith(t, map[string]interface{}{"cache": 10, "warm_up_days": 3, "cache_memory": 1000}), logger, userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.RatesURL, cfg.Clock, cfg.RangeWorkers = server.URL, clock, 1
+	if n := cfg.WarmUp(context.Background()); n != 1 {
+		t.Errorf("unexpected number of cached dates: %v", n)
+	}
+}
+
+func TestERAPI(t *testing.T) {
+	server := stubServer(t, erapiFile)
+	defer server.Close()
+
+	cfg, err := New(getConfig(), logger, userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ERAPIURL = server.URL
+	provider := fallbackProviders[ProviderERAPI](cfg)
+	if s := providerSource(provider); s != erapiSource {
+		t.Errorf("unexpected source: %+v", s)
+	}
+	table, err := provider.Rates(context.Background(), time.Date(2017, 3, 3, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]float64{"usd": 62.5, "eur": 64, "jpy": 0.512}
+	if table.Base != "rub" || table.Date != "2017-03-02" || !reflect.DeepEqual(table.Rates, expected) {
+		t.Errorf("unexpected table: %+v", table)
+	}
+	// no historical rates
+	if _, err = provider.Rates(context.Background(), time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC)); err == nil {
+		t.Error("unexpected historical rates")
+	}
+	failed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"result": "error", "error-type": "unsupported-code"}`))
+	}))
+	defer failed.Close()
+	cfg.ERAPIURL = failed.URL
+	if _, err = provider.Rates(context.Background(), time.Date(2017, 3, 3, 0, 0, 0, 0, time.UTC)); err == nil {
+		t.Error("unexpected success of failed response")
+	}
+}
+
+func TestCfg_FallbackProviders(t *testing.T) {
+	failed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer failed.Close()
+	server := stubServer(t, erapiFile)
+	defer server.Close()
+
+	if _, err := New(configWith(t, map[string]interface{}{"fallback_providers": []string{"ecb"}}), logger, userAgent); err == nil {
+		t.Error("unknown fallback provider is valid")
+	}
+	cfg, err := New(configWith(t, map[string]interface{}{
+		"rates_url":          failed.URL,
+		"erapi_url":          server.URL,
+		"fallback_providers": []string{ProviderERAPI},
+	}), logger, userAgent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(cfg.Fallbacks); n != 1 || cfg.Fallbacks[0].Name() != ProviderERAPI {
+		t.Fatalf("unexpected fallbacks: %v", cfg.Fallbacks)
+	}
+	if err = cfg.SetRequiredCodes(map[string][]string{"usd": {"$"}, "eur": {"€"}, "rub": {"₽"}}); err != nil {
+		t.Fatal(err)
+	}
+	d := time.Date(2017, 3, 2, 0, 0, 0, 0, time.UTC)
+	info, err := cfg.GetRates(d, "1 usd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rate := info.Rates[0].Rate; rate["rub"] != 62.5 || rate["eur"] != 0.98 {
+		t.Errorf("unexpected rates: %v", rate)
+	}
+	if p := info.Provenance; p == nil || p.URL != erapiSource.URL || p.Cached {
+		t.Errorf("unexpected provenance: %+v", p)
+	}
+	days, err := cfg.Calendar(context.Background(), d, d)
+	if err != nil || len(days) != 1 || !days[0].Available {
+		t.Errorf("unexpected calendar: %v, %v", days, err)
+	}
+	table, err := cfg.Table(context.Background(), d)
+	if err != nil || table.Date != "2017-03-02" || len(table.Rows) != 3 {
+		t.Errorf("unexpected table: %+v, %v", table, err)
+	}
+	// all providers fail
+	_, err = cfg.GetRates(d.AddDate(0, 0, -1), "1 usd")
+	if e, ok := err.(*RateError); !ok || e.HTTPCode != http.StatusServiceUnavailable {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,171 @@
+package rates
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// RoundingMode is a rounding rule of calculated values.
+type RoundingMode int
+
+// Rounding modes.
+const (
+	// HalfUp rounds half away from zero, it is default mode.
+	HalfUp RoundingMode = iota
+	// HalfEven rounds half to the nearest even digit (banker's rounding).
+	HalfEven
+	// Floor rounds toward negative infinity.
+	Floor
+	// Ceil rounds toward positive infinity.
+	Ceil
+	// Truncate rounds toward zero.
+	Truncate
+)
+
+// roundingNames are names of rounding modes.
+var roundingNames = map[RoundingMode]string{
+	HalfUp:   "half_up",
+	HalfEven: "half_even",
+	Floor:    "floor",
+	Ceil:     "ceil",
+	Truncate: "truncate",
+}
+
+// ParseRoundingMode returns rounding mode by its case-insensitive name.
+func ParseRoundingMode(name string) (RoundingMode, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for mode, modeName := range roundingNames {
+		if modeName == name {
+			return mode, nil
+		}
+	}
+	return HalfUp, fmt.Errorf("unknown rounding mode %q", name)
+}
+
+// String returns a name of rounding mode.
+func (m RoundingMode) String() string {
+	if name, ok := roundingNames[m]; ok {
+		return name
+	}
+	return fmt.Sprintf("RoundingMode(%d)", int(m))
+}
+
+// MarshalText implements encoding.TextMarshaler interface.
+func (m RoundingMode) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler interface.
+func (m *RoundingMode) UnmarshalText(text []byte) error {
+	mode, err := ParseRoundingMode(string(text))
+	if err != nil {
+		return err
+	}
+	*m = mode
+	return nil
+}
+
+// Round rounds val to decimal places using the mode. The shortest decimal
+// representation of val is rounded, so 1.005 is a half for 2 places
+// although its binary value is a bit less. Negative zero result is zero.
+func (m RoundingMode) Round(val, places float64) float64 {
+	if v := m.round(val, places); v != 0 {
+		return v
+	}
+	return 0
+}
+
+// round rounds val like Round, but keeps sign of zero.
+func (m RoundingMode) round(val, places float64) float64 {
+	if math.IsInf(val, 0) || math.IsNaN(val) {
+		return val
+	}
+	n := int(places)
+	if float64(n) != places || n < 0 {
+		return m.roundBinary(val, places)
+	}
+	neg := math.Signbit(val)
+	digits := strconv.FormatFloat(math.Abs(val), 'f', -1, 64)
+	intPart, frac := digits, ""
+	if i := strings.IndexByte(digits, '.'); i >= 0 {
+		intPart, frac = digits[:i], digits[i+1:]
+	}
+	if len(frac) <= n {
+		return val
+	}
+	// rest is not zero, the shortest representation has no trailing zeros
+	kept, rest := []byte(intPart+frac[:n]), frac[n:]
+	var up bool
+	switch m {
+	case HalfEven:
+		odd := (kept[len(kept)-1]-'0')%2 == 1
+		up = rest[0] > '5' || (rest[0] == '5' && (len(rest) > 1 || odd))
+	case Floor:
+		up = neg
+	case Ceil:
+		up = !neg
+	case Truncate:
+		up = false
+	default:
+		up = rest[0] >= '5'
+	}
+	if up {
+		kept = incrementDigits(kept)
+	}
+	result := string(kept[:len(kept)-n])
+	if n > 0 {
+		result += "." + string(kept[len(kept)-n:])
+	}
+	v, err := strconv.ParseFloat(result, 64)
+	if err != nil {
+		return m.roundBinary(val, places)
+	}
+	return math.Copysign(v, val)
+}
+
+// RoundSignificant rounds val to the number of significant digits using the mode,
+// so low values keep their precision. Digits of the integer part are not rounded.
+func (m RoundingMode) RoundSignificant(val float64, digits int) float64 {
+	if val == 0 || math.IsInf(val, 0) || math.IsNaN(val) {
+		return val
+	}
+	places := digits - 1 - int(math.Floor(math.Log10(math.Abs(val))))
+	if places < 0 {
+		places = 0
+	}
+	return m.Round(val, float64(places))
+}
+
+// incrementDigits adds one to decimal number of digits.
+func incrementDigits(digits []byte) []byte {
+	for i := len(digits) - 1; i >= 0; i-- {
+		if digits[i] < '9' {
+			digits[i]++
+			return digits
+		}
+		digits[i] = '0'
+	}
+	return append([]byte{'1'}, digits...)
+}
+
+// roundBinary rounds val to places scaling its binary value,
+// it is used for not integer or negative places.
+func (m RoundingMode) roundBinary(val, places float64) float64 {
+	pow := math.Pow(10, places)
+	digit := val * pow
+	switch m {
+	case HalfEven:
+		digit = math.RoundToEven(digit)
+	case Floor:
+		digit = math.Floor(digit)
+	case Ceil:
+		digit = math.Ceil(digit)
+	case Truncate:
+		digit = math.Trunc(digit)
+	default:
+		digit = math.Round(digit)
+	}
+	return digit / pow
+}
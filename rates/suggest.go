@@ -0,0 +1,123 @@
+package rates
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	// maxSuggestions is maximum number of suggestions of unrecognized query
+	maxSuggestions = 5
+	// maxSuggestionDistance is maximum edit distance of suggested alias
+	maxSuggestionDistance = 2
+)
+
+// Suggestion is a known currency alias close to an unrecognized query word.
+type Suggestion struct {
+	Alias string `json:"alias"`
+	Code  string `json:"code"`
+}
+
+// String returns suggestion as "alias (code)".
+func (s Suggestion) String() string {
+	if s.Alias == s.Code {
+		return s.Code
+	}
+	return fmt.Sprintf("%v (%v)", s.Alias, s.Code)
+}
+
+// suggest returns aliases of required currencies and char codes of loaded catalog
+// which are the closest ones to words of unrecognized messages, for example,
+// "dollar" for "dollr". Closer aliases are first.
+func (c *Cfg) suggest(messages []parsedMsg) []Suggestion {
+	candidates := make(map[string]string, len(c.aliases))
+	c.catalogMu.RLock()
+	for _, item := range c.catalog {
+		if code := strings.ToLower(item.CharCode); code != "" {
+			candidates[code] = code
+		}
+	}
+	c.catalogMu.RUnlock()
+	for alias, code := range c.aliases {
+		candidates[alias] = code
+	}
+	distances := make(map[Suggestion]int)
+	for _, m := range messages {
+		if m.currency != "" {
+			continue
+		}
+		// aliases are folded, so words are compared in the same form
+		words := strings.FieldsFunc(c.foldText(m.msg), func(r rune) bool {
+			return !unicode.IsLetter(r)
+		})
+		for _, word := range words {
+			for alias, code := range candidates {
+				d := levenshtein(word, alias)
+				if d > maxSuggestionDistance || d >= len([]rune(alias)) {
+					continue
+				}
+				s := Suggestion{Alias: alias, Code: code}
+				if prev, ok := distances[s]; !ok || d < prev {
+					distances[s] = d
+				}
+			}
+		}
+	}
+	result := make([]Suggestion, 0, len(distances))
+	for s := range distances {
+		result = append(result, s)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		di, dj := distances[result[i]], distances[result[j]]
+		if di != dj {
+			return di < dj
+		}
+		return result[i].Alias < result[j].Alias
+	})
+	if len(result) > maxSuggestions {
+		result = result[:maxSuggestions]
+	}
+	return result
+}
+
+// suggestionsText returns suggestions as a hint of error message, it is empty without suggestions.
+func suggestionsText(suggestions []Suggestion) string {
+	if len(suggestions) == 0 {
+		return ""
+	}
+	values := make([]string, len(suggestions))
+	for i, s := range suggestions {
+		values[i] = s.String()
+	}
+	return ", did you mean: " + strings.Join(values, ", ")
+}
+
+// levenshtein returns edit distance of strings a and b in runes.
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = prev[j-1] + cost
+			if d := prev[j] + 1; d < curr[j] {
+				curr[j] = d
+			}
+			if d := curr[j-1] + 1; d < curr[j] {
+				curr[j] = d
+			}
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
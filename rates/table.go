@@ -0,0 +1,56 @@
+package rates
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TableRow is a currency row of daily rates table.
+type TableRow struct {
+	Code    string  `json:"code"`
+	NumCode string  `json:"num_code"`
+	Name    string  `json:"name"`
+	Nominal uint    `json:"nominal"`
+	Value   float64 `json:"value"`
+	Rate    float64 `json:"rate"`
+}
+
+// DayTable is a full rates table of a day, values are in RUB as they are published by CBR:
+// Value is a price of Nominal units, Rate is a price of one unit.
+type DayTable struct {
+	Date string     `json:"date"`
+	Rows []TableRow `json:"rows"`
+}
+
+// Table returns full rates table of the date, the table date is
+// the date of known rates, it can be before the requested date.
+func (c *Cfg) Table(ctx context.Context, date time.Time) (*DayTable, error) {
+	dayInfo, _, err := c.dailyRates(c.withRetryBudget(ctx), date)
+	if err != nil {
+		c.logger.Printf("rates table: %v", err)
+		return nil, &RateError{HTTPCode: http.StatusServiceUnavailable, Msg: "get daily rates"}
+	}
+	table := &DayTable{Date: date.Format("2006-01-02"), Rows: make([]TableRow, len(dayInfo.Items))}
+	if d, err := time.Parse("02.01.2006", dayInfo.Date); err == nil {
+		table.Date = d.Format("2006-01-02")
+	}
+	for i, item := range dayInfo.Items {
+		value, err := strconv.ParseFloat(strings.Replace(item.Value, ",", ".", 1), 64)
+		if err != nil || item.Nominal == 0 {
+			c.logger.Printf("rates table item %v: %v", item.CharCode, err)
+			return nil, &RateError{HTTPCode: http.StatusInternalServerError, Msg: "internal error"}
+		}
+		table.Rows[i] = TableRow{
+			Code:    strings.ToUpper(item.CharCode),
+			NumCode: item.NumCode,
+			Name:    item.Name,
+			Nominal: item.Nominal,
+			Value:   value,
+			Rate:    value / float64(item.Nominal),
+		}
+	}
+	return table, nil
+}
@@ -0,0 +1,94 @@
+package rates
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// xlsxParts are static parts of XLSX workbook with a single worksheet.
+// The workbook is written without spreadsheet library, so it has only parts
+// required by OOXML package and a worksheet of inline strings and numbers.
+var xlsxParts = []struct {
+	name    string
+	content string
+}{
+	{"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">
+<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>
+<Default Extension="xml" ContentType="application/xml"/>
+<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>
+<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>
+</Types>`},
+	{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>
+</Relationships>`},
+	{"xl/workbook.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">
+<sheets><sheet name="Rates" sheetId="1" r:id="rId1"/></sheets>
+</workbook>`},
+	{"xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>
+</Relationships>`},
+}
+
+// xlsxColumns are columns titles of rates table worksheet.
+var xlsxColumns = []interface{}{"Code", "Num code", "Name", "Nominal", "Value, RUB", "Rate, RUB"}
+
+// WriteXLSX writes the table to w as XLSX workbook. Its worksheet "Rates"
+// has the date header row followed by columns titles and currencies rows.
+func (t *DayTable) WriteXLSX(w io.Writer) error {
+	z := zip.NewWriter(w)
+	for _, part := range xlsxParts {
+		f, err := z.Create(part.name)
+		if err != nil {
+			return err
+		}
+		if _, err = io.WriteString(f, part.content); err != nil {
+			return err
+		}
+	}
+	f, err := z.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(t.sheet()); err != nil {
+		return err
+	}
+	return z.Close()
+}
+
+// sheet returns XLSX worksheet of the table.
+func (t *DayTable) sheet() []byte {
+	var b bytes.Buffer
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>` + "\n")
+	b.WriteString(`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	rows := [][]interface{}{{"Date", t.Date}, xlsxColumns}
+	for _, row := range t.Rows {
+		rows = append(rows, []interface{}{row.Code, row.NumCode, row.Name, row.Nominal, row.Value, row.Rate})
+	}
+	for i, row := range rows {
+		fmt.Fprintf(&b, `<row r="%d">`, i+1)
+		for j, value := range row {
+			ref := fmt.Sprintf("%c%d", 'A'+j, i+1)
+			switch v := value.(type) {
+			case string:
+				fmt.Fprintf(&b, `<c r="%v" t="inlineStr"><is><t>`, ref)
+				xml.EscapeText(&b, []byte(v))
+				b.WriteString(`</t></is></c>`)
+			case uint:
+				fmt.Fprintf(&b, `<c r="%v"><v>%d</v></c>`, ref, v)
+			case float64:
+				fmt.Fprintf(&b, `<c r="%v"><v>%v</v></c>`, ref, strconv.FormatFloat(v, 'f', -1, 64))
+			}
+		}
+		b.WriteString(`</row>`)
+	}
+	b.WriteString(`</sheetData></worksheet>`)
+	return b.Bytes()
+}
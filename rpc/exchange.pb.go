@@ -0,0 +1,594 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.9
+// 	protoc        (unknown)
+// source: exchange.proto
+
+package rpc
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// RatesRequest is rates request, date format is YYYY-MM-DD (default today).
+type RatesRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Query         string                 `protobuf:"bytes,1,opt,name=query,proto3" json:"query,omitempty"`
+	Date          string                 `protobuf:"bytes,2,opt,name=date,proto3" json:"date,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *RatesRequest) Reset() {
+	*x = RatesRequest{}
+	mi := &file_exchange_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RatesRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RatesRequest) ProtoMessage() {}
+
+func (x *RatesRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_exchange_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RatesRequest.ProtoReflect.Descriptor instead.
+func (*RatesRequest) Descriptor() ([]byte, []int) {
+	return file_exchange_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *RatesRequest) GetQuery() string {
+	if x != nil {
+		return x.Query
+	}
+	return ""
+}
+
+func (x *RatesRequest) GetDate() string {
+	if x != nil {
+		return x.Date
+	}
+	return ""
+}
+
+// Info is rates response.
+type Info struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Date          string                 `protobuf:"bytes,1,opt,name=date,proto3" json:"date,omitempty"`
+	Rates         []*RateItem            `protobuf:"bytes,2,rep,name=rates,proto3" json:"rates,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Info) Reset() {
+	*x = Info{}
+	mi := &file_exchange_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Info) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Info) ProtoMessage() {}
+
+func (x *Info) ProtoReflect() protoreflect.Message {
+	mi := &file_exchange_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Info.ProtoReflect.Descriptor instead.
+func (*Info) Descriptor() ([]byte, []int) {
+	return file_exchange_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *Info) GetDate() string {
+	if x != nil {
+		return x.Date
+	}
+	return ""
+}
+
+func (x *Info) GetRates() []*RateItem {
+	if x != nil {
+		return x.Rates
+	}
+	return nil
+}
+
+// RateItem is exchange rate item.
+type RateItem struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Msg           string                 `protobuf:"bytes,1,opt,name=msg,proto3" json:"msg,omitempty"`
+	Rate          map[string]float64     `protobuf:"bytes,2,rep,name=rate,proto3" json:"rate,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"fixed64,2,opt,name=value"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *RateItem) Reset() {
+	*x = RateItem{}
+	mi := &file_exchange_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *RateItem) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*RateItem) ProtoMessage() {}
+
+func (x *RateItem) ProtoReflect() protoreflect.Message {
+	mi := &file_exchange_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use RateItem.ProtoReflect.Descriptor instead.
+func (*RateItem) Descriptor() ([]byte, []int) {
+	return file_exchange_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *RateItem) GetMsg() string {
+	if x != nil {
+		return x.Msg
+	}
+	return ""
+}
+
+func (x *RateItem) GetRate() map[string]float64 {
+	if x != nil {
+		return x.Rate
+	}
+	return nil
+}
+
+// ConvertRequest is conversion request, date format is YYYY-MM-DD (default today).
+type ConvertRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	From          string                 `protobuf:"bytes,1,opt,name=from,proto3" json:"from,omitempty"`
+	To            string                 `protobuf:"bytes,2,opt,name=to,proto3" json:"to,omitempty"`
+	Amount        float64                `protobuf:"fixed64,3,opt,name=amount,proto3" json:"amount,omitempty"`
+	Date          string                 `protobuf:"bytes,4,opt,name=date,proto3" json:"date,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ConvertRequest) Reset() {
+	*x = ConvertRequest{}
+	mi := &file_exchange_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ConvertRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ConvertRequest) ProtoMessage() {}
+
+func (x *ConvertRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_exchange_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ConvertRequest.ProtoReflect.Descriptor instead.
+func (*ConvertRequest) Descriptor() ([]byte, []int) {
+	return file_exchange_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *ConvertRequest) GetFrom() string {
+	if x != nil {
+		return x.From
+	}
+	return ""
+}
+
+func (x *ConvertRequest) GetTo() string {
+	if x != nil {
+		return x.To
+	}
+	return ""
+}
+
+func (x *ConvertRequest) GetAmount() float64 {
+	if x != nil {
+		return x.Amount
+	}
+	return 0
+}
+
+func (x *ConvertRequest) GetDate() string {
+	if x != nil {
+		return x.Date
+	}
+	return ""
+}
+
+// ConvertResponse is conversion response.
+type ConvertResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Date          string                 `protobuf:"bytes,1,opt,name=date,proto3" json:"date,omitempty"`
+	Value         float64                `protobuf:"fixed64,2,opt,name=value,proto3" json:"value,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ConvertResponse) Reset() {
+	*x = ConvertResponse{}
+	mi := &file_exchange_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ConvertResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ConvertResponse) ProtoMessage() {}
+
+func (x *ConvertResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_exchange_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ConvertResponse.ProtoReflect.Descriptor instead.
+func (*ConvertResponse) Descriptor() ([]byte, []int) {
+	return file_exchange_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *ConvertResponse) GetDate() string {
+	if x != nil {
+		return x.Date
+	}
+	return ""
+}
+
+func (x *ConvertResponse) GetValue() float64 {
+	if x != nil {
+		return x.Value
+	}
+	return 0
+}
+
+// CodesRequest is currencies codes request with optional search filter.
+type CodesRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Search        string                 `protobuf:"bytes,1,opt,name=search,proto3" json:"search,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CodesRequest) Reset() {
+	*x = CodesRequest{}
+	mi := &file_exchange_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CodesRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CodesRequest) ProtoMessage() {}
+
+func (x *CodesRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_exchange_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CodesRequest.ProtoReflect.Descriptor instead.
+func (*CodesRequest) Descriptor() ([]byte, []int) {
+	return file_exchange_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *CodesRequest) GetSearch() string {
+	if x != nil {
+		return x.Search
+	}
+	return ""
+}
+
+// CodesResponse is currencies codes response.
+type CodesResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Items         []*CodeItem            `protobuf:"bytes,1,rep,name=items,proto3" json:"items,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CodesResponse) Reset() {
+	*x = CodesResponse{}
+	mi := &file_exchange_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CodesResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CodesResponse) ProtoMessage() {}
+
+func (x *CodesResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_exchange_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CodesResponse.ProtoReflect.Descriptor instead.
+func (*CodesResponse) Descriptor() ([]byte, []int) {
+	return file_exchange_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *CodesResponse) GetItems() []*CodeItem {
+	if x != nil {
+		return x.Items
+	}
+	return nil
+}
+
+// CodeItem is currency code item.
+type CodeItem struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Id            string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Name          string                 `protobuf:"bytes,2,opt,name=name,proto3" json:"name,omitempty"`
+	EngName       string                 `protobuf:"bytes,3,opt,name=eng_name,json=engName,proto3" json:"eng_name,omitempty"`
+	Nominal       uint32                 `protobuf:"varint,4,opt,name=nominal,proto3" json:"nominal,omitempty"`
+	ParentCode    string                 `protobuf:"bytes,5,opt,name=parent_code,json=parentCode,proto3" json:"parent_code,omitempty"`
+	NumCode       string                 `protobuf:"bytes,6,opt,name=num_code,json=numCode,proto3" json:"num_code,omitempty"`
+	CharCode      string                 `protobuf:"bytes,7,opt,name=char_code,json=charCode,proto3" json:"char_code,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CodeItem) Reset() {
+	*x = CodeItem{}
+	mi := &file_exchange_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CodeItem) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CodeItem) ProtoMessage() {}
+
+func (x *CodeItem) ProtoReflect() protoreflect.Message {
+	mi := &file_exchange_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CodeItem.ProtoReflect.Descriptor instead.
+func (*CodeItem) Descriptor() ([]byte, []int) {
+	return file_exchange_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *CodeItem) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *CodeItem) GetName() string {
+	if x != nil {
+		return x.Name
+	}
+	return ""
+}
+
+func (x *CodeItem) GetEngName() string {
+	if x != nil {
+		return x.EngName
+	}
+	return ""
+}
+
+func (x *CodeItem) GetNominal() uint32 {
+	if x != nil {
+		return x.Nominal
+	}
+	return 0
+}
+
+func (x *CodeItem) GetParentCode() string {
+	if x != nil {
+		return x.ParentCode
+	}
+	return ""
+}
+
+func (x *CodeItem) GetNumCode() string {
+	if x != nil {
+		return x.NumCode
+	}
+	return ""
+}
+
+func (x *CodeItem) GetCharCode() string {
+	if x != nil {
+		return x.CharCode
+	}
+	return ""
+}
+
+var File_exchange_proto protoreflect.FileDescriptor
+
+const file_exchange_proto_rawDesc = "" +
+	"\n" +
+	"\x0eexchange.proto\x12\bexchange\"8\n" +
+	"\fRatesRequest\x12\x14\n" +
+	"\x05query\x18\x01 \x01(\tR\x05query\x12\x12\n" +
+	"\x04date\x18\x02 \x01(\tR\x04date\"D\n" +
+	"\x04Info\x12\x12\n" +
+	"\x04date\x18\x01 \x01(\tR\x04date\x12(\n" +
+	"\x05rates\x18\x02 \x03(\v2\x12.exchange.RateItemR\x05rates\"\x87\x01\n" +
+	"\bRateItem\x12\x10\n" +
+	"\x03msg\x18\x01 \x01(\tR\x03msg\x120\n" +
+	"\x04rate\x18\x02 \x03(\v2\x1c.exchange.RateItem.RateEntryR\x04rate\x1a7\n" +
+	"\tRateEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\x01R\x05value:\x028\x01\"`\n" +
+	"\x0eConvertRequest\x12\x12\n" +
+	"\x04from\x18\x01 \x01(\tR\x04from\x12\x0e\n" +
+	"\x02to\x18\x02 \x01(\tR\x02to\x12\x16\n" +
+	"\x06amount\x18\x03 \x01(\x01R\x06amount\x12\x12\n" +
+	"\x04date\x18\x04 \x01(\tR\x04date\";\n" +
+	"\x0fConvertResponse\x12\x12\n" +
+	"\x04date\x18\x01 \x01(\tR\x04date\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\x01R\x05value\"&\n" +
+	"\fCodesRequest\x12\x16\n" +
+	"\x06search\x18\x01 \x01(\tR\x06search\"9\n" +
+	"\rCodesResponse\x12(\n" +
+	"\x05items\x18\x01 \x03(\v2\x12.exchange.CodeItemR\x05items\"\xbc\x01\n" +
+	"\bCodeItem\x12\x0e\n" +
+	"\x02id\x18\x01 \x01(\tR\x02id\x12\x12\n" +
+	"\x04name\x18\x02 \x01(\tR\x04name\x12\x19\n" +
+	"\beng_name\x18\x03 \x01(\tR\aengName\x12\x18\n" +
+	"\anominal\x18\x04 \x01(\rR\anominal\x12\x1f\n" +
+	"\vparent_code\x18\x05 \x01(\tR\n" +
+	"parentCode\x12\x19\n" +
+	"\bnum_code\x18\x06 \x01(\tR\anumCode\x12\x1b\n" +
+	"\tchar_code\x18\a \x01(\tR\bcharCode2\xbb\x01\n" +
+	"\bExchange\x122\n" +
+	"\bGetRates\x12\x16.exchange.RatesRequest\x1a\x0e.exchange.Info\x12>\n" +
+	"\aConvert\x12\x18.exchange.ConvertRequest\x1a\x19.exchange.ConvertResponse\x12;\n" +
+	"\bGetCodes\x12\x16.exchange.CodesRequest\x1a\x17.exchange.CodesResponseB\x1fZ\x1dgithub.com/z0rr0/exchange/rpcb\x06proto3"
+
+var (
+	file_exchange_proto_rawDescOnce sync.Once
+	file_exchange_proto_rawDescData []byte
+)
+
+func file_exchange_proto_rawDescGZIP() []byte {
+	file_exchange_proto_rawDescOnce.Do(func() {
+		file_exchange_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_exchange_proto_rawDesc), len(file_exchange_proto_rawDesc)))
+	})
+	return file_exchange_proto_rawDescData
+}
+
+var file_exchange_proto_msgTypes = make([]protoimpl.MessageInfo, 9)
+var file_exchange_proto_goTypes = []any{
+	(*RatesRequest)(nil),    // 0: exchange.RatesRequest
+	(*Info)(nil),            // 1: exchange.Info
+	(*RateItem)(nil),        // 2: exchange.RateItem
+	(*ConvertRequest)(nil),  // 3: exchange.ConvertRequest
+	(*ConvertResponse)(nil), // 4: exchange.ConvertResponse
+	(*CodesRequest)(nil),    // 5: exchange.CodesRequest
+	(*CodesResponse)(nil),   // 6: exchange.CodesResponse
+	(*CodeItem)(nil),        // 7: exchange.CodeItem
+	nil,                     // 8: exchange.RateItem.RateEntry
+}
+var file_exchange_proto_depIdxs = []int32{
+	2, // 0: exchange.Info.rates:type_name -> exchange.RateItem
+	8, // 1: exchange.RateItem.rate:type_name -> exchange.RateItem.RateEntry
+	7, // 2: exchange.CodesResponse.items:type_name -> exchange.CodeItem
+	0, // 3: exchange.Exchange.GetRates:input_type -> exchange.RatesRequest
+	3, // 4: exchange.Exchange.Convert:input_type -> exchange.ConvertRequest
+	5, // 5: exchange.Exchange.GetCodes:input_type -> exchange.CodesRequest
+	1, // 6: exchange.Exchange.GetRates:output_type -> exchange.Info
+	4, // 7: exchange.Exchange.Convert:output_type -> exchange.ConvertResponse
+	6, // 8: exchange.Exchange.GetCodes:output_type -> exchange.CodesResponse
+	6, // [6:9] is the sub-list for method output_type
+	3, // [3:6] is the sub-list for method input_type
+	3, // [3:3] is the sub-list for extension type_name
+	3, // [3:3] is the sub-list for extension extendee
+	0, // [0:3] is the sub-list for field type_name
+}
+
+func init() { file_exchange_proto_init() }
+func file_exchange_proto_init() {
+	if File_exchange_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_exchange_proto_rawDesc), len(file_exchange_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   9,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_exchange_proto_goTypes,
+		DependencyIndexes: file_exchange_proto_depIdxs,
+		MessageInfos:      file_exchange_proto_msgTypes,
+	}.Build()
+	File_exchange_proto = out.File
+	file_exchange_proto_goTypes = nil
+	file_exchange_proto_depIdxs = nil
+}
@@ -0,0 +1,100 @@
+// Package rpc contains gRPC interface of exchange service.
+//
+// Go code is generated from exchange.proto:
+//
+//	protoc --go_out=. --go_opt=paths=source_relative \
+//		--go-grpc_out=. --go-grpc_opt=paths=source_relative exchange.proto
+package rpc
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/z0rr0/exchange/rates"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Server is gRPC exchange service implementation.
+type Server struct {
+	UnimplementedExchangeServer
+	cfg *rates.Cfg
+}
+
+// NewServer returns new gRPC server with registered exchange service.
+func NewServer(cfg *rates.Cfg) *grpc.Server {
+	server := grpc.NewServer()
+	RegisterExchangeServer(server, &Server{cfg: cfg})
+	return server
+}
+
+// statusError converts rates error to gRPC status error.
+func statusError(err error) error {
+	rateError, ok := err.(*rates.RateError)
+	if !ok {
+		return status.Error(codes.Internal, err.Error())
+	}
+	switch rateError.HTTPCode {
+	case http.StatusBadRequest:
+		return status.Error(codes.InvalidArgument, rateError.Msg)
+	case http.StatusServiceUnavailable:
+		return status.Error(codes.Unavailable, rateError.Msg)
+	}
+	return status.Error(codes.Internal, rateError.Msg)
+}
+
+// GetRates returns rates info for comma-separated query messages.
+func (s *Server) GetRates(ctx context.Context, req *RatesRequest) (*Info, error) {
+	date, err := s.cfg.ResolveDate(ctx, req.GetDate())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	query := req.GetQuery()
+	if query == "" {
+		query = s.cfg.DefaultQuery
+	}
+	info, err := s.cfg.GetRates(date, query)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	result := &Info{Date: info.Date, Rates: make([]*RateItem, len(info.Rates))}
+	for i, item := range info.Rates {
+		result.Rates[i] = &RateItem{Msg: item.Msg, Rate: item.Rate}
+	}
+	return result, nil
+}
+
+// Convert converts an amount of one currency to another one.
+func (s *Server) Convert(ctx context.Context, req *ConvertRequest) (*ConvertResponse, error) {
+	date, err := s.cfg.ResolveDate(ctx, req.GetDate())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	value, err := s.cfg.Convert(date, req.GetFrom(), req.GetTo(), req.GetAmount())
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return &ConvertResponse{Date: date.Format("2006-01-02"), Value: value}, nil
+}
+
+// GetCodes returns available currencies codes.
+func (s *Server) GetCodes(ctx context.Context, req *CodesRequest) (*CodesResponse, error) {
+	items, err := s.cfg.SearchCodes(req.GetSearch())
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, "get currencies codes")
+	}
+	result := &CodesResponse{Items: make([]*CodeItem, len(items))}
+	for i, item := range items {
+		result.Items[i] = &CodeItem{
+			Id:         item.ID,
+			Name:       item.Name,
+			EngName:    item.EngName,
+			Nominal:    uint32(item.Nominal),
+			ParentCode: item.ParentCode,
+			NumCode:    item.NumCode,
+			CharCode:   item.CharCode,
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,88 @@
+package rpc
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/z0rr0/exchange/rates"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+const (
+	testConfig = "../config.example.json"
+	testDaily  = "../rates/testdata/daily.xml"
+)
+
+var (
+	logger = log.New(os.Stdout, "TEST: ", log.Ldate|log.Ltime|log.Lshortfile)
+)
+
+// testClient returns gRPC client connected to in-process server.
+func testClient(t *testing.T) (ExchangeClient, func()) {
+	data, err := ioutil.ReadFile(testDaily)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/xml")
+		w.Write(data)
+	}))
+	cfg, err := rates.New(testConfig, logger, "rpc_test/0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.RatesURL = upstream.URL
+	err = cfg.SetRequiredCodes(map[string][]string{"usd": {"$"}, "eur": {"€"}, "rub": {"₽"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := bufconn.Listen(1 << 20)
+	server := NewServer(cfg)
+	go server.Serve(listener)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, s string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewExchangeClient(conn), func() {
+		conn.Close()
+		server.Stop()
+		upstream.Close()
+	}
+}
+
+func TestServer_GetRates(t *testing.T) {
+	client, closer := testClient(t)
+	defer closer()
+
+	info, err := client.GetRates(context.Background(), &RatesRequest{Query: "100 usd", Date: "2017-03-02"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.GetDate() != "2017-03-02" || len(info.GetRates()) != 1 {
+		t.Fatalf("unexpected response: %v", info)
+	}
+	rate := info.GetRates()[0].GetRate()
+	if rate["usd"] != 100 || rate["rub"] != 5812.05 || rate["eur"] != 94.83 {
+		t.Errorf("unexpected rate: %v", rate)
+	}
+	_, err = client.GetRates(context.Background(), &RatesRequest{Query: "100 usd", Date: "bad"})
+	if s, ok := status.FromError(err); !ok || s.Code() != codes.InvalidArgument {
+		t.Errorf("unexpected error: %v", err)
+	}
+}